@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Access log formats for ACCESS_LOG.
+const (
+	accessLogOff      = "off"
+	accessLogJSON     = "json"     // slog line, same stream as application logs
+	accessLogCommon   = "common"   // NCSA common log format
+	accessLogCombined = "combined" // common + referer and user agent
+)
+
+// accessLog logs every request on the public listener in the configured
+// format. Unknown formats fall back to JSON.
+func accessLog(format string, next http.Handler) http.Handler {
+	if format == accessLogOff {
+		return next
+	}
+	var mu sync.Mutex // serializes plain-text lines on out
+	var out io.Writer = os.Stdout
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		elapsed := time.Since(start)
+
+		switch format {
+		case accessLogCommon, accessLogCombined:
+			line := fmt.Sprintf("%s - - [%s] %q %d %d",
+				clientIP(r), start.Format("02/Jan/2006:15:04:05 -0700"),
+				r.Method+" "+r.URL.RequestURI()+" "+r.Proto, rec.status, rec.bytes)
+			if format == accessLogCombined {
+				line += fmt.Sprintf(" %q %q", r.Referer(), r.UserAgent())
+			}
+			mu.Lock()
+			fmt.Fprintln(out, line)
+			mu.Unlock()
+		default:
+			slog.Info("access",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", rec.status,
+				"duration_ms", float64(elapsed.Microseconds())/1000,
+				"bytes", rec.bytes,
+				"client", clientIP(r),
+				"request_id", w.Header().Get("X-Request-ID"),
+			)
+		}
+	})
+}
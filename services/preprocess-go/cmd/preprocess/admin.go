@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// adminMux holds the ops endpoints. With ADMIN_ADDR set it is served on its
+// own listener and /metrics and /stats leave the public mux, so nothing but
+// /preprocess and the probes can be reached through the ingress.
+func (s *server) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.healthHandler)
+	mux.HandleFunc("/livez", s.livezHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	if s.enabled("debug") {
+		mux.Handle("/debug/", debugMux())
+	}
+	if s.enabled("metrics") {
+		mux.Handle("/metrics", compress(s.gate("metrics", metricsHandler)))
+	}
+	if s.enabled("stats") {
+		mux.Handle("/stats", compress(s.gate("stats", statsHandler)))
+	}
+	if s.enabled("admin") {
+		// Knobs that change a running instance need a token, not just
+		// network access to the admin listener.
+		if s.cfg.AdminToken != "" {
+			mux.Handle("/admin/reload", s.adminAuth(s.reloadHandler))
+			mux.Handle("/admin/config", compress(s.adminAuth(s.adminConfigHandler)))
+			mux.Handle("/admin/rate-limit", s.adminAuth(s.adminRateLimitHandler))
+			mux.Handle("/admin/features", s.adminAuth(s.adminFeaturesHandler))
+			mux.Handle("/admin/cache/flush", s.adminAuth(s.adminFlushHandler))
+			mux.Handle("/admin/jobs", compress(s.adminAuth(s.adminJobsHandler)))
+		}
+	}
+	return mux
+}
+
+// adminAuth requires Authorization: Bearer ADMIN_TOKEN. Without a token
+// configured it refuses everything.
+func (s *server) adminAuth(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tok, ok := bearerToken(r)
+		want := s.adminToken.get()
+		if !ok || want == "" || subtle.ConstantTimeCompare([]byte(tok), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid admin token", nil)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// Changes made through the admin API apply to this instance only and last
+// until it restarts; a config reload puts the rate limit back to the file's.
+
+type rateLimitSettings struct {
+	RPS   float64 `json:"rps"`
+	Burst int     `json:"burst"`
+}
+
+// adminConfigHandler shows the knobs a running instance is using.
+func (s *server) adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "GET only", nil)
+		return
+	}
+	live := s.live.Load()
+	var rl rateLimitSettings
+	rl.RPS, rl.Burst = s.limiter.limits()
+	feats := map[string]string{}
+	for _, f := range features {
+		switch {
+		case !s.enabled(f):
+			feats[f] = "disabled" // DISABLE_FEATURES, until restart
+		case !s.serving(f):
+			feats[f] = "off"
+		default:
+			feats[f] = "on"
+		}
+	}
+	writeJSON(w, map[string]any{
+		"rate_limit": rl,
+		"features":   feats,
+		"defaults":   map[string]int{"max_dim": live.defaultMaxDim, "quality": live.defaultQuality},
+		"limits": map[string]int{
+			"min_dim": live.minDim, "max_dim": live.maxDim,
+			"min_quality": live.minQuality, "max_quality": live.maxQuality,
+		},
+		"pool": s.pool.stats(),
+	})
+}
+
+// adminRateLimitHandler replaces RATE_LIMIT_RPS and RATE_LIMIT_BURST:
+//
+//	PUT /admin/rate-limit {"rps": 20, "burst": 40}
+func (s *server) adminRateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", http.MethodPut)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "PUT only", nil)
+		return
+	}
+	var rl rateLimitSettings
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&rl); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_param", "want {\"rps\": N, \"burst\": N}", nil)
+		return
+	}
+	if rl.RPS < 0 || (rl.RPS > 0 && rl.Burst < 1) {
+		writeError(w, http.StatusBadRequest, "invalid_param", "rps must not be negative and burst must be at least 1", nil)
+		return
+	}
+	s.limiter.setRate(rl.RPS, rl.Burst)
+	slog.Info("rate limit changed through admin API", "rps", rl.RPS, "burst", rl.Burst)
+	writeJSON(w, rl)
+}
+
+// adminFeaturesHandler switches features off or back on:
+//
+//	POST /admin/features {"feature": "sprite", "enabled": false}
+func (s *server) adminFeaturesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "POST only", nil)
+		return
+	}
+	var body struct {
+		Feature string `json:"feature"`
+		Enabled *bool  `json:"enabled"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&body); err != nil || body.Enabled == nil {
+		writeError(w, http.StatusBadRequest, "invalid_param", "want {\"feature\": name, \"enabled\": bool}", nil)
+		return
+	}
+	if !s.switchable(body.Feature) {
+		writeError(w, http.StatusConflict, "not_switchable",
+			fmt.Sprintf("%q can't be switched at runtime (unknown, admin, debug, or in DISABLE_FEATURES)", body.Feature), nil)
+		return
+	}
+	s.setServing(body.Feature, *body.Enabled)
+	slog.Info("feature switched through admin API", "feature", body.Feature, "enabled", *body.Enabled)
+	writeJSON(w, map[string]any{"feature": body.Feature, "enabled": *body.Enabled})
+}
+
+// adminFlushHandler empties every result cache layer, Redis included, so
+// it affects all replicas sharing it.
+func (s *server) adminFlushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "POST only", nil)
+		return
+	}
+	tc, ok := s.cache.(tieredCache)
+	if !ok {
+		writeJSON(w, map[string]any{"flushed": map[string]int{}})
+		return
+	}
+	flushed, err := tc.flush(r.Context())
+	slog.Info("result cache flushed through admin API", "flushed", flushed, "err", err)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "flush_failed", err.Error(), map[string]any{"flushed": flushed})
+		return
+	}
+	writeJSON(w, map[string]any{"flushed": flushed})
+}
+
+// adminJobsHandler lists jobs queued for or holding a worker slot.
+func (s *server) adminJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "GET only", nil)
+		return
+	}
+	writeJSON(w, map[string]any{"jobs": s.jobs.list()})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// reloadHandler re-reads the config file now instead of waiting for the
+// watcher to notice the change.
+func (s *server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "POST only", nil)
+		return
+	}
+	if s.watcher == nil {
+		writeError(w, http.StatusConflict, "no_config_file", "no config file to reload", nil)
+		return
+	}
+	if err := s.watcher.reload(s); err != nil {
+		slog.Error("config reload failed; keeping previous settings", "path", s.watcher.path, "err", err)
+		writeError(w, http.StatusUnprocessableEntity, "invalid_config", err.Error(), nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startAdminServer serves adminMux on addr until ctx is done, then drains it
+// alongside the public server.
+func (s *server) startAdminServer(ctx context.Context, addr string) error {
+	ln, err := listen(addr, s.cfg.UnixSocketMode)
+	if err != nil {
+		return err
+	}
+	// No write timeout: CPU profiles and traces stream for ?seconds=N.
+	srv := &http.Server{Handler: s.adminMux(), ReadHeaderTimeout: defaultReadHeaderTimeout}
+	go func() {
+		slog.Info("admin endpoints listening", "addr", addr)
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			slog.Error("admin server stopped", "err", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		drainCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(drainCtx)
+	}()
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// flagAlerter posts a Slack-compatible message to MODERATION_WEBHOOK_URL
+// whenever the moderation stage, the content scan behind MALWARE_SCAN_URL,
+// flags an upload, so trust & safety hears about it as it happens rather
+// than from the logs. Like Sentry reports, alerts go out from a background
+// goroutine and are dropped when the hook is backed up.
+//
+// The message names the reason (the scanner's signature), caller, request
+// ID and the upload's hash and size, and carries a thumbnail of it as a
+// data: URL in "thumbnail". Slack only renders images it can fetch, so it
+// shows the text; the relay in front of the channel, or whoever opens the
+// payload, gets the picture.
+type flagAlerter struct {
+	url    secretValue
+	client *downstream
+	queue  chan flagAlert
+}
+
+type flagAlert struct {
+	reason    string
+	requestID string
+	caller    string
+	path      string
+	sha256    string
+	bytes     int
+	thumbnail []byte // JPEG, nil if the upload isn't an image we decode
+}
+
+const (
+	flagAlertQueueSize       = 64
+	moderationWebhookTimeout = 5 * time.Second
+
+	// flagThumbMaxDim is the long side of an alert's thumbnail: enough to
+	// judge the image by, small enough for a webhook payload.
+	flagThumbMaxDim = 320
+)
+
+func newFlagAlerter(webhookURL string, client *downstream) *flagAlerter {
+	a := &flagAlerter{
+		client: client,
+		queue:  make(chan flagAlert, flagAlertQueueSize),
+	}
+	a.url.set(webhookURL)
+	go a.loop()
+	return a
+}
+
+func (a *flagAlerter) alert(al flagAlert) {
+	select {
+	case a.queue <- al:
+	default:
+		slog.Warn("moderation webhook queue full, dropping alert", "request_id", al.requestID)
+	}
+}
+
+func (a *flagAlerter) loop() {
+	for al := range a.queue {
+		summary := fmt.Sprintf("Upload flagged: %s", al.reason)
+		details := fmt.Sprintf("*Reason:* %s\n*Caller:* `%s`\n*Endpoint:* `%s`\n*Request:* `%s`\n*SHA-256:* `%s`\n*Size:* %d bytes",
+			al.reason, al.caller, al.path, al.requestID, al.sha256, al.bytes)
+		// text is the notification fallback; blocks is what Slack renders.
+		payload := map[string]any{
+			"text": summary,
+			"blocks": []any{
+				map[string]any{"type": "header", "text": map[string]any{"type": "plain_text", "text": ":rotating_light: " + summary}},
+				map[string]any{"type": "section", "text": map[string]any{"type": "mrkdwn", "text": details}},
+			},
+		}
+		if al.thumbnail != nil {
+			payload["thumbnail"] = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(al.thumbnail)
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			continue
+		}
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, a.url.get(), bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := a.client.do(req)
+		if err != nil {
+			slog.Warn("moderation webhook failed", "request_id", al.requestID, "err", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Warn("moderation webhook rejected", "request_id", al.requestID, "status", resp.StatusCode)
+		}
+	}
+}
+
+// alertFlagged queues an alert for an upload the scan rejected, if a
+// webhook is configured.
+func (s *server) alertFlagged(r *http.Request, reason string, b []byte) {
+	if s.alerter == nil {
+		return
+	}
+	s.alerter.alert(flagAlert{
+		reason:    reason,
+		requestID: requestID(r.Context()),
+		caller:    callerID(r),
+		path:      r.URL.Path,
+		sha256:    hashHex(b),
+		bytes:     len(b),
+		thumbnail: s.flagThumbnail(r.Context(), b),
+	})
+}
+
+// flagThumbnail renders flagged upload b small, or returns nil if it isn't
+// an image within the limits. This is the one place flagged bytes are
+// decoded: on a worker slot, after the same header checks as any upload,
+// and only into this thumbnail, never into a response.
+func (s *server) flagThumbnail(ctx context.Context, b []byte) []byte {
+	var thumb []byte
+	err := s.runJob(ctx, func(ctx context.Context) error {
+		f, cfg, err := probeImage(b, "")
+		if err != nil {
+			return err
+		}
+		if err := s.checkLimits(cfg); err != nil {
+			return err
+		}
+		img, err := s.decodeFor(ctx, f, b, cfg, flagThumbMaxDim)
+		if err != nil {
+			return err
+		}
+		w, h, ok := scaledSize(img.Bounds(), flagThumbMaxDim)
+		if ok {
+			small := image.NewRGBA(image.Rect(0, 0, max(1, w), max(1, h)))
+			draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+			img = small
+		}
+		var out bytes.Buffer
+		if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: 70}); err != nil {
+			return err
+		}
+		thumb = out.Bytes()
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+	return thumb
+}
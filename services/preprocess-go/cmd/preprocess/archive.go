@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// POST /archive takes a ZIP of photos, as restaurant onboarding sends them,
+// processes every image in it as /preprocess would with max_dim, quality and
+// sanitize, and answers with a ZIP of the outputs plus a manifest.json:
+//
+//	{"entries":[{"name":"mains/curry.jpg","output":"mains/curry.jpg","width":1280,"height":960,"bytes":81234},
+//	            {"name":"menu.pdf","error":"unsupported_format"}]}
+//
+// A bad entry is recorded in the manifest instead of failing the batch; an
+// unreadable archive, or a full queue, fails all of it. Duplicates within the
+// batch are marked too. Entries are read and processed one at a time, so
+// memory stays that of a single image.
+
+type archiveEntry struct {
+	Name   string `json:"name"`
+	Output string `json:"output,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Bytes  int    `json:"bytes,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	Camera *cameraInfo `json:"camera,omitempty"`
+
+	Duplicate   string `json:"duplicate,omitempty"` // exact or near
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+}
+
+func (s *server) archiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		reject(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "POST only")
+		return
+	}
+	live := s.live.Load()
+	maxDim := intParam(r, "max_dim", live.defaultMaxDim)
+	jpegQ := intParam(r, "quality", live.defaultQuality)
+	maxDim = min(max(maxDim, live.minDim), live.maxDim)
+	jpegQ = min(max(jpegQ, live.minQuality), live.maxQuality)
+	sanitize, err := s.sanitizeParam(r)
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+	skipDuplicates, err := duplicatesParam(r)
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+
+	uploadStart := time.Now()
+	if !s.parseUploadWithin(w, r, s.cfg.ArchiveMaxBytes) {
+		return
+	}
+	file, _, err := r.FormFile("archive")
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "missing_image", "missing form field 'archive'")
+		return
+	}
+	b, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "malformed_upload", "failed to read upload")
+		return
+	}
+	recordStage(r.Context(), "upload", time.Since(uploadStart))
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "invalid_archive", "upload is not a ZIP archive")
+		return
+	}
+	files := archiveImages(zr)
+	if len(files) == 0 {
+		reject(w, r, http.StatusBadRequest, "invalid_archive", "archive holds no files")
+		return
+	}
+	if len(files) > s.cfg.ArchiveMaxEntries {
+		reject(w, r, http.StatusBadRequest, "invalid_archive", fmt.Sprintf("at most %d files per archive", s.cfg.ArchiveMaxEntries))
+		return
+	}
+	// The scanner unpacks archives itself.
+	if !s.scanInput(w, r, b) {
+		return
+	}
+	inputBytes.add(float64(len(b)))
+	inputHash := hashHex(b)
+	logAttrs(r.Context(), "input_bytes", len(b), "inputs", len(files))
+
+	opts := options{maxDim: maxDim, quality: jpegQ, forceEncode: r.URL.Query().Has("quality") || sanitize, sanitize: sanitize}
+	limit := s.uploadLimit(r.Context())
+	entries := make([]archiveEntry, len(files))
+	var set []*result
+	defer func() { releaseAll(set) }()
+	names := map[string]bool{"manifest.json": true}
+	// The first entry with each upload digest and output dHash, which
+	// later ones are duplicates of.
+	firstByDigest := map[string]string{}
+	type original struct {
+		name string
+		hash uint64
+	}
+	var originals []original
+	duplicates := 0
+	for i, f := range files {
+		entries[i].Name = f.Name
+		var exactOf string
+		e, err := s.processEntry(r.Context(), f, limit, opts, func(digest string) bool {
+			exactOf = firstByDigest[digest]
+			return exactOf != "" && skipDuplicates
+		})
+		if code := entryError(err); code != "" {
+			entries[i].Error = code
+			continue
+		} else if err != nil {
+			s.writeJobError(w, r, err)
+			return
+		}
+		if exactOf != "" {
+			entries[i].Duplicate, entries[i].DuplicateOf = "exact", exactOf
+			duplicates++
+			if skipDuplicates {
+				continue
+			}
+		}
+		res := e.res
+		if entries[i].Duplicate == "" && e.hashed {
+			for _, o := range originals {
+				if nearDuplicate(o.hash, e.hash) {
+					entries[i].Duplicate, entries[i].DuplicateOf = "near", o.name
+					duplicates++
+					break
+				}
+			}
+		}
+		switch {
+		case entries[i].Duplicate == "":
+			firstByDigest[e.digest] = f.Name
+			if e.hashed {
+				originals = append(originals, original{f.Name, e.hash})
+			}
+		case skipDuplicates:
+			res.release()
+			continue
+		}
+		res.name = outputName(f.Name, fileExt(res.ct), names)
+		entries[i].Output, entries[i].Width, entries[i].Height, entries[i].Bytes = res.name, res.width, res.height, len(res.body)
+		entries[i].Camera = readCamera(e.input)
+		set = append(set, res)
+	}
+	logAttrs(r.Context(), "outputs", len(set), "duplicates", duplicates)
+
+	manifest, _ := json.Marshal(map[string]any{"entries": entries})
+	bundle := append(set[:len(set):len(set)], &result{body: manifest, ct: "application/json", name: "manifest.json"})
+	if acceptsTar(r) {
+		writeTar(w, bundle)
+	} else {
+		writeZip(w, bundle)
+	}
+	s.completed(r, inputHash, len(b), len(set), set)
+}
+
+// archiveImages lists the files in zr, skipping directories and the
+// dotfiles and __MACOSX/ resource forks that desktop zip tools add.
+func archiveImages(zr *zip.Reader) []*zip.File {
+	var files []*zip.File
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") || strings.HasPrefix(path.Base(f.Name), ".") {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// readEntry reads one archive entry, no larger than limit.
+func readEntry(ctx context.Context, f *zip.File, limit int64) ([]byte, error) {
+	if f.UncompressedSize64 > uint64(limit) {
+		return nil, errEntryTooLarge
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadEntry, err)
+	}
+	// The header's size can lie; the reader stops at limit regardless.
+	b, err := io.ReadAll(io.LimitReader(rc, limit+1))
+	rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadEntry, err)
+	}
+	if int64(len(b)) > limit {
+		return nil, errEntryTooLarge
+	}
+	return motionStill(ctx, b), nil
+}
+
+// processedEntry is an archive entry and what became of it.
+type processedEntry struct {
+	input  []byte // the entry as read, after motionStill
+	digest string // hashHex of input
+	res    *result
+	hash   uint64 // dHash of res, if it has a meaningful one
+	hashed bool
+}
+
+// processEntry reads and processes an entry on a worker slot with its own
+// PROCESS_TIMEOUT. skip is asked with the entry's digest before processing,
+// and res is nil if it says to leave the entry out. A failure to hash the
+// output only leaves it unhashed, since the near-duplicate check is an
+// extra.
+//
+// The worker can outlive a timeout, so it hands the entry back under mu and
+// stops calling skip once the caller has given up; an output that arrives
+// too late is released instead.
+func (s *server) processEntry(ctx context.Context, f *zip.File, limit int64, opts options, skip func(digest string) bool) (processedEntry, error) {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.ProcessTimeout)
+	defer cancel()
+	var (
+		mu   sync.Mutex
+		gone bool
+		out  = make(chan processedEntry, 1)
+	)
+	err := s.runJob(ctx, func(ctx context.Context) (err error) {
+		var e processedEntry
+		b, err := readEntry(ctx, f, limit)
+		if err != nil {
+			return err
+		}
+		e.input, e.digest = b, hashHex(b)
+		mu.Lock()
+		skipped := !gone && skip(e.digest)
+		mu.Unlock()
+		if !skipped {
+			if s.cfg.FFmpegPath != "" && s.serving("video") && isJPEG2000(b) {
+				if b, err = s.jp2Still(ctx, b); err != nil {
+					return err
+				}
+				opts.forceEncode = true
+			}
+			if e.res, err = s.process(ctx, b, http.DetectContentType(b), opts); err != nil {
+				return err
+			}
+			if hash, ok, err := outputHash(e.res); err == nil {
+				e.hash, e.hashed = hash, ok
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if gone {
+			if e.res != nil {
+				e.res.release()
+			}
+			return ctx.Err()
+		}
+		out <- e
+		return nil
+	})
+	mu.Lock()
+	gone = true
+	mu.Unlock()
+	var e processedEntry
+	select {
+	case e = <-out:
+	default:
+	}
+	if err != nil {
+		if e.res != nil {
+			e.res.release()
+		}
+		if errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil {
+			err = errEntryTimeout
+		}
+		return processedEntry{}, err
+	}
+	return e, nil
+}
+
+var (
+	errEntryTooLarge = errors.New("archive entry exceeds the upload limit")
+	errBadEntry      = errors.New("archive entry can't be read")
+	errEntryTimeout  = errors.New("archive entry timed out")
+)
+
+// entryError names the error code for failures that are the entry's own,
+// and returns "" for those that should fail the whole request.
+func entryError(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, errEntryTooLarge):
+		return "upload_too_large"
+	case errors.Is(err, errBadEntry):
+		return "malformed_upload"
+	case errors.Is(err, errUnsupportedImage):
+		return "unsupported_format"
+	case errors.Is(err, errTooManyPixels):
+		return "too_many_pixels"
+	case errors.Is(err, errAspectRatio):
+		return "aspect_ratio_exceeded"
+	case errors.Is(err, errBlankImage):
+		return "blank_image"
+	case errors.Is(err, errTranscode):
+		return "transcode_failed"
+	case errors.Is(err, errEntryTimeout):
+		return "timeout"
+	}
+	return ""
+}
+
+// outputName keeps an entry's path with the output's extension, made safe
+// to extract and unique within the response.
+func outputName(entry, ext string, taken map[string]bool) string {
+	stem := strings.TrimPrefix(path.Clean("/"+entry), "/")
+	stem = strings.TrimSuffix(stem, path.Ext(stem))
+	name := stem + "." + ext
+	for n := 2; taken[name]; n++ {
+		name = fmt.Sprintf("%s-%d.%s", stem, n, ext)
+	}
+	taken[name] = true
+	return name
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func zipFile(t *testing.T, name string, body []byte) *zip.File {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(body)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr.File[0]
+}
+
+func TestProcessEntryTimeout(t *testing.T) {
+	f := zipFile(t, "menu/dish.jpg", []byte("not really a jpeg"))
+	tests := []struct {
+		name     string
+		cancel   bool // the whole request goes away rather than the entry running long
+		skipTime time.Duration
+		wantErr  error
+		wantCode string
+	}{
+		{"entry in time", false, 0, nil, ""},
+		{"entry too slow", false, 100 * time.Millisecond, errEntryTimeout, "timeout"},
+		{"request cancelled", true, 100 * time.Millisecond, context.Canceled, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{cfg: config{ProcessTimeout: 30 * time.Millisecond}, pool: newWorkPool(1, 1), jobs: newJobRegistry()}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+			e, err := s.processEntry(ctx, f, 1<<20, options{}, func(string) bool {
+				time.Sleep(tt.skipTime)
+				return true // skip as a duplicate, so nothing is decoded
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("processEntry = %v, want %v", err, tt.wantErr)
+			}
+			if code := entryError(err); code != tt.wantCode {
+				t.Errorf("entryError = %q, want %q", code, tt.wantCode)
+			}
+			if err == nil && e.digest != hashHex([]byte("not really a jpeg")) {
+				t.Errorf("digest = %q", e.digest)
+			}
+			// The slot is handed back even when the entry ran past its deadline.
+			if err := s.pool.acquire(context.Background(), laneInteractive, ""); err != nil {
+				t.Errorf("worker slot not released: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadEntryLimit(t *testing.T) {
+	body := bytes.Repeat([]byte{1}, 100)
+	if b, err := readEntry(context.Background(), zipFile(t, "ok.jpg", body), 100); err != nil || len(b) != 100 {
+		t.Errorf("readEntry at the limit = %d bytes, %v", len(b), err)
+	}
+	if _, err := readEntry(context.Background(), zipFile(t, "big.jpg", body), 99); !errors.Is(err, errEntryTooLarge) {
+		t.Errorf("readEntry over the limit = %v, want %v", err, errEntryTooLarge)
+	}
+	// A header understating the size doesn't get more than limit read.
+	f := zipFile(t, "lying.jpg", body)
+	f.UncompressedSize64 = 10
+	if _, err := readEntry(context.Background(), f, 99); err == nil {
+		t.Error("readEntry accepted an entry larger than its header says")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRecord is one line per processed image. It identifies content by hash
+// only; the images themselves are never written to the audit trail.
+type auditRecord struct {
+	Time         time.Time         `json:"time"`
+	RequestID    string            `json:"request_id"`
+	Caller       string            `json:"caller"`
+	Tenant       string            `json:"tenant,omitempty"`
+	SourceSHA256 string            `json:"source_sha256"`
+	SourceBytes  int               `json:"source_bytes"`
+	Params       map[string]string `json:"params"`
+	Outputs      []auditOutput     `json:"outputs"`
+}
+
+type auditOutput struct {
+	SHA256      string `json:"sha256"`
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Bytes       int    `json:"bytes"`
+}
+
+// auditLog appends JSON lines to a file and/or pushes them onto a Redis list
+// that a compliance consumer drains. Records are written from a queue in the
+// background, so neither a slow disk nor Redis holds up a response.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File // nil when only Redis is configured
+
+	redis    *redisClient
+	redisKey string
+	queue    chan auditRecord
+}
+
+const auditQueueSize = 1024
+
+func newAuditLog(path string, redis *redisClient, redisKey string) (*auditLog, error) {
+	a := &auditLog{redis: redis, redisKey: redisKey, queue: make(chan auditRecord, auditQueueSize)}
+	switch path {
+	case "":
+	case "-":
+		a.file = os.Stdout
+	default:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	go a.loop()
+	return a, nil
+}
+
+func (a *auditLog) loop() {
+	for rec := range a.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		a.write(ctx, rec)
+		cancel()
+	}
+}
+
+func (a *auditLog) write(ctx context.Context, rec auditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	if a.file != nil {
+		a.mu.Lock()
+		_, err = a.file.Write(append(line, '\n'))
+		a.mu.Unlock()
+		if err != nil {
+			slog.Error("audit: write failed", "request_id", rec.RequestID, "err", err)
+		}
+	}
+	if a.redis != nil && a.redisKey != "" {
+		if _, err := a.redis.do(ctx, "RPUSH", a.redisKey, string(line)); err != nil {
+			slog.Error("audit: redis push failed", "request_id", rec.RequestID, "err", err)
+		}
+	}
+}
+
+func hashHex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// callerID names the caller for audit purposes: the key name when
+// authenticated. Unknown API keys are fingerprinted, never recorded verbatim.
+func callerID(r *http.Request) string {
+	if name := callerName(r.Context()); name != "" {
+		return "name:" + name
+	}
+	if k := r.Header.Get("X-Api-Key"); k != "" {
+		return "key:" + hashHex([]byte(k))[:12]
+	}
+	return "ip:" + clientIP(r)
+}
+
+// audit queues the record of a successful request. A full queue drops it
+// with an error in the log rather than making the client wait.
+func (s *server) audit(r *http.Request, sourceHash string, sourceBytes int, outputs []*result) {
+	if s.auditLog == nil {
+		return
+	}
+	rec := auditRecord{
+		Time:         time.Now().UTC(),
+		RequestID:    requestID(r.Context()),
+		Caller:       callerID(r),
+		Tenant:       tenantName(r.Context()),
+		SourceSHA256: sourceHash,
+		SourceBytes:  sourceBytes,
+		Params:       map[string]string{},
+	}
+	q := r.URL.Query()
+	for _, k := range []string{"max_dim", "quality", "sizes"} {
+		if q.Has(k) {
+			rec.Params[k] = q.Get(k)
+		}
+	}
+	for _, res := range outputs {
+		rec.Outputs = append(rec.Outputs, auditOutput{
+			SHA256:      res.digest(),
+			ContentType: res.ct,
+			Width:       res.width,
+			Height:      res.height,
+			Bytes:       len(res.body),
+		})
+	}
+	select {
+	case s.auditLog.queue <- rec:
+	default:
+		slog.Error("audit: queue full, dropping record", "request_id", rec.RequestID)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// apiKeys maps the SHA-256 of each key to its name. Keys are looked up by
+// hash so the map never holds plaintext and lookup time doesn't depend on
+// how much of a guessed key matches.
+type apiKeys map[[sha256.Size]byte]string
+
+// loadAPIKeys reads keys from API_KEYS and API_KEYS_FILE. It returns nil
+// when neither is set, which leaves the service open as before.
+func loadAPIKeys(inline, path string) (apiKeys, error) {
+	entries, err := readNamedSecrets(inline, path)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	keys := apiKeys{}
+	for _, e := range entries {
+		keys[sha256.Sum256([]byte(e.secret))] = e.name
+	}
+	return keys, nil
+}
+
+type namedSecret struct{ name, secret string }
+
+// readNamedSecrets parses "name:secret" pairs from a comma-separated env
+// value and an optional file with one pair per line (# comments). A name may
+// appear more than once so secrets can be rotated without downtime.
+func readNamedSecrets(inline, path string) ([]namedSecret, error) {
+	lines := strings.Split(inline, ",")
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	var out []namedSecret
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		name, secret, ok := strings.Cut(l, ":")
+		name, secret = strings.TrimSpace(name), strings.TrimSpace(secret)
+		if !ok || name == "" || secret == "" {
+			return nil, fmt.Errorf("entry %q: want name:secret", name)
+		}
+		out = append(out, namedSecret{name, secret})
+	}
+	return out, nil
+}
+
+func (k apiKeys) lookup(key string) (string, bool) {
+	name, ok := k[sha256.Sum256([]byte(key))]
+	return name, ok
+}
+
+// authenticate requires a verified client certificate, a known X-Api-Key, a
+// valid bearer JWT or an HMAC signature when any of them is configured, and
+// records who the caller is (never the credential) for logs, metrics and rate
+// limits. Certificates are identified by CN, API keys by name, HMAC callers
+// by key id, and tokens by subject, grouped under "jwt" in metrics to keep
+// label cardinality bounded.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	if !s.authConfigured() {
+		return next
+	}
+	allowedPeers := splitList(s.cfg.TLSClientAllowedNames)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name, ok := peerName(r); ok {
+			if len(allowedPeers) > 0 && !slices.Contains(allowedPeers, name) {
+				logAttrs(r.Context(), "auth_error", "client certificate not allowed: "+name)
+				reject(w, r, http.StatusForbidden, "forbidden", "client certificate not allowed")
+				return
+			}
+			setCaller(r.Context(), "cert:"+name, "cert:"+name)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("X-Signature") != "" && s.hmac != nil {
+			id, err := s.hmac.verify(r)
+			switch {
+			case err == nil:
+				setCaller(r.Context(), "hmac:"+id, "hmac:"+id)
+				next.ServeHTTP(w, r)
+			case errors.Is(err, errBodyTooLarge):
+				s.rejectTooLarge(w, r, s.hmac.maxBytes)
+			default:
+				logAttrs(r.Context(), "auth_error", err.Error())
+				reject(w, r, http.StatusUnauthorized, "unauthorized", "missing or invalid credentials")
+			}
+			return
+		}
+		if k, keys := r.Header.Get("X-Api-Key"), s.apiKeys.Load(); k != "" && keys != nil {
+			if name, ok := keys.lookup(k); ok {
+				setCaller(r.Context(), name, name)
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if tok, ok := bearerToken(r); ok && s.jwt != nil {
+			claims, err := s.jwt.verify(r.Context(), tok)
+			if err == nil {
+				setCaller(r.Context(), "jwt:"+claims.Subject, "jwt")
+				next.ServeHTTP(w, r)
+				return
+			}
+			logAttrs(r.Context(), "auth_error", err.Error())
+			if !errors.Is(err, errInvalidToken) {
+				// JWKS unreachable: not the caller's fault.
+				reject(w, r, http.StatusServiceUnavailable, "auth_unavailable", "token verification unavailable")
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		}
+		reject(w, r, http.StatusUnauthorized, "unauthorized", "missing or invalid credentials")
+	})
+}
+
+// authConfigured reports whether any way for callers to authenticate is set up.
+func (s *server) authConfigured() bool {
+	return s.apiKeys.Load() != nil || s.jwt != nil || s.hmac != nil || s.cfg.TLSClientCAFile != ""
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, tok, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || tok == "" {
+		return "", false
+	}
+	return strings.TrimSpace(tok), true
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// dish_id=<id> has the service PATCH the dish record in the main Snap2Serve
+// API once the image is processed, replacing the Node glue script:
+//
+//	PATCH <BACKEND_URL><BACKEND_DISH_PATH with {id}>
+//	Authorization: Bearer <BACKEND_TOKEN>
+//	{"image":{"width":1600,"height":1200,"content_type":"image/jpeg","bytes":345678,
+//	          "sha256":"…","source_sha256":"…","blurhash":"LKO2?U%2Tw=w]~RBVZRi};RPxuwH",
+//	          "dominant_colors":["#c9bda9","#3a2f28"],
+//	          "outputs":[{"name":"crop-1x1","url":"https://…","width":900,"height":900}]}}
+//
+// The top-level fields describe the first output; outputs lists all of
+// them, with URLs when store= uploaded them. A likely screenshot adds
+// "screenshot", as in the store= response. The PATCH is sent in the
+// background after the response, so a slow backend never holds an upload.
+
+var dishIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func dishParam(r *http.Request) (string, error) {
+	v := r.URL.Query().Get("dish_id")
+	if v != "" && !dishIDRe.MatchString(v) {
+		return "", fmt.Errorf("dish_id must be 1-64 letters, digits, - or _, got %q", v)
+	}
+	return v, nil
+}
+
+type dishCallback struct {
+	urlTemplate string // BACKEND_URL + BACKEND_DISH_PATH
+	token       secretValue
+	client      *downstream
+	queue       chan dishUpdate
+}
+
+type dishUpdate struct {
+	requestID string
+	dishID    string
+	body      []byte
+}
+
+const dishQueueSize = 256
+
+func newDishCallback(baseURL, path, token string, client *downstream) (*dishCallback, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("BACKEND_URL must be an http(s) URL, got %q", baseURL)
+	}
+	if !strings.Contains(path, "{id}") {
+		return nil, fmt.Errorf("BACKEND_DISH_PATH must contain {id}, got %q", path)
+	}
+	c := &dishCallback{
+		urlTemplate: strings.TrimRight(baseURL, "/") + "/" + strings.TrimLeft(path, "/"),
+		client:      client,
+		queue:       make(chan dishUpdate, dishQueueSize),
+	}
+	c.token.set(token)
+	go c.loop()
+	return c, nil
+}
+
+func (c *dishCallback) loop() {
+	for u := range c.queue {
+		target := strings.ReplaceAll(c.urlTemplate, "{id}", url.PathEscape(u.dishID))
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPatch, target, bytes.NewReader(u.body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Request-ID", u.requestID)
+		if tok := c.token.get(); tok != "" {
+			req.Header.Set("Authorization", "Bearer "+tok)
+		}
+		resp, err := c.client.do(req)
+		if err != nil {
+			slog.Warn("backend callback failed", "request_id", u.requestID, "dish_id", u.dishID, "err", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Warn("backend callback rejected", "request_id", u.requestID, "dish_id", u.dishID, "status", resp.StatusCode)
+		}
+	}
+}
+
+// updateDish queues the PATCH for a request that named a dish.
+func (s *server) updateDish(r *http.Request, sourceHash string, outputs []*result) {
+	if s.dishes == nil || len(outputs) == 0 {
+		return
+	}
+	dishID, err := dishParam(r)
+	if err != nil || dishID == "" {
+		return
+	}
+	type dishOutput struct {
+		Name   string `json:"name,omitempty"`
+		URL    string `json:"url,omitempty"`
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+	}
+	type dishImage struct {
+		Width          int             `json:"width"`
+		Height         int             `json:"height"`
+		ContentType    string          `json:"content_type"`
+		Bytes          int             `json:"bytes"`
+		SHA256         string          `json:"sha256"`
+		SourceSHA256   string          `json:"source_sha256"`
+		Blurhash       string          `json:"blurhash,omitempty"`
+		DominantColors []string        `json:"dominant_colors"`
+		Outputs        []dishOutput    `json:"outputs"`
+		Screenshot     *screenshotInfo `json:"screenshot,omitempty"`
+	}
+	first := outputs[0]
+	img := dishImage{
+		Width:          first.width,
+		Height:         first.height,
+		ContentType:    first.ct,
+		Bytes:          len(first.body),
+		SHA256:         first.digest(),
+		SourceSHA256:   sourceHash,
+		DominantColors: []string{},
+		Screenshot:     screenshot(r.Context()),
+	}
+	if st, ok := outputStats(first); ok {
+		img.Blurhash, img.DominantColors = st.blurhash, st.palette
+	}
+	stored := storedImages(r.Context())
+	for i, res := range outputs {
+		out := dishOutput{Name: res.name, Width: res.width, Height: res.height}
+		if i < len(stored) {
+			out.URL = stored[i].url
+		}
+		img.Outputs = append(img.Outputs, out)
+	}
+	body, err := json.Marshal(map[string]any{"image": img})
+	if err != nil {
+		return
+	}
+	select {
+	case s.dishes.queue <- dishUpdate{requestID: requestID(r.Context()), dishID: dishID, body: body}:
+	default:
+		slog.Warn("backend callback queue full, dropping update", "request_id", requestID(r.Context()), "dish_id", dishID)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// BlurHash (https://blurha.sh) packs a blurry preview of an image into a
+// couple dozen characters, which clients paint while the real image loads.
+// The encoder follows the reference implementation, with 4x3 components.
+
+const (
+	blurhashX   = 4
+	blurhashY   = 3
+	blurhashDim = 32 // components this coarse don't need more pixels
+)
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func blurhash(img image.Image) string {
+	linearOnce.Do(buildLinearTables)
+	b := img.Bounds()
+	scale := math.Min(1, float64(blurhashDim)/float64(max(b.Dx(), b.Dy())))
+	w, h := max(1, int(float64(b.Dx())*scale)), max(1, int(float64(b.Dy())*scale))
+	small := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, b, draw.Src, nil)
+
+	var factors [blurhashX * blurhashY][3]float64
+	for j := range blurhashY {
+		for i := range blurhashX {
+			var f [3]float64
+			for y := range h {
+				cy := math.Cos(math.Pi * float64(j) * float64(y) / float64(h))
+				for x := range w {
+					basis := cy * math.Cos(math.Pi*float64(i)*float64(x)/float64(w))
+					p := small.Pix[y*small.Stride+x*4:]
+					for c := range 3 {
+						f[c] += basis * float64(toLinear[p[c]]) / 0xffff
+					}
+				}
+			}
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			for c := range 3 {
+				factors[j*blurhashX+i][c] = f[c] * norm / float64(w*h)
+			}
+		}
+	}
+
+	var sb strings.Builder
+	encode83(&sb, (blurhashX-1)+(blurhashY-1)*9, 1)
+	var acMax float64
+	for _, f := range factors[1:] {
+		for _, v := range f {
+			acMax = math.Max(acMax, math.Abs(v))
+		}
+	}
+	quantMax := int(math.Max(0, math.Min(82, math.Floor(acMax*166-0.5))))
+	maxValue := float64(quantMax+1) / 166
+	encode83(&sb, quantMax, 1)
+
+	dc := factors[0]
+	encode83(&sb, int(linearToSRGB(dc[0]))<<16|int(linearToSRGB(dc[1]))<<8|int(linearToSRGB(dc[2])), 4)
+	for _, f := range factors[1:] {
+		var q [3]int
+		for c, v := range f {
+			q[c] = int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		encode83(&sb, q[0]*19*19+q[1]*19+q[2], 2)
+	}
+	return sb.String()
+}
+
+func linearToSRGB(v float64) byte {
+	return fromLinear[int(math.Round(math.Max(0, math.Min(1, v))*0xffff))]
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+func encode83(sb *strings.Builder, v, length int) {
+	for i := 1; i <= length; i++ {
+		d := v / int(math.Pow(83, float64(length-i))) % 83
+		sb.WriteByte(base83[d])
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// border=width,color frames each output for the promotional card
+// generator, e.g. border=12,ffffff or border=4,00000080. The frame is drawn
+// over the outermost width pixels, so output dimensions don't change.
+const maxBorderWidth = 256
+
+type border struct {
+	width int
+	color color.NRGBA
+}
+
+func borderParam(r *http.Request) (border, error) {
+	v := r.URL.Query().Get("border")
+	if v == "" {
+		return border{}, nil
+	}
+	ws, cs, ok := strings.Cut(v, ",")
+	if !ok {
+		return border{}, fmt.Errorf("border must be width,color, got %q", v)
+	}
+	w, err := strconv.Atoi(ws)
+	if err != nil || w < 1 || w > maxBorderWidth {
+		return border{}, fmt.Errorf("border width must be 1-%d, got %q", maxBorderWidth, ws)
+	}
+	c, err := parseHexColor(cs)
+	if err != nil {
+		return border{}, fmt.Errorf("border color: %w", err)
+	}
+	return border{width: w, color: c}, nil
+}
+
+// parseHexColor reads RRGGBB or RRGGBBAA, with or without a leading "#".
+func parseHexColor(s string) (color.NRGBA, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "#"))
+	if err != nil || (len(b) != 3 && len(b) != 4) {
+		return color.NRGBA{}, fmt.Errorf("want RRGGBB or RRGGBBAA hex, got %q", s)
+	}
+	c := color.NRGBA{R: b[0], G: b[1], B: b[2], A: 0xff}
+	if len(b) == 4 {
+		c.A = b[3]
+	}
+	return c, nil
+}
+
+// drawBorder frames img, in place when render owns it. On outputs too
+// small for the width the frame covers the whole image.
+func drawBorder(img image.Image, owned bool, bd border) image.Image {
+	dst := drawable(img, owned)
+	b := dst.Bounds()
+	w := min(bd.width, b.Dx(), b.Dy())
+	src := image.NewUniform(bd.color)
+	inner := image.Rect(b.Min.X+w, b.Min.Y+w, b.Max.X-w, b.Max.Y-w)
+	if inner.Empty() {
+		draw.Draw(dst, b, src, image.Point{}, draw.Over)
+		return dst
+	}
+	for _, r := range []image.Rectangle{
+		image.Rect(b.Min.X, b.Min.Y, b.Max.X, inner.Min.Y), // top
+		image.Rect(b.Min.X, inner.Max.Y, b.Max.X, b.Max.Y), // bottom
+		image.Rect(b.Min.X, inner.Min.Y, inner.Min.X, inner.Max.Y),
+		image.Rect(inner.Max.X, inner.Min.Y, b.Max.X, inner.Max.Y),
+	} {
+		draw.Draw(dst, r, src, image.Point{}, draw.Over)
+	}
+	return dst
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bundle=zip answers with a ZIP of the outputs instead of the image or
+// multipart/mixed, for "download all photos of this dish" exports.
+// bundle_original=true adds a sanitized full-size copy (capped at MAX_DIM,
+// always re-encoded so no metadata survives) as original.<ext>. Entries are
+// named after the output: crop or tile name, else <w>x<h>.<ext>.
+//
+// Accept: application/x-tar gets the same entries as a tar stream, for the
+// backfill CLI and data pipelines that read outputs as they arrive rather
+// than buffering a whole ZIP to reach its central directory.
+
+func bundleParam(r *http.Request) (zipped, original bool, err error) {
+	q := r.URL.Query()
+	switch v := q.Get("bundle"); v {
+	case "":
+	case "zip":
+		zipped = true
+	default:
+		return false, false, fmt.Errorf("bundle must be zip, got %q", v)
+	}
+	if original, err = boolParam(r, "bundle_original"); err != nil {
+		return false, false, err
+	}
+	if original && !zipped {
+		return false, false, fmt.Errorf("bundle_original needs bundle=zip")
+	}
+	return zipped, original, nil
+}
+
+// withOriginal appends the sanitized original to set when
+// bundle_original=true asks for it. On failure it has already written the
+// response.
+func (s *server) withOriginal(ctx context.Context, w http.ResponseWriter, r *http.Request, set []*result, b []byte, ct string, opts options) ([]*result, bool) {
+	if _, original, _ := bundleParam(r); !original {
+		return set, true
+	}
+	opts.maxDim = s.live.Load().maxDim
+	opts.sanitize, opts.forceEncode = true, true
+	var res *result
+	err := s.runJob(ctx, func(ctx context.Context) (err error) {
+		res, err = s.process(ctx, b, ct, opts)
+		return err
+	})
+	if err != nil {
+		s.writeJobError(w, r, err)
+		return nil, false
+	}
+	res.name = "original"
+	return append(set, res), true
+}
+
+// bundleModTime stamps every ZIP and tar entry, so the same outputs always
+// make a byte-identical archive.
+var bundleModTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// writeZip answers with set as a ZIP. Images are stored, not deflated:
+// JPEG and PNG don't compress further.
+func writeZip(w http.ResponseWriter, set []*result) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="images.zip"`)
+	w.Header().Set("X-Original-Content-Type", set[0].origCT)
+	w.WriteHeader(http.StatusOK)
+	zw := zip.NewWriter(w)
+	var written int
+	for i, name := range entryNames(set) {
+		res := set[i]
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: bundleModTime})
+		if err != nil {
+			break
+		}
+		n, err := fw.Write(res.body)
+		written += n
+		if err != nil {
+			break
+		}
+	}
+	_ = zw.Close() // a failed write means the client is gone
+	outputBytes.add(float64(written))
+}
+
+// writeTar answers with set as an uncompressed tar, named as in writeZip,
+// for pipelines that unpack the stream as it arrives.
+func writeTar(w http.ResponseWriter, set []*result) {
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="images.tar"`)
+	w.Header().Set("X-Original-Content-Type", set[0].origCT)
+	w.WriteHeader(http.StatusOK)
+	tw := tar.NewWriter(w)
+	// Each entry goes out as soon as it is written, so the consumer can
+	// start unpacking before the last one.
+	rc := http.NewResponseController(w)
+	var written int
+	for i, name := range entryNames(set) {
+		res := set[i]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(res.body)), ModTime: bundleModTime}); err != nil {
+			break
+		}
+		n, err := tw.Write(res.body)
+		written += n
+		if err != nil {
+			break
+		}
+		_ = rc.Flush()
+	}
+	_ = tw.Close()
+	outputBytes.add(float64(written))
+}
+
+// acceptsTar reports whether the client asked for a tar stream with
+// Accept: application/x-tar.
+func acceptsTar(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(v, ",") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil || (mt != "application/x-tar" && mt != "application/tar") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue // explicitly refused
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// entryNames names each output for an archive, numbering repeats.
+func entryNames(set []*result) []string {
+	names := make([]string, len(set))
+	seen := map[string]int{}
+	for i, res := range set {
+		name := zipEntryName(res)
+		if n := seen[name]; n > 0 {
+			// sizes= beyond the image's own size all come out the same.
+			name = strconv.Itoa(n+1) + "-" + name
+		}
+		seen[zipEntryName(res)]++
+		names[i] = name
+	}
+	return names
+}
+
+func zipEntryName(res *result) string {
+	switch {
+	case res.name != "" && path.Ext(res.name) == "":
+		return res.name + "." + fileExt(res.ct)
+	case res.name != "":
+		return res.name
+	}
+	return fmt.Sprintf("%dx%d.%s", res.width, res.height, fileExt(res.ct))
+}
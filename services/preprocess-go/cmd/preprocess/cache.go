@@ -0,0 +1,322 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultCache holds finished responses so a retried upload of the same bytes
+// with the same options skips decode/encode entirely.
+type resultCache interface {
+	Get(ctx context.Context, key string) (*result, bool)
+	Set(ctx context.Context, key string, res *result)
+}
+
+// cacheKey covers everything that affects the output: the input hash, the
+// type hint used to pick a decoder, and every transform option. Options are
+// written out field by field rather than dumped, so the key doesn't depend on
+// how they format; a new one must be added here.
+func cacheKey(inputHash, ct string, opts options) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s%s:%s:dim=%d:q=%d", cacheKeyPrefix, inputHash, ct, opts.maxDim, opts.quality)
+	for _, flag := range []struct {
+		name string
+		on   bool
+	}{
+		{"force", opts.forceEncode}, {"sanitize", opts.sanitize}, {"depth16", opts.depth16},
+		{"interlace", opts.interlace}, {"blur_faces", opts.blurFaces}, {"linear", opts.linear},
+	} {
+		if flag.on {
+			b.WriteString(":" + flag.name)
+		}
+	}
+	if red := opts.redact; len(red.regions) > 0 {
+		fmt.Fprintf(&b, ":redact=%t", red.pixelate)
+		for _, r := range red.regions {
+			fmt.Fprintf(&b, ",%d,%d,%d,%d", r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+		}
+	}
+	if o := opts.overlay; o != nil {
+		// The overlay by identity and placement, not by its pixels.
+		fmt.Fprintf(&b, ":overlay=%s,%s,%g,%g,%g", o.id, o.spec.Position, o.spec.Width, o.spec.Margin, o.spec.Opacity)
+	}
+	if bd := opts.border; bd.width > 0 {
+		fmt.Fprintf(&b, ":border=%d,%s", bd.width, hexNRGBA(bd.color))
+	}
+	if lb := opts.letterbox; lb.ar != (aspect{}) {
+		fmt.Fprintf(&b, ":letterbox=%s,%s", lb.ar, hexNRGBA(lb.bg))
+	}
+	if opts.trim != (aspect{}) {
+		fmt.Fprintf(&b, ":trim=%s", opts.trim)
+	}
+	return b.String()
+}
+
+func hexNRGBA(c color.NRGBA) string {
+	return fmt.Sprintf("%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
+
+// cacheKeyPrefix starts every key; bump its version when results change shape.
+const cacheKeyPrefix = "pp:v1:"
+
+// detach copies a result out of its pooled buffer so it can outlive the request.
+func (res *result) detach() *result {
+	c := *res
+	c.body = append([]byte(nil), res.body...)
+	c.buf = nil
+	return &c
+}
+
+// memoryCache is a byte-bounded LRU.
+type memoryCache struct {
+	maxBytes int
+
+	mu    sync.Mutex
+	size  int
+	order *list.List // front = most recent
+	items map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key string
+	res *result
+}
+
+func newMemoryCache(maxBytes int) *memoryCache {
+	return &memoryCache{maxBytes: maxBytes, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *memoryCache) Get(_ context.Context, key string) (*result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	// A copy, since requests fill in res's lazily computed fields; the
+	// body is shared and never written.
+	res := *el.Value.(*memoryEntry).res
+	return &res, true
+}
+
+func (c *memoryCache) Set(_ context.Context, key string, res *result) {
+	n := len(res.body)
+	if n > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.size -= len(el.Value.(*memoryEntry).res.body)
+		c.order.Remove(el)
+	}
+	c.items[key] = c.order.PushFront(&memoryEntry{key: key, res: res})
+	c.size += n
+	for c.size > c.maxBytes {
+		el := c.order.Back()
+		e := el.Value.(*memoryEntry)
+		c.order.Remove(el)
+		delete(c.items, e.key)
+		c.size -= len(e.res.body)
+	}
+}
+
+// flush drops every entry and reports how many there were.
+func (c *memoryCache) flush(context.Context) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.items)
+	c.order.Init()
+	clear(c.items)
+	c.size = 0
+	return n, nil
+}
+
+// redisCache shares results across replicas. Failures are logged and treated
+// as misses; the cache must never fail a request.
+type redisCache struct {
+	client *redisClient
+	ttl    time.Duration
+}
+
+// cacheEntry is the serialized form of a result for the Redis and disk layers.
+type cacheEntry struct {
+	Body   []byte `json:"body"`
+	CT     string `json:"ct"`
+	OrigCT string `json:"orig_ct"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+
+	Passthrough bool   `json:"passthrough,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+func marshalEntry(res *result) ([]byte, error) {
+	return json.Marshal(cacheEntry{
+		Body: res.body, CT: res.ct, OrigCT: res.origCT, Width: res.width, Height: res.height,
+		Passthrough: res.passthrough, Reason: res.reason,
+	})
+}
+
+func unmarshalEntry(raw []byte) (*result, error) {
+	var e cacheEntry
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, err
+	}
+	return &result{
+		body: e.Body, ct: e.CT, origCT: e.OrigCT, width: e.Width, height: e.Height,
+		passthrough: e.Passthrough, reason: e.Reason,
+	}, nil
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) (*result, bool) {
+	reply, err := c.client.do(ctx, "GET", key)
+	if err != nil {
+		if err != errRedisNil {
+			slog.Warn("cache: redis get failed", "err", err)
+		}
+		return nil, false
+	}
+	raw, _ := reply.([]byte)
+	res, err := unmarshalEntry(raw)
+	if err != nil {
+		return nil, false
+	}
+	return res, true
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, res *result) {
+	raw, err := marshalEntry(res)
+	if err != nil {
+		return
+	}
+	ms := fmt.Sprint(c.ttl.Milliseconds())
+	if _, err := c.client.do(ctx, "SET", key, string(raw), "PX", ms); err != nil {
+		slog.Warn("cache: redis set failed", "err", err)
+	}
+}
+
+// flush deletes every cached result in Redis, for every replica. Keys are
+// found with SCAN so a large cache doesn't block the server.
+func (c *redisCache) flush(ctx context.Context) (int, error) {
+	cursor, n := "0", 0
+	for {
+		reply, err := c.client.do(ctx, "SCAN", cursor, "MATCH", cacheKeyPrefix+"*", "COUNT", "500")
+		if err != nil {
+			return n, err
+		}
+		parts, _ := reply.([]any)
+		if len(parts) != 2 {
+			return n, fmt.Errorf("unexpected SCAN reply %v", reply)
+		}
+		b, _ := parts[0].([]byte)
+		cursor = string(b)
+		keys, _ := parts[1].([]any)
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, k := range keys {
+				kb, _ := k.([]byte)
+				args = append(args, string(kb))
+			}
+			if _, err := c.client.do(ctx, args...); err != nil {
+				return n, err
+			}
+			n += len(keys)
+		}
+		if cursor == "0" {
+			return n, nil
+		}
+	}
+}
+
+// tieredCache checks each layer in order and backfills the faster layers on
+// a hit further down. Writes to all but the first layer happen in the
+// background so a slow remote cache never adds response latency.
+type tieredCache []resultCache
+
+func (t tieredCache) Get(ctx context.Context, key string) (*result, bool) {
+	for i, c := range t {
+		if res, ok := c.Get(ctx, key); ok {
+			// Each tier gets its own copy: the caller fills in res's lazily
+			// computed fields while other requests read the cached one.
+			for _, upper := range t[:i] {
+				upper.Set(ctx, key, res.detach())
+			}
+			return res, true
+		}
+	}
+	return nil, false
+}
+
+func (t tieredCache) Set(_ context.Context, key string, res *result) {
+	res = res.detach()
+	for i, c := range t {
+		if i == 0 {
+			c.Set(context.Background(), key, res)
+			continue
+		}
+		go func(c resultCache) {
+			ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+			defer cancel()
+			c.Set(ctx, key, res)
+		}(c)
+	}
+}
+
+// flush empties every layer, fastest first, and reports the entries each
+// dropped by layer name.
+func (t tieredCache) flush(ctx context.Context) (map[string]int, error) {
+	flushed := map[string]int{}
+	for _, c := range t {
+		var name string
+		var n int
+		var err error
+		switch c := c.(type) {
+		case *memoryCache:
+			name = "memory"
+			n, err = c.flush(ctx)
+		case *diskCache:
+			name = "disk"
+			n, err = c.flush(ctx)
+		case *redisCache:
+			name = "redis"
+			n, err = c.flush(ctx)
+		}
+		flushed[name] = n
+		if err != nil {
+			return flushed, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return flushed, nil
+}
+
+// newResultCache builds the configured layers, or returns nil when caching
+// is disabled.
+func newResultCache(cfg config, redis *redisClient) (resultCache, error) {
+	var layers tieredCache
+	if cfg.CacheMaxBytes > 0 {
+		layers = append(layers, newMemoryCache(cfg.CacheMaxBytes))
+	}
+	if cfg.CacheDir != "" {
+		dc, err := newDiskCache(cfg.CacheDir, cfg.CacheDirMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, dc)
+	}
+	if cfg.CacheRedis {
+		layers = append(layers, &redisCache{client: redis, ttl: cfg.CacheTTL})
+	}
+	if len(layers) == 0 {
+		return nil, nil
+	}
+	return layers, nil
+}
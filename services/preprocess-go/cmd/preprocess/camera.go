@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The content team tells pro shoots from user photos by what took them.
+// cameraInfo is read from the upload's EXIF block, before sanitizing or
+// re-encoding drops it, and reported as "camera" in the JSON that describes
+// an upload: the store= response and /archive manifest entries. JPEG and
+// TIFF carry EXIF this way; other formats, and photos whose EXIF was
+// stripped already, have none.
+
+// cameraInfo is what the EXIF block says about the camera and exposure.
+type cameraInfo struct {
+	Make         string  `json:"make,omitempty"`
+	Model        string  `json:"model,omitempty"`
+	Lens         string  `json:"lens,omitempty"`
+	ISO          int     `json:"iso,omitempty"`
+	ExposureTime float64 `json:"exposure_time,omitempty"` // seconds
+	FNumber      float64 `json:"f_number,omitempty"`
+	FocalLength  float64 `json:"focal_length,omitempty"` // millimetres
+}
+
+// EXIF tags, in IFD0 and the Exif sub-IFD.
+const (
+	tagMake         = 0x010F
+	tagModel        = 0x0110
+	tagExifIFD      = 0x8769
+	tagExposureTime = 0x829A
+	tagFNumber      = 0x829D
+	tagISO          = 0x8827
+	tagFocalLength  = 0x920A
+	tagLensModel    = 0xA434
+)
+
+// readCamera returns the camera details of JPEG or TIFF b, or nil if it has
+// none.
+func readCamera(b []byte) *cameraInfo {
+	t := b
+	if !isTIFF(b) {
+		t = exifBlock(b)
+	}
+	bo, ok := tiffByteOrder(t)
+	if !ok {
+		return nil
+	}
+	ifd0 := int(bo.Uint32(t[4:]))
+	cam := &cameraInfo{
+		Make:  ifdString(t, bo, ifd0, tagMake),
+		Model: ifdString(t, bo, ifd0, tagModel),
+	}
+	if entries, _, ok := readIFD(t, bo, ifd0); ok && entries[tagExifIFD] != 0 {
+		exif := int(entries[tagExifIFD])
+		cam.Lens = ifdString(t, bo, exif, tagLensModel)
+		cam.ExposureTime = ifdRational(t, bo, exif, tagExposureTime)
+		cam.FNumber = ifdRational(t, bo, exif, tagFNumber)
+		cam.FocalLength = ifdRational(t, bo, exif, tagFocalLength)
+		if sub, _, ok := readIFD(t, bo, exif); ok {
+			cam.ISO = int(sub[tagISO])
+		}
+	}
+	if *cam == (cameraInfo{}) {
+		return nil
+	}
+	return cam
+}
+
+// ifdValue returns the raw value bytes of tag in the IFD at off, provided it
+// has type typ, each element size bytes.
+func ifdValue(t []byte, bo binary.ByteOrder, off int, tag, typ uint16, size int) ([]byte, bool) {
+	if off < 8 || off+2 > len(t) {
+		return nil, false
+	}
+	end := off + 2 + 12*int(bo.Uint16(t[off:]))
+	if end > len(t) {
+		return nil, false
+	}
+	for e := off + 2; e < end; e += 12 {
+		if bo.Uint16(t[e:]) != tag || bo.Uint16(t[e+2:]) != typ {
+			continue
+		}
+		n := int(bo.Uint32(t[e+4:])) * size
+		if n <= 4 {
+			return t[e+8 : e+8+n], true
+		}
+		at := int(bo.Uint32(t[e+8:]))
+		if n > 1<<16 || at < 8 || at+n > len(t) {
+			return nil, false
+		}
+		return t[at : at+n], true
+	}
+	return nil, false
+}
+
+// ifdString reads an ASCII tag, trimmed of padding.
+func ifdString(t []byte, bo binary.ByteOrder, off int, tag uint16) string {
+	v, ok := ifdValue(t, bo, off, tag, 2, 1)
+	if !ok {
+		return ""
+	}
+	s, _, _ := strings.Cut(string(v), "\x00")
+	s = strings.TrimSpace(s)
+	if !utf8.ValidString(s) || strings.ContainsFunc(s, unicode.IsControl) {
+		return ""
+	}
+	return s
+}
+
+// ifdRational reads a RATIONAL tag, rounded to four decimals.
+func ifdRational(t []byte, bo binary.ByteOrder, off int, tag uint16) float64 {
+	v, ok := ifdValue(t, bo, off, tag, 5, 8)
+	if !ok || len(v) < 8 {
+		return 0
+	}
+	num, den := bo.Uint32(v), bo.Uint32(v[4:])
+	if den == 0 {
+		return 0
+	}
+	return math.Round(float64(num)/float64(den)*1e4) / 1e4
+}
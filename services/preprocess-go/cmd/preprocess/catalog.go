@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/image/draw"
+)
+
+// The catalog records every processed output in Postgres (POSTGRES_URL), one
+// row each, so the rest of Snap2Serve can query images by hash, size or
+// color without an indexing job of its own. Like the audit log it's written
+// from a queue in the background, so neither the insert nor the decode that
+// describes each output holds up a response, and a failed insert is logged,
+// never surfaced.
+
+// catalogMaxOutputs skips tile pyramids, the only sets larger than this;
+// hundreds of tile rows per request would swamp the table.
+const catalogMaxOutputs = maxSizes
+
+var pgIdentRe = regexp.MustCompile(`^[a-z_][a-z0-9_]*(\.[a-z_][a-z0-9_]*)?$`)
+
+// catalogQueueSize bounds the batches waiting for Postgres. Each holds
+// copies of up to catalogMaxOutputs outputs, so it is kept small; when
+// Postgres falls that far behind, further batches are dropped and logged.
+const catalogQueueSize = 64
+
+type catalog struct {
+	pg    atomic.Pointer[pgxpool.Pool]
+	table string
+	queue chan catalogBatch
+
+	mu      sync.Mutex
+	created bool // CREATE TABLE has succeeded; retried until it does
+}
+
+func newCatalog(rawURL, table string) (*catalog, error) {
+	if !pgIdentRe.MatchString(table) {
+		return nil, fmt.Errorf("POSTGRES_TABLE %q is not a plain [schema.]table name", table)
+	}
+	c := &catalog{table: table, queue: make(chan catalogBatch, catalogQueueSize)}
+	if err := c.rotate(rawURL); err != nil {
+		return nil, err
+	}
+	go c.loop()
+	return c, nil
+}
+
+// rotate connects to rawURL from now on, such as one with a rotated
+// password. The old pool closes once its connections are returned.
+func (c *catalog) rotate(rawURL string) error {
+	pg, err := newPgPool(rawURL)
+	if err != nil {
+		return err
+	}
+	if old := c.pg.Swap(pg); old != nil {
+		go old.Close()
+	}
+	return nil
+}
+
+// ping checks that Postgres can be reached, for readiness.
+func (c *catalog) ping(ctx context.Context) error {
+	return c.pg.Load().Ping(ctx)
+}
+
+// catalogBatch is one request's rows, waiting for their color and sharpness
+// columns, which the loop fills in from the outputs.
+type catalogBatch struct {
+	requestID string
+	rows      [][]any
+	outputs   []*result // detached copies, rows[i] describes outputs[i]
+}
+
+func (c *catalog) loop() {
+	for b := range c.queue {
+		start := time.Now()
+		for i, res := range b.outputs {
+			if st, ok := outputStats(res); ok {
+				b.rows[i][12], b.rows[i][13], b.rows[i][14] = st.average, st.dominant, st.sharpness
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), pgTimeout)
+		err := c.ensureTable(ctx)
+		if err == nil {
+			err = c.insert(ctx, b.rows)
+		}
+		cancel()
+		if err != nil {
+			slog.Error("catalog: insert failed", "request_id", b.requestID, "err", err)
+			continue
+		}
+		observeStage(context.Background(), start, "catalog")
+	}
+}
+
+// insert writes rows in one round trip and one implicit transaction.
+func (c *catalog) insert(ctx context.Context, rows [][]any) error {
+	var batch pgx.Batch
+	for _, row := range rows {
+		batch.Queue(`INSERT INTO `+c.table+` (
+	request_id, caller, source_sha256, source_bytes, source_type,
+	output_index, name, sha256, content_type, width, height, bytes,
+	average_color, dominant_color, sharpness, storage_key, storage_url
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`, row...)
+	}
+	return c.pg.Load().SendBatch(ctx, &batch).Close()
+}
+
+func (c *catalog) ensureTable(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.created {
+		return nil
+	}
+	_, err := c.pg.Load().Exec(ctx, `CREATE TABLE IF NOT EXISTS `+c.table+` (
+	id             bigserial PRIMARY KEY,
+	created_at     timestamptz NOT NULL DEFAULT now(),
+	request_id     text NOT NULL,
+	caller         text NOT NULL,
+	source_sha256  text NOT NULL,
+	source_bytes   integer NOT NULL,
+	source_type    text NOT NULL,
+	output_index   integer NOT NULL,
+	name           text,
+	sha256         text NOT NULL,
+	content_type   text NOT NULL,
+	width          integer NOT NULL,
+	height         integer NOT NULL,
+	bytes          integer NOT NULL,
+	average_color  text,
+	dominant_color text,
+	sharpness      real,
+	storage_key    text,
+	storage_url    text
+)`)
+	c.created = err == nil
+	return err
+}
+
+// catalogOutputs queues one row per output.
+func (s *server) catalogOutputs(r *http.Request, sourceHash string, sourceBytes int, outputs []*result) {
+	if s.catalog == nil || len(outputs) == 0 || len(outputs) > catalogMaxOutputs {
+		return
+	}
+	stored := storedImages(r.Context())
+	b := catalogBatch{
+		requestID: requestID(r.Context()),
+		rows:      make([][]any, len(outputs)),
+		outputs:   make([]*result, len(outputs)),
+	}
+	for i, res := range outputs {
+		var name, storageKey, storageURL any
+		if res.name != "" {
+			name = res.name
+		}
+		if i < len(stored) {
+			storageKey, storageURL = stored[i].id, stored[i].url
+		}
+		b.rows[i] = []any{
+			b.requestID, callerID(r), sourceHash, sourceBytes, res.origCT,
+			i, name, res.digest(), res.ct, res.width, res.height, len(res.body),
+			nil, nil, nil, storageKey, storageURL,
+		}
+		// The outputs go back to the pool once the response is written.
+		b.outputs[i] = res.detach()
+	}
+	select {
+	case s.catalog.queue <- b:
+	default:
+		slog.Error("catalog: queue full, dropping rows", "request_id", b.requestID)
+	}
+}
+
+type imageStats struct {
+	average, dominant string   // #rrggbb
+	palette           []string // up to paletteSize most common colors, dominant first
+	sharpness         float64  // mean edge strength, 0-1; blurry photos score low
+	blurhash          string
+}
+
+// paletteSize and paletteMinShare bound the palette: a color must cover
+// that share of the image to be listed after the dominant one.
+const (
+	paletteSize     = 3
+	paletteMinShare = 0.05
+)
+
+// outputStats decodes a small output again to describe it; the pipeline's
+// pixels are back in the pool by now. The result is kept on res, for
+// callers that ask more than once.
+func outputStats(res *result) (imageStats, bool) {
+	if res.stats != nil {
+		return *res.stats, true
+	}
+	if !strings.HasPrefix(res.ct, "image/") {
+		return imageStats{}, false
+	}
+	img, _, err := image.Decode(bytes.NewReader(res.body))
+	if err != nil {
+		return imageStats{}, false
+	}
+	st := describeImage(img)
+	res.stats = &st
+	return st, true
+}
+
+// meanEnergy is the mean edge strength of an energyMap, 0-1.
+func meanEnergy(energy *image.Gray) float64 {
+	var sum int
+	for _, v := range energy.Pix {
+		sum += int(v)
+	}
+	return float64(sum) / float64(max(1, len(energy.Pix))) / 255
+}
+
+// describeImage works on an energyDim-sized copy: plenty for colors, and
+// the size the sharpness measure is calibrated at.
+func describeImage(img image.Image) imageStats {
+	energy := energyMap(img)
+	b := energy.Bounds()
+
+	small := image.NewRGBA(b)
+	draw.ApproxBiLinear.Scale(small, b, img, img.Bounds(), draw.Src, nil)
+	// Palette colors are the fullest buckets of a 4-bit-per-channel
+	// histogram, each reported as the mean of the pixels in it.
+	var total [3]int
+	counts := map[int]int{}
+	sums := map[int][3]int{}
+	for i := 0; i+3 < len(small.Pix); i += 4 {
+		r, g, bl := int(small.Pix[i]), int(small.Pix[i+1]), int(small.Pix[i+2])
+		total[0], total[1], total[2] = total[0]+r, total[1]+g, total[2]+bl
+		k := r>>4<<8 | g>>4<<4 | bl>>4
+		counts[k]++
+		s := sums[k]
+		sums[k] = [3]int{s[0] + r, s[1] + g, s[2] + bl}
+	}
+	n := max(1, b.Dx()*b.Dy())
+	keys := make([]int, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	var palette []string
+	for i, k := range keys {
+		if i == paletteSize || i > 0 && float64(counts[k]) < paletteMinShare*float64(n) {
+			break
+		}
+		c, s := counts[k], sums[k]
+		palette = append(palette, fmt.Sprintf("#%02x%02x%02x", s[0]/c, s[1]/c, s[2]/c))
+	}
+	st := imageStats{
+		average:   fmt.Sprintf("#%02x%02x%02x", total[0]/n, total[1]/n, total[2]/n),
+		palette:   palette,
+		sharpness: meanEnergy(energy),
+		blurhash:  blurhash(small),
+	}
+	if len(palette) > 0 {
+		st.dominant = palette[0]
+	}
+	return st
+}
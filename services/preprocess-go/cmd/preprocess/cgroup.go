@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// applyCPUQuota lowers GOMAXPROCS to the container's CPU quota. The Go
+// runtime sizes itself from the host's cores, so under a 2-CPU limit on a
+// 32-core node it would run 32 threads and get throttled by the CFS
+// scheduler. An explicit GOMAXPROCS env var always wins.
+func applyCPUQuota() {
+	if os.Getenv("GOMAXPROCS") != "" {
+		return
+	}
+	quota, ok := cgroupCPUQuota()
+	if !ok {
+		return
+	}
+	// Round down like automaxprocs: 1.5 CPUs of quota can't sustain 2 threads.
+	n := max(1, int(quota))
+	if n < runtime.GOMAXPROCS(0) {
+		slog.Info("applying cgroup CPU quota", "quota", quota, "gomaxprocs", n)
+		runtime.GOMAXPROCS(n)
+	}
+}
+
+// cgroupCPUQuota returns the CPU limit in cores, checking cgroup v2 first
+// and then v1. ok is false when there is no limit or no cgroup fs.
+func cgroupCPUQuota() (float64, bool) {
+	if b, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		// "<quota> <period>" or "max <period>"
+		f := strings.Fields(string(b))
+		if len(f) == 2 && f[0] != "max" {
+			return quotaRatio(f[0], f[1])
+		}
+		return 0, false
+	}
+	for _, dir := range []string{"/sys/fs/cgroup/cpu", "/sys/fs/cgroup/cpu,cpuacct"} {
+		q, err1 := os.ReadFile(dir + "/cpu.cfs_quota_us")
+		p, err2 := os.ReadFile(dir + "/cpu.cfs_period_us")
+		if err1 == nil && err2 == nil {
+			return quotaRatio(strings.TrimSpace(string(q)), strings.TrimSpace(string(p)))
+		}
+	}
+	return 0, false
+}
+
+func quotaRatio(quota, period string) (float64, bool) {
+	q, err1 := strconv.ParseFloat(quota, 64)
+	p, err2 := strconv.ParseFloat(period, 64)
+	if err1 != nil || err2 != nil || q <= 0 || p <= 0 {
+		return 0, false // v1 reports -1 for "no limit"
+	}
+	return q / p, true
+}
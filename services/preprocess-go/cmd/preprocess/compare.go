@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// POST /compare/side-by-side stitches a "before" and an "after" upload into
+// one labelled JPEG for the app's enhance preview: both scaled to the same
+// height, side by side on white, each with its label in the top-left corner.
+const (
+	compareGutter   = 8
+	maxLabelLength  = 40
+	defaultLabels   = "Before,After"
+	labelSizeFactor = 20 // label height is the panel height over this, at least minLabelSize
+	minLabelSize    = 14
+)
+
+var labelFont = sync.OnceValues(func() (*opentype.Font, error) {
+	return opentype.Parse(goregular.TTF)
+})
+
+func (s *server) compareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		reject(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "POST only")
+		return
+	}
+	live := s.live.Load()
+	maxDim := intParam(r, "max_dim", live.defaultMaxDim)
+	jpegQ := intParam(r, "quality", live.defaultQuality)
+	maxDim = min(max(maxDim, live.minDim), live.maxDim)
+	jpegQ = min(max(jpegQ, live.minQuality), live.maxQuality)
+	labels, err := labelsParam(r)
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+
+	uploadStart := time.Now()
+	if !s.parseUpload(w, r) {
+		return
+	}
+	before, beforeCT, ok := s.formImage(w, r, "before")
+	if !ok {
+		return
+	}
+	after, afterCT, ok := s.formImage(w, r, "after")
+	if !ok {
+		return
+	}
+	recordStage(r.Context(), "upload", time.Since(uploadStart))
+	if !s.scanInput(w, r, before) || !s.scanInput(w, r, after) {
+		return
+	}
+	total := len(before) + len(after)
+	inputBytes.add(float64(total))
+	inputHash := hashHex(append(append([]byte(nil), before...), after...))
+	logAttrs(r.Context(), "input_bytes", total)
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ProcessTimeout)
+	defer cancel()
+	var res *result
+	err = s.runJob(ctx, func(ctx context.Context) (err error) {
+		res, err = s.sideBySide(ctx, [2][]byte{before, after}, [2]string{beforeCT, afterCT}, labels, maxDim, jpegQ)
+		return err
+	})
+	if err != nil {
+		s.writeJobError(w, r, err)
+		return
+	}
+	defer res.release()
+	logAttrs(r.Context(), "output_width", res.width, "output_height", res.height, "output_bytes", len(res.body))
+	writeResult(w, res)
+	s.completed(r, inputHash, total, 1, []*result{res})
+}
+
+// labelsParam reads labels=Before,After; an empty label leaves that panel
+// unlabelled.
+func labelsParam(r *http.Request) ([2]string, error) {
+	v := r.URL.Query().Get("labels")
+	if !r.URL.Query().Has("labels") {
+		v = defaultLabels
+	}
+	parts := strings.Split(v, ",")
+	if len(parts) != 2 {
+		return [2]string{}, fmt.Errorf("labels must be two comma-separated labels, got %q", v)
+	}
+	var labels [2]string
+	for i, p := range parts {
+		p = strings.TrimSpace(p)
+		if len([]rune(p)) > maxLabelLength {
+			return [2]string{}, fmt.Errorf("labels must be at most %d characters each", maxLabelLength)
+		}
+		labels[i] = p
+	}
+	return labels, nil
+}
+
+// sideBySide scales both images to a common height, no taller than the
+// shorter input, then shrinks the whole composite to fit maxDim.
+func (s *server) sideBySide(ctx context.Context, inputs [2][]byte, cts [2]string, labels [2]string, maxDim, quality int) (*result, error) {
+	var imgs [2]image.Image
+	for i, b := range inputs {
+		f, _, err := s.probe(ctx, b, cts[i])
+		if err != nil {
+			return nil, err
+		}
+		if imgs[i], err = s.decode(ctx, f, b); err != nil {
+			return nil, err
+		}
+	}
+
+	h := min(imgs[0].Bounds().Dy(), imgs[1].Bounds().Dy())
+	var widths [2]int
+	for i, img := range imgs {
+		b := img.Bounds()
+		widths[i] = max(1, b.Dx()*h/b.Dy())
+	}
+	w := widths[0] + compareGutter + widths[1]
+	if longest := max(w, h); longest > maxDim {
+		scale := float64(maxDim) / float64(longest)
+		h = max(1, int(float64(h)*scale))
+		for i := range widths {
+			widths[i] = max(1, int(float64(widths[i])*scale))
+		}
+		w = widths[0] + compareGutter + widths[1]
+	}
+
+	start := time.Now()
+	canvas := newRGBA(image.Rect(0, 0, w, h))
+	defer putRGBA(canvas)
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+	x := 0
+	var panels [2]image.Rectangle
+	for i, img := range imgs {
+		panels[i] = image.Rect(x, 0, x+widths[i], h)
+		draw.CatmullRom.Scale(canvas, panels[i], img, img.Bounds(), draw.Over, nil)
+		x += widths[i] + compareGutter
+	}
+	observeStage(ctx, start, "resize")
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := drawLabels(canvas, panels, labels); err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	out := getBuffer()
+	if err := jpeg.Encode(out, canvas, &jpeg.Options{Quality: quality}); err != nil {
+		putBuffer(out)
+		return nil, fmt.Errorf("failed to encode image/jpeg")
+	}
+	observeStage(ctx, start, "encode")
+	return &result{body: out.Bytes(), buf: out, ct: "image/jpeg", origCT: cts[0], width: w, height: h}, nil
+}
+
+// drawLabels writes each label in white on a translucent black box in its
+// panel's top-left corner, clipped to the panel.
+func drawLabels(dst *image.RGBA, panels [2]image.Rectangle, labels [2]string) error {
+	f, err := labelFont()
+	if err != nil {
+		return err
+	}
+	size := max(minLabelSize, panels[0].Dy()/labelSizeFactor)
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: float64(size), DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+	pad := size / 2
+	box := image.NewUniform(color.NRGBA{0, 0, 0, 0x99})
+	for i, label := range labels {
+		if label == "" {
+			continue
+		}
+		clip := dst.SubImage(panels[i]).(*image.RGBA)
+		d := &font.Drawer{Dst: clip, Src: image.White, Face: face}
+		tw := d.MeasureString(label).Ceil()
+		m := face.Metrics()
+		r := image.Rect(0, 0, tw+2*pad, (m.Ascent+m.Descent).Ceil()+2*pad).
+			Add(panels[i].Min.Add(image.Pt(pad, pad))).Intersect(panels[i])
+		draw.Draw(clip, r, box, image.Point{}, draw.Over)
+		d.Dot = fixed.P(r.Min.X+pad, r.Min.Y+pad+m.Ascent.Ceil())
+		d.DrawString(label)
+	}
+	return nil
+}
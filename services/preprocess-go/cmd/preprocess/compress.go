@@ -0,0 +1,108 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Dashboards poll /stats, /metrics, /usage and the admin API every few
+// seconds, and those bodies are repetitive JSON and text that gzip shrinks
+// several times over. compress gzips them for clients that accept it. It
+// looks at the Content-Type as the response starts, so an image body is
+// never touched: it is compressed already, and callers and CDNs rely on its
+// exact bytes. Brotli isn't offered; the standard library has no encoder,
+// and on bodies this size gzip gets most of the gain.
+
+var gzipPool = sync.Pool{New: func() any {
+	zw, _ := gzip.NewWriterLevel(io.Discard, gzip.BestSpeed)
+	return zw
+}}
+
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// acceptsGzip reports whether Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+					continue // explicitly refused
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// compressible reports whether a response with header h and status code
+// should be gzipped.
+func compressible(h http.Header, code int) bool {
+	if code == http.StatusNoContent || code == http.StatusNotModified || h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && (mt == "application/json" || mt == "text/plain")
+}
+
+// compressWriter decides on compression when the status line goes out.
+type compressWriter struct {
+	http.ResponseWriter
+	zw    *gzip.Writer
+	wrote bool
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if !c.wrote {
+		c.wrote = true
+		if h := c.Header(); compressible(h, code) {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", "gzip")
+			c.zw = gzipPool.Get().(*gzip.Writer)
+			c.zw.Reset(c.ResponseWriter)
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.wrote {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.zw != nil {
+		return c.zw.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *compressWriter) close() {
+	if c.zw != nil {
+		_ = c.zw.Close()
+		gzipPool.Put(c.zw)
+	}
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
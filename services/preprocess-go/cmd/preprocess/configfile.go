@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A config file is the env var set written as a tree, so deployments can
+// keep dozens of settings in one reviewed file:
+//
+//	server:
+//	  addr: ":8080"
+//	  read_timeout: 30s
+//	limits:
+//	  max_pixels: 40000000
+//	auth:
+//	  api_keys:
+//	    web: vault://secret/preprocess#web
+//	presets:
+//	  thumb: {max_dim: 320, quality: 70}
+//	tenant_presets:
+//	  brandx:
+//	    thumb: {max_dim: 400, quality: 80}
+//
+// Section names only group keys; each key is the lower-case name of the env
+// var it sets. Lists are joined with commas and maps become "name:value"
+// pairs, the formats the env vars already use. Env vars win over the file.
+var (
+	fileMu       sync.Mutex
+	fileSettings = map[string]string{} // env name -> value
+	fileUsed     = map[string]bool{}
+	filePresets  map[string]url.Values
+	fileOverlays map[string]overlaySpec
+)
+
+// presetParams are the query params a preset may default.
+var presetParams = map[string]bool{
+	"max_dim": true, "quality": true, "sizes": true, "sanitize": true,
+	"depth": true, "interlace": true, "linear": true, "privacy": true, "redact_mode": true,
+	"overlay": true, "border": true, "ar": true, "fit": true, "bg": true,
+	"crops": true, "crop_mode": true, "bundle": true, "bundle_original": true,
+	"min_width": true, "min_height": true,
+}
+
+// setting returns the flag if given, else the env var if set, else the
+// config file value.
+func setting(key string) string {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+	fileUsed[key] = true
+	if v, ok := flagSettings[key]; ok {
+		return v
+	}
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fileSettings[key]
+}
+
+func loadConfigFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var tree map[string]any
+	if err := yaml.Unmarshal(b, &tree); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	settings := map[string]string{}
+	var presets map[string]url.Values
+	var overlays map[string]overlaySpec
+	tenantPresets := map[string]url.Values{}
+	for section, v := range tree {
+		switch section {
+		case "presets":
+			if presets, err = parsePresets(v); err != nil {
+				return fmt.Errorf("%s: presets: %w", path, err)
+			}
+			continue
+		case "tenant_presets":
+			m, ok := v.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s: tenant_presets: want a map of tenant names", path)
+			}
+			for tenant, tv := range m {
+				tp, err := parsePresets(tv)
+				if err != nil {
+					return fmt.Errorf("%s: tenant_presets: %s: %w", path, tenant, err)
+				}
+				for name, q := range tp {
+					tenantPresets[tenant+"/"+name] = q
+				}
+			}
+			continue
+		case "overlays":
+			if overlays, err = parseOverlays(v); err != nil {
+				return fmt.Errorf("%s: overlays: %w", path, err)
+			}
+			continue
+		}
+		m, ok := v.(map[string]any)
+		if !ok {
+			// Top-level scalars are allowed for one-off settings.
+			if err := flattenSetting(settings, section, v); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			continue
+		}
+		for key, val := range m {
+			if err := flattenSetting(settings, key, val); err != nil {
+				return fmt.Errorf("%s: %s: %w", path, section, err)
+			}
+		}
+	}
+	if len(tenantPresets) > 0 {
+		// Kept beside the shared ones as "tenant/name", which a plain
+		// preset name can't be.
+		if presets == nil {
+			presets = map[string]url.Values{}
+		}
+		maps.Copy(presets, tenantPresets)
+	}
+	fileMu.Lock()
+	fileSettings, filePresets, fileOverlays = settings, presets, overlays
+	fileUsed = map[string]bool{}
+	fileMu.Unlock()
+	return nil
+}
+
+func flattenSetting(dst map[string]string, key string, v any) error {
+	name := strings.ToUpper(key)
+	if _, dup := dst[name]; dup {
+		return fmt.Errorf("%s set twice", key)
+	}
+	s, err := settingValue(v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	dst[name] = s
+	return nil
+}
+
+func settingValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case int, bool:
+		return fmt.Sprint(v), nil
+	case float64:
+		// 'f' keeps 5e6 readable by the integer settings.
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, e := range v {
+			s, err := settingValue(e)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	case map[string]any:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		parts := make([]string, 0, len(v))
+		for _, name := range names {
+			s, err := settingValue(v[name])
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, name+":"+s)
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+func parsePresets(v any) (map[string]url.Values, error) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("want a map of preset names")
+	}
+	presets := make(map[string]url.Values, len(m))
+	for name, pv := range m {
+		if strings.Contains(name, "/") {
+			return nil, fmt.Errorf("%s: preset names can't contain /", name)
+		}
+		params, ok := pv.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: want a map of query params", name)
+		}
+		q := url.Values{}
+		for k, val := range params {
+			if !presetParams[k] {
+				return nil, fmt.Errorf("%s: unknown param %q", name, k)
+			}
+			s, err := settingValue(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", name, k, err)
+			}
+			q.Set(k, s)
+		}
+		presets[name] = q
+	}
+	return presets, nil
+}
+
+// warnUnusedSettings flags file keys nothing read, which are almost always
+// typos of a real setting.
+func warnUnusedSettings() {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+	for key := range fileSettings {
+		if !fileUsed[key] {
+			slog.Warn("unknown config file key", "key", strings.ToLower(key))
+		}
+	}
+}
+
+// applyPreset fills query params the request left unset from ?preset=,
+// taking the tenant's own preset of that name over the shared one.
+func (s *server) applyPreset(r *http.Request, presets map[string]url.Values) error {
+	q := r.URL.Query()
+	name := q.Get("preset")
+	if name == "" {
+		return nil
+	}
+	// Tenant presets are only reachable as the tenant, not by full name.
+	preset, ok := presets[name]
+	ok = ok && !strings.Contains(name, "/")
+	if t := tenantName(r.Context()); t != "" {
+		if tp, found := presets[t+"/"+name]; found {
+			preset, ok = tp, true
+		}
+	}
+	if !ok {
+		return fmt.Errorf("unknown preset %q", name)
+	}
+	for k, v := range preset {
+		if !q.Has(k) {
+			q[k] = v
+		}
+	}
+	r.URL.RawQuery = q.Encode()
+	logAttrs(r.Context(), "preset", name)
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// exposedHeaders are the response headers browser code may read.
+const exposedHeaders = "Content-Type, X-Original-Content-Type, X-Image-Width, X-Image-Height, X-Passthrough, X-Cache, X-Request-ID, X-Object-Name, X-Content-SHA256, X-Input-SHA256, X-Original-Bytes, X-Output-Bytes, X-Compression-Ratio"
+
+// cors lets the web client call the service from the browser. Preflights are
+// answered here, before auth and rate limiting, since browsers send them
+// without credentials. It is a no-op when no origins are configured.
+func (s *server) cors(next http.Handler) http.Handler {
+	origins := splitList(s.cfg.CORSAllowedOrigins)
+	if len(origins) == 0 {
+		return next
+	}
+	anyOrigin := slices.Contains(origins, "*")
+	methods := strings.Join(splitList(s.cfg.CORSAllowedMethods), ", ")
+	headers := strings.Join(splitList(s.cfg.CORSAllowedHeaders), ", ")
+	maxAge := strconv.Itoa(int(s.cfg.CORSMaxAge.Seconds()))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !(anyOrigin || slices.Contains(origins, origin)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", methods)
+			h.Set("Access-Control-Allow-Headers", headers)
+			h.Set("Access-Control-Max-Age", maxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", exposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// splitList splits a comma-separated config value, dropping blanks.
+func splitList(v string) []string {
+	var out []string
+	for _, f := range strings.Split(v, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
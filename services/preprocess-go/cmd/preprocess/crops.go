@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// crops=1:1,4:3,16:9 returns one output per aspect ratio, each the largest
+// crop of that shape, from a single decode. crop_mode=smart (the default)
+// slides each crop to the busiest part of the frame, center keeps it
+// centered. Parts come back in request order, named crop-WxH.
+//
+// Callers whose classifier has already found the dish pass its bounding box
+// as focus_box=x,y,w,h, fractions of the image's width and height. Each
+// crop is then centered on the box instead, and the energy pass smart mode
+// would run is skipped.
+const maxCrops = maxSizes
+
+// energyDim is the longest side of the map smart cropping scores; detail
+// finer than that doesn't move a crop.
+const energyDim = 256
+
+func cropsParam(r *http.Request) (crops []aspect, smart bool, err error) {
+	q := r.URL.Query()
+	switch v := q.Get("crop_mode"); v {
+	case "", "smart":
+		smart = true
+	case "center":
+	default:
+		return nil, false, fmt.Errorf("crop_mode must be smart or center, got %q", v)
+	}
+	v := q.Get("crops")
+	if v == "" {
+		return nil, false, nil
+	}
+	parts := strings.Split(v, ",")
+	if len(parts) > maxCrops {
+		return nil, false, fmt.Errorf("at most %d crops per request", maxCrops)
+	}
+	for _, p := range parts {
+		a, err := parseAspect(strings.TrimSpace(p))
+		if err != nil {
+			return nil, false, fmt.Errorf("crops: %w", err)
+		}
+		crops = append(crops, a)
+	}
+	return crops, smart, nil
+}
+
+// focusBox is a region of interest as fractions of the image's size.
+type focusBox struct {
+	x, y, w, h float64
+}
+
+func focusParam(r *http.Request) (*focusBox, error) {
+	v := r.URL.Query().Get("focus_box")
+	if v == "" {
+		return nil, nil
+	}
+	parts := strings.Split(v, ",")
+	var n [4]float64
+	ok := len(parts) == 4
+	for i := 0; ok && i < 4; i++ {
+		var err error
+		n[i], err = strconv.ParseFloat(strings.TrimSpace(parts[i]), 64)
+		ok = err == nil && n[i] >= 0 && n[i] <= 1
+	}
+	if !ok || n[2] == 0 || n[3] == 0 {
+		return nil, fmt.Errorf("focus_box must be x,y,w,h as fractions from 0 to 1 with w and h above 0, got %q", v)
+	}
+	return &focusBox{n[0], n[1], n[2], n[3]}, nil
+}
+
+func (s *server) processCrops(ctx context.Context, b []byte, ct string, crops []aspect, smart bool, focus *focusBox, opts options) ([]*result, error) {
+	start := time.Now()
+	f, cfg, err := s.probe(ctx, b, ct)
+	if err != nil {
+		return nil, err
+	}
+	// A crop's long side can be as short as the image's short side, so the
+	// EXIF thumbnail has to be that much larger to stand in.
+	need := opts.maxDim * max(cfg.Width, cfg.Height) / max(1, min(cfg.Width, cfg.Height))
+	img, err := s.decodeFor(ctx, f, b, cfg, need)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkBlank(ctx, f, b, cfg, img); err != nil {
+		return nil, err
+	}
+	if img, err = s.editImage(ctx, img, b, f.ct, cfg, opts); err != nil {
+		return nil, err
+	}
+
+	var energy *image.Gray
+	if smart && focus == nil {
+		t := time.Now()
+		energy = energyMap(img)
+		observeStage(ctx, t, "analyze")
+	}
+	set, err := s.renderAll(len(crops), func(i int) (*result, error) {
+		res, err := render(ctx, subImage(img, cropRect(img.Bounds(), crops[i], energy, focus)), f.ct, opts.maxDim, opts)
+		if err == nil {
+			res.name = fmt.Sprintf("crop-%dx%d", crops[i].w, crops[i].h)
+		}
+		return res, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out int
+	for _, res := range set {
+		out += len(res.body)
+	}
+	observeFormat(f.ct, start, len(b), out)
+	return set, nil
+}
+
+// cropRect returns the largest rectangle of aspect a within b, centered, or
+// with energy, placed where the map is busiest along the axis it can slide,
+// or with focus, centered on it as far as b allows.
+func cropRect(b image.Rectangle, a aspect, energy *image.Gray, focus *focusBox) image.Rectangle {
+	w, h := b.Dx(), b.Dy()
+	cw, ch := w, h
+	if float64(w)/float64(h) > a.ratio() {
+		cw = max(1, min(w, int(math.Round(float64(h)*a.ratio()))))
+	} else {
+		ch = max(1, min(h, int(math.Round(float64(w)/a.ratio()))))
+	}
+	x, y := (w-cw)/2, (h-ch)/2
+	switch {
+	case focus != nil:
+		cx, cy := (focus.x+focus.w/2)*float64(w), (focus.y+focus.h/2)*float64(h)
+		x = min(max(0, int(math.Round(cx-float64(cw)/2))), w-cw)
+		y = min(max(0, int(math.Round(cy-float64(ch)/2))), h-ch)
+	case energy != nil:
+		eb := energy.Bounds()
+		if cw < w {
+			x = busiestWindow(columnSums(energy), float64(cw)/float64(w)) * w / eb.Dx()
+		} else if ch < h {
+			y = busiestWindow(rowSums(energy), float64(ch)/float64(h)) * h / eb.Dy()
+		}
+		x, y = min(x, w-cw), min(y, h-ch)
+	}
+	return image.Rect(x, y, x+cw, y+ch).Add(b.Min)
+}
+
+// energyMap is a small edge-strength map of img: sharp, detailed regions
+// (the dish) score high, plain backgrounds and bokeh low.
+func energyMap(img image.Image) *image.Gray {
+	small := grayThumb(img)
+	w, h := small.Rect.Dx(), small.Rect.Dy()
+	energy := image.NewGray(small.Bounds())
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := int(small.GrayAt(x, y).Y)
+			dx := c - int(small.GrayAt(min(x+1, w-1), y).Y)
+			dy := c - int(small.GrayAt(x, min(y+1, h-1)).Y)
+			energy.SetGray(x, y, color.Gray{Y: uint8(min(255, absInt(dx)+absInt(dy)))})
+		}
+	}
+	return energy
+}
+
+// grayThumb is a grayscale copy of img, energyDim on its long side at most.
+func grayThumb(img image.Image) *image.Gray {
+	b := img.Bounds()
+	scale := math.Min(1, float64(energyDim)/float64(max(b.Dx(), b.Dy())))
+	w, h := max(1, int(float64(b.Dx())*scale)), max(1, int(float64(b.Dy())*scale))
+	small := image.NewGray(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, b, draw.Src, nil)
+	return small
+}
+
+func columnSums(g *image.Gray) []int {
+	b := g.Bounds()
+	sums := make([]int, b.Dx())
+	for y := 0; y < b.Dy(); y++ {
+		for x := range sums {
+			sums[x] += int(g.GrayAt(x, y).Y)
+		}
+	}
+	return sums
+}
+
+func rowSums(g *image.Gray) []int {
+	b := g.Bounds()
+	sums := make([]int, b.Dy())
+	for y := range sums {
+		for x := 0; x < b.Dx(); x++ {
+			sums[y] += int(g.GrayAt(x, y).Y)
+		}
+	}
+	return sums
+}
+
+// busiestWindow returns the start of the window covering frac of sums with
+// the largest total. When a run of windows ties, as when all of them hold
+// the whole subject, it takes the middle one to leave the subject centered.
+func busiestWindow(sums []int, frac float64) int {
+	n := len(sums)
+	win := max(1, min(n, int(math.Round(frac*float64(n)))))
+	total := 0
+	for _, v := range sums[:win] {
+		total += v
+	}
+	first, last, bestTotal := 0, 0, total
+	for i := 1; i+win <= n; i++ {
+		total += sums[i+win-1] - sums[i-1]
+		switch {
+		case total > bestTotal:
+			first, last, bestTotal = i, i, total
+		case total == bestTotal && last == i-1:
+			last = i
+		}
+	}
+	return (first + last) / 2
+}
+
+// subImage crops img to r without copying when the image type allows it.
+func subImage(img image.Image, r image.Rectangle) image.Image {
+	if si, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return si.SubImage(r)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
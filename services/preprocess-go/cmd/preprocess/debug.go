@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"net/netip"
+)
+
+// debugMux serves pprof and expvar. It is only ever mounted on the internal
+// debug listener, never on the public mux.
+func debugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+func startDebugServer(addr string) {
+	// No write timeout: CPU profiles and traces stream for ?seconds=N.
+	srv := &http.Server{Addr: addr, Handler: debugMux(), ReadHeaderTimeout: defaultReadHeaderTimeout}
+	go func() {
+		slog.Info("debug endpoints listening", "addr", addr)
+		if err := srv.ListenAndServe(); err != nil {
+			slog.Error("debug server stopped", "err", err)
+		}
+	}()
+}
+
+// debugHeaders answers X-Debug: 1 from internal callers (DEBUG_CALLERS names
+// or DEBUG_NETWORKS addresses) with X-Debug-Info, a JSON object of what the
+// pipeline decided (formats, dimensions, scale, passthrough, cache) and how
+// long each stage took. Anyone else's X-Debug is ignored.
+func (s *server) debugHeaders(next http.Handler) http.Handler {
+	if len(s.debugCallers) == 0 && len(s.debugNets) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := stateFrom(r.Context())
+		if r.Header.Get("X-Debug") != "1" || st == nil || !s.debugAllowed(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&debugWriter{ResponseWriter: w, st: st}, r)
+	})
+}
+
+func (s *server) debugAllowed(r *http.Request) bool {
+	if name := callerName(r.Context()); name != "" && s.debugCallers[name] {
+		return true
+	}
+	ip, err := netip.ParseAddr(clientIP(r))
+	return err == nil && containsAddr(s.debugNets, ip)
+}
+
+// debugWriter adds X-Debug-Info as the status line goes out; every stage
+// has finished by then, since results are fully encoded before writing.
+type debugWriter struct {
+	http.ResponseWriter
+	st    *requestState
+	wrote bool
+}
+
+func (d *debugWriter) WriteHeader(code int) {
+	if !d.wrote {
+		d.wrote = true
+		if b, err := json.Marshal(d.st.snapshot()); err == nil {
+			d.Header().Set("X-Debug-Info", string(b))
+		}
+	}
+	d.ResponseWriter.WriteHeader(code)
+}
+
+func (d *debugWriter) Write(b []byte) (int, error) {
+	if !d.wrote {
+		d.WriteHeader(http.StatusOK)
+	}
+	return d.ResponseWriter.Write(b)
+}
+
+func (d *debugWriter) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math/bits"
+	"net/http"
+
+	"golang.org/x/image/draw"
+)
+
+// Restaurants export galleries with the same photo in them several times:
+// copied into two folders, or saved again at another size or quality.
+// /archive reports such entries in the manifest, "duplicate":"exact" for
+// the same bytes and "near" for the same picture, with "duplicate_of"
+// naming the first one; duplicates=skip leaves them out of the outputs too.
+// Exact copies are found by hash before processing. Near ones are found by a
+// difference hash of each output, which survives resizing and recompression
+// but not crops or edits.
+
+// nearDuplicateBits is how many of the 64 dHash bits two outputs may differ
+// in and still be the same picture. Recompressed or resized copies differ
+// in a few; different dishes shot on the same table in twenty or more.
+const nearDuplicateBits = 6
+
+func duplicatesParam(r *http.Request) (bool, error) {
+	switch v := r.URL.Query().Get("duplicates"); v {
+	case "", "keep":
+		return false, nil
+	case "skip":
+		return true, nil
+	default:
+		return false, fmt.Errorf("duplicates must be keep or skip, got %q", v)
+	}
+}
+
+// dHash is the difference hash of img: a 9×8 grayscale copy, one bit per
+// pair of horizontal neighbours, set when the left one is brighter. At 9×8
+// a plain or finely patterned image averages out to flat gray, whose bits
+// are all noise; ok is false for those, and they are never near anything.
+func dHash(img image.Image) (hash uint64, ok bool) {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	// From the energyDim copy, so the kernel averages every pixel instead
+	// of sampling a few of a large image.
+	thumb := grayThumb(img)
+	draw.BiLinear.Scale(small, small.Bounds(), thumb, thumb.Bounds(), draw.Src, nil)
+	lo, hi := 255, 0
+	for _, v := range small.Pix {
+		lo, hi = min(lo, int(v)), max(hi, int(v))
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash, hi-lo >= minHashContrast
+}
+
+// minHashContrast is the least spread of gray levels, out of 255, a 9×8
+// copy needs for its dHash to mean anything.
+const minHashContrast = 16
+
+// outputHash is dHash of res's image, decoded from its body.
+func outputHash(res *result) (uint64, bool, error) {
+	f, _, err := probeImage(res.body, res.ct)
+	if err != nil {
+		return 0, false, err
+	}
+	img, err := f.decode(bytes.NewReader(res.body))
+	if err != nil {
+		return 0, false, err
+	}
+	hash, ok := dHash(img)
+	return hash, ok, nil
+}
+
+func nearDuplicate(a, b uint64) bool {
+	return bits.OnesCount64(a^b) <= nearDuplicateBits
+}
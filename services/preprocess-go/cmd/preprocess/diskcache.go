@@ -0,0 +1,185 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCache keeps serialized results as files under dir, evicting the least
+// recently used once the total exceeds maxBytes. Recency is persisted as the
+// file mtime so the order survives restarts.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	order *list.List // front = most recent
+	items map[string]*list.Element
+}
+
+type diskEntry struct {
+	name string
+	size int64
+}
+
+const diskCacheExt = ".entry"
+
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &diskCache{dir: dir, maxBytes: maxBytes, order: list.New(), items: map[string]*list.Element{}}
+
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		diskEntry
+		mtime time.Time
+	}
+	var files []found
+	for _, de := range des {
+		if de.IsDir() || !strings.HasSuffix(de.Name(), diskCacheExt) {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, found{diskEntry{de.Name(), info.Size()}, info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.After(files[j].mtime) })
+	for _, f := range files {
+		e := f.diskEntry
+		c.items[e.name] = c.order.PushBack(&e)
+		c.size += e.size
+	}
+	c.mu.Lock()
+	c.evictLocked()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// Keys embed option dumps, so hash them into safe, fixed-length file names.
+func diskCacheName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + diskCacheExt
+}
+
+func (c *diskCache) Get(_ context.Context, key string) (*result, bool) {
+	name := diskCacheName(key)
+	c.mu.Lock()
+	el, ok := c.items[name]
+	if ok {
+		c.order.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	path := filepath.Join(c.dir, name)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		c.forget(name)
+		return nil, false
+	}
+	res, err := unmarshalEntry(raw)
+	if err != nil {
+		c.forget(name)
+		_ = os.Remove(path)
+		return nil, false
+	}
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return res, true
+}
+
+func (c *diskCache) Set(_ context.Context, key string, res *result) {
+	raw, err := marshalEntry(res)
+	if err != nil || int64(len(raw)) > c.maxBytes {
+		return
+	}
+	name := diskCacheName(key)
+
+	// Write-then-rename so a concurrent Get never sees a partial file.
+	tmp, err := os.CreateTemp(c.dir, "tmp-*")
+	if err != nil {
+		slog.Warn("cache: disk set failed", "err", err)
+		return
+	}
+	_, err = tmp.Write(raw)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		slog.Warn("cache: disk set failed", "err", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[name]; ok {
+		c.size -= el.Value.(*diskEntry).size
+		c.order.Remove(el)
+	}
+	c.items[name] = c.order.PushFront(&diskEntry{name: name, size: int64(len(raw))})
+	c.size += int64(len(raw))
+	c.evictLocked()
+}
+
+// flush removes every entry file and reports how many there were.
+func (c *diskCache) flush(context.Context) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	var firstErr error
+	for name := range c.items {
+		if err := os.Remove(filepath.Join(c.dir, name)); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+		n++
+	}
+	c.order.Init()
+	clear(c.items)
+	c.size = 0
+	return n, firstErr
+}
+
+func (c *diskCache) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[name]; ok {
+		c.size -= el.Value.(*diskEntry).size
+		c.order.Remove(el)
+		delete(c.items, name)
+	}
+}
+
+func (c *diskCache) evictLocked() {
+	for c.size > c.maxBytes {
+		el := c.order.Back()
+		e := el.Value.(*diskEntry)
+		c.order.Remove(el)
+		delete(c.items, e.name)
+		c.size -= e.size
+		if err := os.Remove(filepath.Join(c.dir, e.name)); err != nil && !os.IsNotExist(err) {
+			slog.Warn("cache: disk evict failed", "err", err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// downstream is the HTTP client for the services uploads depend on (face
+// detection, image hosts, webhooks): each attempt has its own timeout,
+// transient failures are retried with jittered exponential backoff, and a
+// circuit breaker stops calling a service that keeps failing, so one flaky
+// dependency costs its callers a fast error instead of every request
+// waiting out its timeouts.
+//
+// Transient means a transport error, 429, 502, 503 or 504. Retries stay
+// within the caller's context, so they never stretch a request past its
+// deadline. The breaker counts a call as failed when it ends in a transient
+// failure or any other 5xx but 501, retried or not.
+type downstream struct {
+	name    string
+	client  *http.Client
+	retries int
+	backoff time.Duration // first retry delay; doubles each time
+
+	mu       sync.Mutex
+	failures int       // consecutive failed calls
+	openedAt time.Time // zero while closed
+	probing  bool      // a half-open trial call is in flight
+	cfg      breakerConfig
+}
+
+type breakerConfig struct {
+	threshold int           // consecutive failures that open the circuit
+	cooldown  time.Duration // how long it stays open before a trial call
+}
+
+// errCircuitOpen is returned without calling a service whose breaker is open.
+var errCircuitOpen = errors.New("circuit open")
+
+const (
+	// maxRetryAfter caps how long a Retry-After header can make a retry wait.
+	maxRetryAfter = 5 * time.Second
+	// maxBackoff caps the doubling delay between retries.
+	maxBackoff = 30 * time.Second
+)
+
+var downstreamRequests = newCounterVec("preprocess_downstream_requests_total",
+	"Calls to downstream services by result (ok, retried, failed, circuit_open).", "service", "result")
+
+func newDownstream(name string, timeout time.Duration, cfg config) *downstream {
+	return &downstream{
+		name:    name,
+		client:  &http.Client{Timeout: timeout},
+		retries: cfg.DownstreamRetries,
+		backoff: cfg.DownstreamBackoff,
+		cfg:     breakerConfig{threshold: cfg.BreakerThreshold, cooldown: cfg.BreakerCooldown},
+	}
+}
+
+// do sends req, retrying transient failures. A request with a body must be
+// replayable (http.NewRequest sets GetBody for in-memory readers). The last
+// response is returned as-is, including a final transient status, for the
+// caller to interpret.
+func (d *downstream) do(req *http.Request) (*http.Response, error) {
+	if !d.allow() {
+		downstreamRequests.inc(d.name, "circuit_open")
+		return nil, fmt.Errorf("%s: %w", d.name, errCircuitOpen)
+	}
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		resp, err := d.client.Do(req)
+		if !transient(resp, err) {
+			if serverError(resp) {
+				d.record(false)
+				downstreamRequests.inc(d.name, "failed")
+			} else {
+				d.record(true)
+				downstreamRequests.inc(d.name, "ok")
+			}
+			return resp, err
+		}
+		if ctx.Err() != nil {
+			// The caller gave up; that says nothing about the service.
+			d.abandon()
+			downstreamRequests.inc(d.name, "failed")
+			return resp, err
+		}
+		if attempt == d.retries || (req.Body != nil && req.GetBody == nil) {
+			d.record(false)
+			downstreamRequests.inc(d.name, "failed")
+			return resp, err
+		}
+		wait := d.retryDelay(attempt)
+		if resp != nil {
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+				wait = min(time.Duration(s)*time.Second, maxRetryAfter)
+			}
+			resp.Body.Close()
+		}
+		downstreamRequests.inc(d.name, "retried")
+		if err := sleepCtx(ctx, wait); err != nil {
+			d.abandon()
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				d.abandon()
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
+
+func transient(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// serverError reports whether resp says the service itself failed. 501 is
+// left out: it's a fixed answer to what was asked, not a sign of trouble.
+func serverError(resp *http.Response) bool {
+	return resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented
+}
+
+// retryDelay is the jittered wait before retrying after attempt, doubling
+// from backoff up to maxBackoff.
+func (d *downstream) retryDelay(attempt int) time.Duration {
+	wait := d.backoff
+	for i := 0; i < attempt && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	wait = min(wait, maxBackoff)
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + rand.N(wait/2+1)
+}
+
+// allow reports whether a call may go ahead. Once the cooldown has passed,
+// an open breaker lets a single trial call through; its outcome closes the
+// breaker or restarts the cooldown.
+func (d *downstream) allow() bool {
+	if d.cfg.threshold <= 0 {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.openedAt.IsZero() {
+		return true
+	}
+	if d.probing || time.Since(d.openedAt) < d.cfg.cooldown {
+		return false
+	}
+	d.probing = true
+	return true
+}
+
+func (d *downstream) record(ok bool) {
+	if d.cfg.threshold <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	wasOpen := !d.openedAt.IsZero()
+	d.probing = false
+	if ok {
+		d.failures, d.openedAt = 0, time.Time{}
+		return
+	}
+	d.failures++
+	if wasOpen || d.failures >= d.cfg.threshold {
+		if !wasOpen {
+			slog.Warn("circuit opened", "service", d.name, "failures", d.failures, "cooldown", d.cfg.cooldown)
+		}
+		d.openedAt = time.Now()
+	}
+}
+
+// check is a readiness probe that costs no call: it fails while the
+// breaker is open and cooling down. Once a trial call is due the service
+// counts as ready again, so the trial can happen.
+func (d *downstream) check(context.Context) error {
+	if d.cfg.threshold <= 0 {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.openedAt.IsZero() && time.Since(d.openedAt) < d.cfg.cooldown {
+		return fmt.Errorf("%w after %d failed calls", errCircuitOpen, d.failures)
+	}
+	return nil
+}
+
+// abandon ends a call without an outcome, such as one its caller cancelled:
+// neither success nor failure is counted, but a half-open trial is over, so
+// the next call may try again.
+func (d *downstream) abandon() {
+	if d.cfg.threshold <= 0 {
+		return
+	}
+	d.mu.Lock()
+	d.probing = false
+	d.mu.Unlock()
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
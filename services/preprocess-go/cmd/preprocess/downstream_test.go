@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testDownstream(threshold int, cooldown time.Duration) *downstream {
+	return newDownstream("test", time.Second, config{
+		DownstreamRetries: 2,
+		DownstreamBackoff: time.Millisecond,
+		BreakerThreshold:  threshold,
+		BreakerCooldown:   cooldown,
+	})
+}
+
+// statusServer answers each call with the next status in statuses,
+// repeating the last one.
+func statusServer(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(statuses[min(n, len(statuses))-1])
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func call(t *testing.T, d *downstream, url string) (int, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := d.do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestDownstreamRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		want      int
+		wantCalls int32
+		failed    bool // counted against the breaker
+	}{
+		{"ok", []int{200}, 200, 1, false},
+		{"client error isn't retried", []int{400}, 400, 1, false},
+		{"not implemented isn't a failure", []int{501}, 501, 1, false},
+		{"500 isn't retried but fails", []int{500}, 500, 1, true},
+		{"transient then ok", []int{503, 502, 200}, 200, 3, false},
+		{"429 is retried", []int{429, 200}, 200, 2, false},
+		{"retries run out", []int{503}, 503, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, calls := statusServer(t, tt.statuses...)
+			d := testDownstream(1, time.Hour)
+			got, err := call(t, d, srv.URL)
+			if err != nil || got != tt.want {
+				t.Fatalf("do = %d, %v; want %d", got, err, tt.want)
+			}
+			if n := calls.Load(); n != tt.wantCalls {
+				t.Errorf("%d calls, want %d", n, tt.wantCalls)
+			}
+			if open := d.check(context.Background()) != nil; open != tt.failed {
+				t.Errorf("breaker open = %v, want %v", open, tt.failed)
+			}
+		})
+	}
+}
+
+func TestDownstreamBreaker(t *testing.T) {
+	srv, calls := statusServer(t, 500, 500, 500, 200)
+	d := testDownstream(3, 50*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		if code, _ := call(t, d, srv.URL); code != 500 {
+			t.Fatalf("call %d = %d, want 500", i, code)
+		}
+	}
+	if _, err := call(t, d, srv.URL); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("call after %d failures = %v, want %v", 3, err, errCircuitOpen)
+	}
+	if err := d.check(context.Background()); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("check while open = %v, want %v", err, errCircuitOpen)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("open breaker let calls through: %d, want 3", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := d.check(context.Background()); err != nil {
+		t.Errorf("check once a trial is due = %v, want nil", err)
+	}
+	// Only one trial call goes through at a time.
+	if !d.allow() {
+		t.Fatal("trial call refused after the cooldown")
+	}
+	if d.allow() {
+		t.Error("second call allowed while the trial is in flight")
+	}
+	d.abandon()
+	if code, err := call(t, d, srv.URL); err != nil || code != 200 {
+		t.Fatalf("trial call = %d, %v; want 200", code, err)
+	}
+	if err := d.check(context.Background()); err != nil {
+		t.Errorf("check after a good trial = %v, want nil", err)
+	}
+}
+
+func TestDownstreamFailedTrialReopens(t *testing.T) {
+	srv, _ := statusServer(t, 500)
+	d := testDownstream(1, 30*time.Millisecond)
+	call(t, d, srv.URL)
+	time.Sleep(40 * time.Millisecond)
+	if code, err := call(t, d, srv.URL); err != nil || code != 500 {
+		t.Fatalf("trial call = %d, %v; want 500", code, err)
+	}
+	if _, err := call(t, d, srv.URL); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("call after a failed trial = %v, want %v", err, errCircuitOpen)
+	}
+}
+
+func TestDownstreamCancelledCallDoesntCount(t *testing.T) {
+	srv, _ := statusServer(t, 503)
+	d := testDownstream(1, time.Hour)
+	d.backoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if _, err := d.do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("do = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := d.check(context.Background()); err != nil {
+		t.Errorf("breaker opened by a call its caller gave up on: %v", err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	d := &downstream{backoff: time.Second}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		for i := 0; i < 20; i++ {
+			if got := d.retryDelay(attempt); got < want/2 || got > want {
+				t.Fatalf("retryDelay(%d) = %v, want %v-%v", attempt, got, want/2, want)
+			}
+		}
+	}
+	for _, attempt := range []int{5, 30, 64, 1000} {
+		if got := d.retryDelay(attempt); got <= 0 || got > maxBackoff {
+			t.Errorf("retryDelay(%d) = %v, want within (0, %v]", attempt, got, maxBackoff)
+		}
+	}
+	if got := (&downstream{}).retryDelay(3); got != 0 {
+		t.Errorf("retryDelay without backoff = %v, want 0", got)
+	}
+}
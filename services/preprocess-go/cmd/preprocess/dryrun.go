@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+)
+
+// dry_run=true checks a /preprocess request the way processing it would,
+// parameters, upload, format and limits, and answers with what it would
+// produce instead of producing it:
+//
+//	200 {"dry_run":true,"input":{"content_type":"image/jpeg","width":4032,"height":3024,"bytes":3145728},
+//	     "transforms":["resize"],"outputs":[{"content_type":"image/jpeg","width":1280,"height":960,"estimated_bytes":201234}]}
+//
+// Only the image header is read; nothing is decoded and no worker slot is
+// taken, so clients can preflight a large batch cheaply. Dimensions and
+// passthroughs are exact. The format is exact except for inputs with an
+// alpha channel, which are planned as PNG though a fully opaque one would
+// come out JPEG, and estimated_bytes is a rough guess from the pixel count,
+// quality and, for JPEG inputs, how densely the upload is compressed.
+// Nothing is stored or charged to quotas.
+
+type plannedOutput struct {
+	Name           string `json:"name,omitempty"`
+	ContentType    string `json:"content_type"`
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	EstimatedBytes int    `json:"estimated_bytes"`
+	Passthrough    bool   `json:"passthrough,omitempty"`
+}
+
+// writeDryRun answers a dry run for b, the upload as the pipeline would
+// see it.
+func (s *server) writeDryRun(w http.ResponseWriter, r *http.Request, b []byte, ct string, sizes []int, crops []aspect, focus *focusBox, opts options) {
+	f, cfg, err := s.probe(r.Context(), b, ct)
+	if err != nil {
+		s.writeJobError(w, r, err)
+		return
+	}
+	full := image.Rect(0, 0, cfg.Width, cfg.Height)
+	if opts.trim != (aspect{}) {
+		full = cropRect(full, opts.trim, nil, nil)
+	}
+	var outputs []plannedOutput
+	resized := false
+	plan := func(name string, w, h, maxDim int) {
+		single := len(crops) == 0 && len(sizes) == 0
+		out := planOutput(f, cfg, len(b), w, h, maxDim, single, opts)
+		out.Name = name
+		outputs = append(outputs, out)
+		resized = resized || max(w, h) > maxDim
+	}
+	switch {
+	case len(crops) > 0:
+		for _, a := range crops {
+			c := cropRect(full, a, nil, focus)
+			plan(fmt.Sprintf("crop-%dx%d", a.w, a.h), c.Dx(), c.Dy(), opts.maxDim)
+		}
+	case len(sizes) > 0:
+		for _, size := range sizes {
+			plan("", full.Dx(), full.Dy(), size)
+		}
+	default:
+		plan("", full.Dx(), full.Dy(), opts.maxDim)
+	}
+
+	transforms := []string{}
+	add := func(on bool, name string) {
+		if on {
+			transforms = append(transforms, name)
+		}
+	}
+	add(opts.blurFaces, "blur_faces")
+	add(len(opts.redact.regions) > 0, "redact")
+	add(opts.trim != (aspect{}), "trim")
+	add(len(crops) > 0, "crop")
+	add(resized, "resize")
+	add(opts.letterbox.ar != (aspect{}), "letterbox")
+	add(opts.overlay != nil, "overlay")
+	add(opts.border.width > 0, "border")
+	add(opts.sanitize, "sanitize")
+
+	logAttrs(r.Context(), "dry_run", true, "outputs", len(outputs))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"dry_run": true,
+		"input": map[string]any{
+			"content_type": f.ct, "width": cfg.Width, "height": cfg.Height, "bytes": len(b),
+		},
+		"transforms": transforms,
+		"outputs":    outputs,
+	})
+}
+
+// planOutput follows process and render for one output of a w×h region of
+// the input, scaled to fit maxDim. Only a single output, not sizes or
+// crops, can skip the decode and pass through untouched.
+func planOutput(f imageFormat, cfg image.Config, inputLen, w, h, maxDim int, single bool, opts options) plannedOutput {
+	fits := single && max(cfg.Width, cfg.Height) <= maxDim
+	alpha := hasAlphaChannel(cfg.ColorModel)
+	switch {
+	case fits && !opts.forceEncode && f.ct == "image/jpeg" && !isCMYK(cfg),
+		fits && !opts.forceEncode && !opts.interlace && f.ct == "image/png" && opts.depth16 && is16Bit(cfg.ColorModel),
+		fits && !opts.forceEncode && !opts.interlace && f.ct == "image/png" && alpha:
+		return plannedOutput{ContentType: f.ct, Width: cfg.Width, Height: cfg.Height, EstimatedBytes: inputLen, Passthrough: true}
+	}
+
+	out := plannedOutput{ContentType: "image/jpeg", Width: w, Height: h}
+	if lb := opts.letterbox; lb.ar != (aspect{}) {
+		out.Width, out.Height, _ = lb.fit(image.Rect(0, 0, w, h), maxDim)
+		alpha = alpha || lb.bg.A < 0xff
+	} else if nw, nh, ok := scaledSize(image.Rect(0, 0, w, h), maxDim); ok {
+		out.Width, out.Height = nw, nh
+	}
+	if (opts.depth16 && is16Bit(cfg.ColorModel)) || alpha {
+		out.ContentType = "image/png"
+	}
+	out.EstimatedBytes = estimateBytes(out, f, cfg, inputLen, opts)
+
+	// keepSmaller hands back an upload that fits when re-encoding grows it.
+	keepable := !opts.sanitize && !opts.edits() && max(cfg.Width, cfg.Height) <= maxDim && !isCMYK(cfg) &&
+		(f.ct == "image/jpeg" || f.ct == "image/png") && !(opts.interlace && out.ContentType == "image/png") &&
+		w == cfg.Width && h == cfg.Height
+	if keepable && out.EstimatedBytes > inputLen {
+		return plannedOutput{ContentType: f.ct, Width: cfg.Width, Height: cfg.Height, EstimatedBytes: inputLen, Passthrough: true}
+	}
+	return out
+}
+
+// estimateBytes guesses out's encoded size from how densely the upload is
+// compressed, which says more about how busy this particular photo is than
+// any typical figure, adjusted for the change in size, quality and format.
+func estimateBytes(out plannedOutput, f imageFormat, cfg image.Config, inputLen int, opts options) int {
+	pixels := float64(out.Width * out.Height)
+	in := float64(cfg.Width * cfg.Height)
+	inBPP := float64(inputLen) * 8 / in
+	// Downscaling packs more detail into each pixel; measured on our
+	// uploads, bits per pixel rise with about the 0.4th power of the
+	// reduction.
+	detail := math.Pow(in/pixels, 0.4)
+	// JPEG size grows steeply with quality: ~0.7 bits per pixel at 50, ~2
+	// at 85, ~3 at 95. Phone uploads are typically quality 90 or so.
+	qualityBPP := func(q int) float64 {
+		x := float64(q) / 100
+		return 0.5 + 3*x*x*x*x
+	}
+	jpegBPP := qualityBPP(opts.quality)
+	if f.ct == "image/jpeg" {
+		jpegBPP = inBPP * detail * qualityBPP(opts.quality) / qualityBPP(90)
+	}
+	var bpp float64
+	switch {
+	case out.ContentType == "image/png" && f.ct == "image/png":
+		bpp = inBPP * detail
+	case out.ContentType == "image/png":
+		bpp = 5 * jpegBPP // lossless, roughly
+	default:
+		bpp = jpegBPP
+		if cfg.ColorModel == color.GrayModel {
+			bpp *= 0.6
+		}
+	}
+	return int(pixels * bpp / 8)
+}
+
+// hasAlphaChannel reports whether images of model m can carry transparency.
+func hasAlphaChannel(m color.Model) bool {
+	switch m {
+	case color.RGBAModel, color.NRGBAModel, color.RGBA64Model, color.NRGBA64Model, color.AlphaModel, color.Alpha16Model:
+		return true
+	}
+	if p, ok := m.(color.Palette); ok {
+		for _, c := range p {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
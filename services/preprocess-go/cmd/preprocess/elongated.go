@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+)
+
+// Screenshots of chat threads and receipts, 1:4 and worse, get uploaded
+// where a dish photo should be. PHOTO_MAX_ASPECT_RATIO sets how elongated a
+// /preprocess upload may be, and PHOTO_ASPECT_MODE what happens past it:
+// reject answers 422 EXTREME_ASPECT_RATIO, which the app turns into a prompt
+// for an actual food photo; crop keeps the middle of the image at the limit
+// and processes that. Unlike MAX_ASPECT_RATIO, which protects the decoder,
+// this is about what the picture is, so it is checked against a video's
+// frame or a document's page when one stands in for the upload.
+
+// PHOTO_ASPECT_MODE values.
+const (
+	photoAspectReject = "reject"
+	photoAspectCrop   = "crop"
+)
+
+// elongation is how many times the longest side of cfg is the shortest.
+func elongation(cfg image.Config) float64 {
+	return float64(max(cfg.Width, cfg.Height)) / float64(max(1, min(cfg.Width, cfg.Height)))
+}
+
+// photoAspect checks b against PHOTO_MAX_ASPECT_RATIO and returns the aspect
+// to crop it to in crop mode, or the zero aspect if it needs none. An upload
+// whose header can't be read is left for the pipeline to reject. On failure
+// it has already written the response.
+func (s *server) photoAspect(w http.ResponseWriter, r *http.Request, b []byte, ct string) (aspect, bool) {
+	limit := s.cfg.PhotoMaxAspectRatio
+	if limit == 0 {
+		return aspect{}, true
+	}
+	_, cfg, err := probeImage(b, ct)
+	if err != nil || elongation(cfg) <= limit {
+		return aspect{}, true
+	}
+	ratio := math.Round(elongation(cfg)*100) / 100
+	if s.cfg.PhotoAspectMode == photoAspectReject {
+		rejectJSON(w, r, http.StatusUnprocessableEntity, "extreme_aspect_ratio",
+			fmt.Sprintf("image is %dx%d, more elongated than the %g:1 a photo may be", cfg.Width, cfg.Height, limit),
+			map[string]any{"width": cfg.Width, "height": cfg.Height, "aspect_ratio": ratio, "max_aspect_ratio": limit})
+		return aspect{}, false
+	}
+	// In hundredths, so a fractional limit like 2.5 keeps its precision.
+	trim := aspect{int(math.Round(limit * 100)), 100}
+	if cfg.Height > cfg.Width {
+		trim.w, trim.h = trim.h, trim.w
+	}
+	logAttrs(r.Context(), "aspect_ratio", ratio, "aspect_crop", trim.String())
+	return trim, true
+}
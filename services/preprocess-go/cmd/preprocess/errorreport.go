@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errorReporter ships panics and 5xx causes to an external tracker. Events
+// carry only sanitized request context (formats, sizes, transform params),
+// never image bytes or credentials.
+type errorReporter interface {
+	report(ev errorEvent)
+}
+
+type errorEvent struct {
+	err       error
+	requestID string
+	stack     string
+	tags      map[string]string
+	extra     map[string]any
+}
+
+// sentryReporter posts events to Sentry's store endpoint. Sends happen on a
+// background goroutine through a small buffer; when Sentry is slow or down,
+// events are dropped rather than backing up request handling.
+type sentryReporter struct {
+	project     atomic.Pointer[sentryProject]
+	environment string
+	client      *http.Client
+	queue       chan errorEvent
+}
+
+// sentryProject is where a DSN says to send events.
+type sentryProject struct {
+	endpoint string
+	auth     string
+}
+
+const sentryQueueSize = 64
+
+func newSentryReporter(dsn, environment string) (*sentryReporter, error) {
+	r := &sentryReporter{
+		environment: environment,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		queue:       make(chan errorEvent, sentryQueueSize),
+	}
+	if err := r.rotate(dsn); err != nil {
+		return nil, err
+	}
+	go r.loop()
+	return r, nil
+}
+
+// rotate parses a DSN of the form
+// https://<public_key>@<host>[/<path>]/<project_id> and sends further events
+// there.
+func (r *sentryReporter) rotate(dsn string) error {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return fmt.Errorf("sentry: DSN has no public key")
+	}
+	path := strings.Trim(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	prefix, project := "", path
+	if i >= 0 {
+		prefix, project = path[:i+1], path[i+1:]
+	}
+	if project == "" {
+		return fmt.Errorf("sentry: DSN has no project id")
+	}
+	r.project.Store(&sentryProject{
+		endpoint: fmt.Sprintf("%s://%s/%sapi/%s/store/", u.Scheme, u.Host, prefix, project),
+		auth:     "Sentry sentry_version=7, sentry_client=preprocess-go/1.0, sentry_key=" + u.User.Username(),
+	})
+	return nil
+}
+
+func (r *sentryReporter) report(ev errorEvent) {
+	select {
+	case r.queue <- ev:
+	default:
+		slog.Warn("error reporter queue full, dropping event", "err", ev.err)
+	}
+}
+
+func (r *sentryReporter) loop() {
+	host, _ := os.Hostname()
+	for ev := range r.queue {
+		var id [16]byte
+		_, _ = rand.Read(id[:])
+		tags := map[string]string{"request_id": ev.requestID}
+		for k, v := range ev.tags {
+			tags[k] = v
+		}
+		exc := map[string]any{"type": fmt.Sprintf("%T", ev.err), "value": ev.err.Error()}
+		extra := ev.extra
+		if ev.stack != "" {
+			exc["type"] = "panic"
+			if extra == nil {
+				extra = map[string]any{}
+			}
+			extra["stack"] = ev.stack
+		}
+		body, err := json.Marshal(map[string]any{
+			"event_id":    hex.EncodeToString(id[:]),
+			"timestamp":   time.Now().UTC().Format(time.RFC3339),
+			"platform":    "go",
+			"level":       "error",
+			"logger":      "preprocess-go",
+			"server_name": host,
+			"environment": r.environment,
+			"message":     ev.err.Error(),
+			"exception":   map[string]any{"values": []any{exc}},
+			"tags":        tags,
+			"extra":       extra,
+		})
+		if err != nil {
+			continue
+		}
+		project := r.project.Load()
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, project.endpoint, bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sentry-Auth", project.auth)
+		resp, err := r.client.Do(req)
+		if err != nil {
+			slog.Warn("error report failed", "err", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Warn("error report rejected", "status", resp.StatusCode)
+		}
+	}
+}
+
+// reportError sends err with the request's sanitized context, if a reporter
+// is configured.
+func (s *server) reportError(r *http.Request, err error, stack string) {
+	if s.reporter == nil {
+		return
+	}
+	ev := errorEvent{
+		err:       err,
+		requestID: requestID(r.Context()),
+		stack:     stack,
+		tags:      map[string]string{"path": r.URL.Path},
+		extra:     map[string]any{},
+	}
+	// Only the transform parameters; anything else in the query is caller data.
+	q := r.URL.Query()
+	for _, k := range []string{"max_dim", "quality", "sizes"} {
+		if q.Has(k) {
+			ev.extra[k] = q.Get(k)
+		}
+	}
+	if st := stateFrom(r.Context()); st != nil {
+		st.mu.Lock()
+		for i := 0; i+1 < len(st.attrs); i += 2 {
+			if k, ok := st.attrs[i].(string); ok {
+				ev.extra[k] = st.attrs[i+1]
+			}
+		}
+		st.mu.Unlock()
+		if f, ok := ev.extra["input_format"].(string); ok {
+			ev.tags["input_format"] = f
+		}
+	}
+	s.reporter.report(ev)
+}
+
+// recoverPanics turns a handler panic into a 500 and an error report instead
+// of a dropped connection.
+func (s *server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			perr := newPanicError(v)
+			slog.Error("panic serving request", "request_id", requestID(r.Context()), "err", perr, "stack", perr.stack)
+			s.reportError(r, perr, perr.stack)
+			reject(w, r, http.StatusInternalServerError, "internal_error", "internal error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// panicError carries a recovered panic out of a pipeline goroutine, where
+// the HTTP middleware's recover can't see it.
+type panicError struct {
+	value any
+	stack string
+}
+
+func newPanicError(v any) *panicError {
+	return &panicError{value: v, stack: string(debug.Stack())}
+}
+
+func (e *panicError) Error() string { return fmt.Sprintf("panic: %v", e.value) }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// After each job an "image processed" event goes to EVENTS_REDIS_CHANNEL
+// (PUBLISH, for live subscribers) and/or EVENTS_REDIS_STREAM (XADD, for
+// consumers that must not miss one), so the search indexer and feed service
+// pick up new images without polling:
+//
+//	{"type":"image.processed","id":"<request id>","time":"…","caller":"name:web",
+//	 "source_sha256":"…","source_bytes":2345678,
+//	 "outputs":[{"sha256":"…","content_type":"image/jpeg","width":1600,"height":1200,
+//	             "bytes":345678,"storage_key":"…","storage_url":"…"}]}
+//
+// A likely screenshot adds "screenshot", as in the store= response. Stream
+// entries carry the JSON in an "event" field. Like the audit log, events
+// are sent from a queue in the background, so Redis never holds up a
+// response, and a Redis failure is only logged.
+
+type processedEvent struct {
+	Type         string          `json:"type"`
+	ID           string          `json:"id"`
+	Time         time.Time       `json:"time"`
+	Caller       string          `json:"caller"`
+	Tenant       string          `json:"tenant,omitempty"`
+	SourceSHA256 string          `json:"source_sha256"`
+	SourceBytes  int             `json:"source_bytes"`
+	Outputs      []eventOutput   `json:"outputs"`
+	Truncated    int             `json:"truncated,omitempty"` // outputs left out, for tile pyramids
+	Screenshot   *screenshotInfo `json:"screenshot,omitempty"`
+}
+
+type eventOutput struct {
+	Name        string `json:"name,omitempty"`
+	SHA256      string `json:"sha256"`
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Bytes       int    `json:"bytes"`
+	StorageKey  string `json:"storage_key,omitempty"`
+	StorageURL  string `json:"storage_url,omitempty"`
+}
+
+// eventPublisher sends queued events to the channel and/or stream.
+type eventPublisher struct {
+	redis   *redisClient
+	channel string
+	stream  string
+	maxLen  string // EVENTS_STREAM_MAXLEN
+	queue   chan processedEvent
+}
+
+const eventQueueSize = 1024
+
+func newEventPublisher(redis *redisClient, channel, stream string, maxLen int) *eventPublisher {
+	p := &eventPublisher{
+		redis:   redis,
+		channel: channel,
+		stream:  stream,
+		maxLen:  strconv.Itoa(maxLen),
+		queue:   make(chan processedEvent, eventQueueSize),
+	}
+	go p.loop()
+	return p
+}
+
+func (p *eventPublisher) loop() {
+	for ev := range p.queue {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		if p.channel != "" {
+			if _, err := p.redis.do(ctx, "PUBLISH", p.channel, string(b)); err != nil {
+				slog.Error("events: publish failed", "request_id", ev.ID, "err", err)
+			}
+		}
+		if p.stream != "" {
+			// "~" lets Redis trim lazily, in whole macro nodes, which is far
+			// cheaper than an exact MAXLEN.
+			if _, err := p.redis.do(ctx, "XADD", p.stream, "MAXLEN", "~", p.maxLen, "*", "event", string(b)); err != nil {
+				slog.Error("events: stream append failed", "request_id", ev.ID, "err", err)
+			}
+		}
+		cancel()
+	}
+}
+
+// eventMaxOutputs keeps tile pyramids from producing events hundreds of
+// outputs long; consumers that need every tile read the response.
+const eventMaxOutputs = maxSizes
+
+// publishProcessed queues the event for a completed request.
+func (s *server) publishProcessed(r *http.Request, sourceHash string, sourceBytes int, outputs []*result) {
+	if s.events == nil {
+		return
+	}
+	ev := processedEvent{
+		Type:         "image.processed",
+		ID:           requestID(r.Context()),
+		Time:         time.Now().UTC(),
+		Caller:       callerID(r),
+		Tenant:       tenantName(r.Context()),
+		SourceSHA256: sourceHash,
+		SourceBytes:  sourceBytes,
+		Outputs:      []eventOutput{},
+		Screenshot:   screenshot(r.Context()),
+	}
+	stored := storedImages(r.Context())
+	for i, res := range outputs {
+		if i == eventMaxOutputs {
+			ev.Truncated = len(outputs) - i
+			break
+		}
+		out := eventOutput{
+			Name:        res.name,
+			SHA256:      res.digest(),
+			ContentType: res.ct,
+			Width:       res.width,
+			Height:      res.height,
+			Bytes:       len(res.body),
+		}
+		if i < len(stored) {
+			out.StorageKey, out.StorageURL = stored[i].id, stored[i].url
+		}
+		ev.Outputs = append(ev.Outputs, out)
+	}
+	select {
+	case s.events.queue <- ev:
+	default:
+		slog.Error("events: queue full, dropping event", "request_id", ev.ID)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"math"
+	"time"
+)
+
+// Thumbnailing a 48MP photo spends nearly all its time in the full-size
+// decode, yet most cameras and phones embed a small JPEG preview in the EXIF
+// block. When that preview is at least as large as the output, we decode
+// and scale it instead. (image/jpeg can't decode at reduced DCT scale, so
+// this is the only shortcut available without cgo.)
+
+// exifThumbAspectTolerance rejects previews whose shape differs from the
+// photo's, such as 160×120 previews of 3:2 images padded with black bars.
+const exifThumbAspectTolerance = 0.01
+
+// exifThumbnail returns the decoded EXIF preview of b when it can stand in
+// for the full image at maxDim, or nil.
+func exifThumbnail(ctx context.Context, b []byte, cfg image.Config, maxDim int) image.Image {
+	thumb := exifThumbnailBytes(b)
+	if thumb == nil {
+		return nil
+	}
+	tc, err := jpeg.DecodeConfig(bytes.NewReader(thumb))
+	if err != nil || max(tc.Width, tc.Height) < maxDim || tc.Height == 0 || cfg.Height == 0 {
+		return nil
+	}
+	aspect, want := float64(tc.Width)/float64(tc.Height), float64(cfg.Width)/float64(cfg.Height)
+	if math.Abs(aspect-want)/want > exifThumbAspectTolerance {
+		return nil
+	}
+	start := time.Now()
+	img, err := jpeg.Decode(bytes.NewReader(thumb))
+	observeStage(ctx, start, "decode")
+	if err != nil {
+		return nil
+	}
+	logAttrs(ctx, "exif_thumbnail", true, "thumbnail_width", tc.Width, "thumbnail_height", tc.Height)
+	return img
+}
+
+// exifThumbnailBytes returns the thumbnail IFD1 of b's EXIF block points
+// at, or nil.
+func exifThumbnailBytes(b []byte) []byte {
+	return tiffThumbnail(exifBlock(b))
+}
+
+// exifBlock finds the APP1 Exif segment among the JPEG headers and returns
+// its TIFF-structured payload, or nil.
+func exifBlock(b []byte) []byte {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return nil
+		}
+		switch m := b[i+1]; {
+		case m == 0xFF: // fill byte
+			i++
+			continue
+		case m == 0xDA, m == 0xD9: // headers are over
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return nil
+		}
+		seg := b[i+4 : i+2+n]
+		if b[i+1] == 0xE1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return seg[6:]
+		}
+		i += 2 + n
+	}
+	return nil
+}
+
+func tiffThumbnail(t []byte) []byte {
+	bo, ok := tiffByteOrder(t)
+	if !ok {
+		return nil
+	}
+	// IFD0 describes the main image; the IFD after it, the thumbnail.
+	_, ifd1, ok := readIFD(t, bo, int(bo.Uint32(t[4:])))
+	if !ok || ifd1 == 0 {
+		return nil
+	}
+	entries, _, ok := readIFD(t, bo, ifd1)
+	if !ok {
+		return nil
+	}
+	off, n := int(entries[0x0201]), int(entries[0x0202]) // JPEGInterchangeFormat, ...Length
+	if off <= 0 || n <= 2 || off+n > len(t) || t[off] != 0xFF || t[off+1] != 0xD8 {
+		return nil
+	}
+	return t[off : off+n]
+}
+
+// tiffByteOrder reads the byte order from a TIFF header.
+func tiffByteOrder(t []byte) (binary.ByteOrder, bool) {
+	if len(t) < 8 {
+		return nil, false
+	}
+	switch string(t[:2]) {
+	case "II":
+		return binary.LittleEndian, true
+	case "MM":
+		return binary.BigEndian, true
+	}
+	return nil, false
+}
+
+// readIFD returns an IFD's single-valued SHORT and LONG entries by tag and
+// the offset of the next IFD.
+func readIFD(t []byte, bo binary.ByteOrder, off int) (map[uint16]uint32, int, bool) {
+	if off < 8 || off+2 > len(t) {
+		return nil, 0, false
+	}
+	count := int(bo.Uint16(t[off:]))
+	end := off + 2 + 12*count
+	if end+4 > len(t) {
+		return nil, 0, false
+	}
+	entries := make(map[uint16]uint32, count)
+	for e := off + 2; e < end; e += 12 {
+		tag, typ, n := bo.Uint16(t[e:]), bo.Uint16(t[e+2:]), bo.Uint32(t[e+4:])
+		if n != 1 {
+			continue
+		}
+		switch typ {
+		case 3: // SHORT
+			entries[tag] = uint32(bo.Uint16(t[e+8:]))
+		case 4: // LONG
+			entries[tag] = bo.Uint32(t[e+8:])
+		}
+	}
+	return entries, int(bo.Uint32(t[end:])), true
+}
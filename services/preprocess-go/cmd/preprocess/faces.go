@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// privacy=faces blurs every face FACE_DETECT_URL finds, for user-submitted
+// photos that catch bystanders. The detector gets the upload as-is and
+// answers with boxes in the upload's pixel coordinates:
+//
+//	POST <FACE_DETECT_URL>   Content-Type: image/jpeg   <bytes>
+//	200 {"faces":[{"x":120,"y":40,"w":64,"h":80}]}
+//
+// Blurring fails closed: if the detector can't be reached the request
+// fails rather than return an unblurred image.
+
+// errFaceDetect wraps any failure to get an answer from the detector.
+var errFaceDetect = errors.New("face detection unavailable")
+
+const (
+	// faceMargin grows each box by this fraction per side; detectors box
+	// the face tightly and leave hair and ears recognizable.
+	faceMargin = 0.2
+	// faceBlurFactor is how far a face is shrunk before being scaled back
+	// up, relative to its size, which sets how strong the blur is.
+	faceBlurFactor = 20
+)
+
+type faceBox struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type faceDetector struct {
+	url    string
+	client *downstream
+}
+
+func newFaceDetector(url string, client *downstream) *faceDetector {
+	return &faceDetector{url: url, client: client}
+}
+
+func (d *faceDetector) detect(ctx context.Context, b []byte, ct string) ([]faceBox, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errFaceDetect, err)
+	}
+	req.Header.Set("Content-Type", ct)
+	resp, err := d.client.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errFaceDetect, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: detector returned %s", errFaceDetect, resp.Status)
+	}
+	var out struct {
+		Faces []faceBox `json:"faces"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("%w: %v", errFaceDetect, err)
+	}
+	return out.Faces, nil
+}
+
+// blurFaces returns img with the detected faces blurred. Boxes are in the
+// upload's coordinates (cfg); img may be smaller when it came from the EXIF
+// thumbnail. img itself is left untouched.
+func (s *server) blurFaces(ctx context.Context, img image.Image, b []byte, ct string, cfg image.Config) (image.Image, error) {
+	start := time.Now()
+	faces, err := s.faces.detect(ctx, b, ct)
+	recordStage(ctx, "detect", time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	logAttrs(ctx, "faces", len(faces))
+	if len(faces) == 0 {
+		return img, nil
+	}
+
+	start = time.Now()
+	bounds := img.Bounds()
+	dst := mutableCopy(img)
+	sx := float64(bounds.Dx()) / float64(cfg.Width)
+	sy := float64(bounds.Dy()) / float64(cfg.Height)
+	for _, f := range faces {
+		mx, my := float64(f.W)*faceMargin, float64(f.H)*faceMargin
+		r := image.Rect(
+			int((float64(f.X)-mx)*sx), int((float64(f.Y)-my)*sy),
+			int((float64(f.X+f.W)+mx)*sx), int((float64(f.Y+f.H)+my)*sy),
+		).Add(bounds.Min).Intersect(bounds)
+		if r.Empty() {
+			continue
+		}
+		small := image.NewRGBA(image.Rect(0, 0, max(1, r.Dx()/faceBlurFactor), max(1, r.Dy()/faceBlurFactor)))
+		draw.CatmullRom.Scale(small, small.Bounds(), dst, r, draw.Src, nil)
+		draw.BiLinear.Scale(dst, r, small, small.Bounds(), draw.Src, nil)
+	}
+	observeStage(ctx, start, "blur")
+	return dst, nil
+}
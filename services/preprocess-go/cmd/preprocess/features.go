@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// features are the optional surfaces DISABLE_FEATURES can switch off, so an
+// internet-facing instance serves nothing beyond /preprocess and the probes
+// even when it shares a config file with internal ones.
+var features = []string{"url_fetch", "thumbor", "usage", "sprite", "archive", "compare", "validate", "video", "metrics", "stats", "debug", "admin"}
+
+func parseDisabledFeatures(v string) (map[string]bool, error) {
+	disabled := map[string]bool{}
+	for _, f := range splitList(v) {
+		if !slices.Contains(features, f) {
+			return nil, fmt.Errorf("unknown feature %q (want one of %s)", f, strings.Join(features, ", "))
+		}
+		disabled[f] = true
+	}
+	return disabled, nil
+}
+
+func (s *server) enabled(feature string) bool {
+	return !s.disabled[feature]
+}
+
+// Features can also be switched off and on again at runtime through
+// /admin/features. Those stay mounted and answer 404 FEATURE_DISABLED while
+// off; only DISABLE_FEATURES keeps a surface from being served at all.
+// admin and debug can't be switched, so the API can't lock itself out.
+func (s *server) switchable(feature string) bool {
+	return slices.Contains(features, feature) && feature != "admin" && feature != "debug" && s.enabled(feature)
+}
+
+// serving reports whether feature is enabled and not switched off.
+func (s *server) serving(feature string) bool {
+	_, off := s.switchedOff.Load(feature)
+	return s.enabled(feature) && !off
+}
+
+func (s *server) setServing(feature string, on bool) {
+	if on {
+		s.switchedOff.Delete(feature)
+	} else {
+		s.switchedOff.Store(feature, true)
+	}
+}
+
+// gate answers 404 instead of running h while feature is switched off.
+func (s *server) gate(feature string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.serving(feature) {
+			reject(w, r, http.StatusNotFound, "feature_disabled", feature+" is switched off")
+			return
+		}
+		h(w, r)
+	})
+}
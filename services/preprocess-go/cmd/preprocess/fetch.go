@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	errFetchBlocked  = errors.New("fetch target not allowed")
+	errFetchTooLarge = errors.New("remote image too large")
+)
+
+// blockedPrefixes are ranges a fetch may never connect to: loopback,
+// RFC 1918/4193 private space, link-local (which includes the cloud metadata
+// endpoint 169.254.169.254), CGNAT, and reserved/special-use blocks. Teredo
+// and IPv4-compatible addresses are blocked outright, as is local-use NAT64,
+// whose mapping is up to the site.
+var blockedPrefixes = func() []netip.Prefix {
+	var ps []netip.Prefix
+	for _, s := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15",
+		"198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+		"::/96", "64:ff9b:1::/48", "100::/64", "2001::/32", "2001:db8::/32", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		ps = append(ps, netip.MustParsePrefix(s))
+	}
+	return ps
+}()
+
+var (
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour   = netip.MustParsePrefix("2002::/16")
+)
+
+// embeddedIPv4 returns the IPv4 address a NAT64 (64:ff9b::a.b.c.d) or 6to4
+// (2002:aabb:ccdd::) address routes to.
+func embeddedIPv4(ip netip.Addr) (netip.Addr, bool) {
+	b := ip.As16()
+	switch {
+	case nat64Prefix.Contains(ip):
+		return netip.AddrFrom4([4]byte(b[12:16])), true
+	case sixToFour.Contains(ip):
+		return netip.AddrFrom4([4]byte(b[2:6])), true
+	}
+	return netip.Addr{}, false
+}
+
+func blockedAddr(ip netip.Addr) bool {
+	ip = ip.Unmap() // ::ffff:127.0.0.1 is still loopback
+	if v4, ok := embeddedIPv4(ip); ok {
+		ip = v4 // and so are 64:ff9b::7f00:1 and 2002:7f00:1::
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetcher downloads remote images for ?url= requests without letting callers
+// reach internal services. Addresses are checked at connect time, after DNS
+// resolution, so rebinding a hostname to a private IP doesn't get through.
+type fetcher struct {
+	client   *http.Client
+	schemes  []string
+	maxBytes int64
+}
+
+func newFetcher(cfg config) *fetcher {
+	f := &fetcher{
+		schemes:  splitList(strings.ToLower(cfg.URLFetchSchemes)),
+		maxBytes: cfg.URLFetchMaxBytes,
+	}
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil || blockedAddr(ap.Addr()) {
+				return fmt.Errorf("%w: %s", errFetchBlocked, address)
+			}
+			return nil
+		},
+	}
+	f.client = &http.Client{
+		Timeout: cfg.URLFetchTimeout,
+		Transport: &http.Transport{
+			Proxy:                 nil, // an env proxy would bypass the address check
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ResponseHeaderTimeout: cfg.URLFetchTimeout,
+			MaxIdleConnsPerHost:   2,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.URLFetchMaxRedirects {
+				return fmt.Errorf("%w: too many redirects", errFetchBlocked)
+			}
+			return f.checkURL(req.URL)
+		},
+	}
+	return f
+}
+
+func (f *fetcher) checkURL(u *url.URL) error {
+	if !slices.Contains(f.schemes, u.Scheme) {
+		return fmt.Errorf("%w: scheme %q", errFetchBlocked, u.Scheme)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: credentials in URL", errFetchBlocked)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%w: no host", errFetchBlocked)
+	}
+	return nil
+}
+
+func (f *fetcher) fetch(ctx context.Context, raw string) ([]byte, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed URL", errFetchBlocked)
+	}
+	if err := f.checkURL(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "image/*")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote returned %d", resp.StatusCode)
+	}
+	if resp.ContentLength > f.maxBytes {
+		return nil, errFetchTooLarge
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > f.maxBytes {
+		return nil, errFetchTooLarge
+	}
+	return b, nil
+}
+
+func (s *server) writeFetchError(w http.ResponseWriter, r *http.Request, err error) {
+	logAttrs(r.Context(), "fetch_error", err.Error())
+	switch {
+	case errors.Is(err, errFetchBlocked):
+		reject(w, r, http.StatusBadRequest, "fetch_blocked", "URL not allowed")
+	case errors.Is(err, errFetchTooLarge):
+		rejectJSON(w, r, http.StatusRequestEntityTooLarge, "fetch_too_large",
+			fmt.Sprintf("remote image exceeds the %s limit", humanBytes(s.fetcher.maxBytes)),
+			map[string]any{"limit_bytes": s.fetcher.maxBytes})
+	case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+		setOutcome(r.Context(), "client_gone")
+	default:
+		reject(w, r, http.StatusBadGateway, "fetch_failed", "failed to fetch URL")
+	}
+}
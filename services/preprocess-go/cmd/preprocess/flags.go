@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// settingKeys lists every setting that can be given as a flag. Each one is
+// exposed as its env name in lower kebab case (MAX_PIXELS → -max-pixels),
+// taking the same value format. Secrets that would show up in ps output
+// (VAULT_TOKEN, AWS credentials) are deliberately missing.
+var settingKeys = []string{
+	"ADDR", "PORT", "UNIX_SOCKET_MODE", "SIDECAR_DIR", "LOG_LEVEL",
+	"DEFAULT_MAX_DIM", "DEFAULT_QUALITY", "MIN_DIM", "MAX_DIM", "MIN_QUALITY", "MAX_QUALITY",
+	"MAX_UPLOAD_BYTES", "UPLOAD_LIMITS", "ARCHIVE_MAX_BYTES", "ARCHIVE_MAX_ENTRIES", "MAX_PIXELS", "MAX_ASPECT_RATIO",
+	"PHOTO_MAX_ASPECT_RATIO", "PHOTO_ASPECT_MODE", "REJECT_BLANK_IMAGES",
+	"PROCESS_TIMEOUT", "SHUTDOWN_TIMEOUT",
+	"STRICT_CONTENT_TYPE", "SANITIZE", "EXIF_THUMBNAIL",
+	"URL_FETCH", "URL_FETCH_SCHEMES", "URL_FETCH_MAX_REDIRECTS", "URL_FETCH_MAX_BYTES", "URL_FETCH_TIMEOUT",
+	"MALWARE_SCAN_URL", "MALWARE_SCAN_TIMEOUT", "MALWARE_SCAN_FAIL_OPEN",
+	"MODERATION_WEBHOOK_URL",
+	"FACE_DETECT_URL", "FACE_DETECT_TIMEOUT", "FFMPEG_PATH", "VIDEO_MAX_DURATION", "VIDEO_FRAME_SAMPLES", "PDFTOPPM_PATH",
+	"VALIDATE_MIN_SIDE", "VALIDATE_MIN_SHARPNESS",
+	"THUMBOR_SECURITY_KEY", "THUMBOR_ALLOW_UNSAFE", "THUMBOR_PATH_PREFIX", "THUMBOR_SOURCE_BASE",
+	"CLOUDFLARE_ACCOUNT_ID", "CLOUDFLARE_API_TOKEN", "CLOUDINARY_URL", "STORE_TIMEOUT",
+	"POSTGRES_URL", "POSTGRES_TABLE",
+	"BACKEND_URL", "BACKEND_DISH_PATH", "BACKEND_TOKEN", "BACKEND_TIMEOUT",
+	"DOWNSTREAM_RETRIES", "DOWNSTREAM_BACKOFF", "BREAKER_THRESHOLD", "BREAKER_COOLDOWN",
+	"CACHE_MAX_BYTES", "REDIS_URL", "CACHE_REDIS", "CACHE_TTL", "CACHE_DIR", "CACHE_DIR_MAX_BYTES",
+	"API_KEYS", "API_KEYS_FILE", "SECRETS_REFRESH",
+	"HMAC_KEYS", "HMAC_KEYS_FILE", "HMAC_MAX_SKEW",
+	"JWKS_URL", "JWT_ISSUER", "JWT_AUDIENCE", "JWKS_REFRESH",
+	"TRUSTED_PROXIES", "IP_ALLOWLIST", "IP_DENYLIST",
+	"CORS_ALLOWED_ORIGINS", "CORS_ALLOWED_METHODS", "CORS_ALLOWED_HEADERS", "CORS_MAX_AGE",
+	"QUOTAS", "TENANTS", "TENANT_KEYS", "RATE_LIMIT_RPS", "RATE_LIMIT_BURST",
+	"WORKERS", "MAX_QUEUE", "PRIORITY_CLASSES", "RESIZE_PARALLELISM",
+	"H2C", "READ_TIMEOUT", "READ_HEADER_TIMEOUT", "WRITE_TIMEOUT", "IDLE_TIMEOUT",
+	"TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_CLIENT_CA_FILE", "TLS_CLIENT_AUTH", "TLS_CLIENT_ALLOWED_NAMES",
+	"ACME_DOMAINS", "ACME_CACHE_DIR", "ACME_EMAIL", "ACME_HTTP_ADDR",
+	"ADMIN_ADDR", "ADMIN_TOKEN", "DEBUG_ADDR", "DISABLE_FEATURES", "DEBUG_CALLERS", "DEBUG_NETWORKS", "ACCESS_LOG", "SLOW_REQUEST_THRESHOLD",
+	"SENTRY_DSN", "SENTRY_ENVIRONMENT",
+	"AUDIT_LOG", "AUDIT_REDIS_KEY",
+	"EVENTS_REDIS_CHANNEL", "EVENTS_REDIS_STREAM", "EVENTS_STREAM_MAXLEN",
+	"VAULT_ADDR", "VAULT_TOKEN_FILE", "VAULT_NAMESPACE",
+	"AWS_REGION", "AWS_ENDPOINT_URL_SECRETS_MANAGER",
+}
+
+// flagSettings holds values given on the command line; they beat both env
+// vars and the config file. Only written before flag.Parse returns.
+var flagSettings = map[string]string{}
+
+func flagName(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+}
+
+func registerSettingFlags(fs *flag.FlagSet) {
+	for _, key := range settingKeys {
+		fs.Func(flagName(key), "sets "+key, func(v string) error {
+			flagSettings[key] = v
+			return nil
+		})
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !purego
+
+package main
+
+// halveRowSSE2 is halveRowGeneric for n blocks of 4 output pixels. SSE2 is
+// part of the amd64 baseline, so there's no CPU feature check.
+//
+//go:noescape
+func halveRowSSE2(dst, r0, r1 *uint8, n int)
+
+func halveRow(dst, r0, r1 []uint8) {
+	if len(dst) == 0 {
+		return
+	}
+	r0, r1 = r0[:2*len(dst)], r1[:2*len(dst)]
+	n := len(dst) / 16
+	if n > 0 {
+		halveRowSSE2(&dst[0], &r0[0], &r1[0], n)
+	}
+	halveRowGeneric(dst[16*n:], r0[32*n:], r1[32*n:])
+}
@@ -0,0 +1,71 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// func halveRowSSE2(dst, r0, r1 *uint8, n int)
+//
+// Each iteration reads 8 pixels from both rows and writes 4. The rows are
+// widened to 16-bit lanes and added, the two pixels of each pair are
+// lined up with PUNPCKL/HQDQ and added, then (sum+2)>>2 is packed back.
+TEXT ·halveRowSSE2(SB), NOSPLIT, $0-32
+	MOVQ dst+0(FP), DI
+	MOVQ r0+8(FP), SI
+	MOVQ r1+16(FP), DX
+	MOVQ n+24(FP), CX
+	TESTQ CX, CX
+	JZ   done
+
+	PXOR X7, X7
+	MOVQ $0x0002000200020002, AX
+	MOVQ AX, X6
+	PUNPCKLQDQ X6, X6
+
+loop:
+	MOVOU (SI), X0
+	MOVOU 16(SI), X1
+	MOVOU (DX), X2
+	MOVOU 16(DX), X3
+
+	// Pixels 0-3: column sums, then pairs.
+	MOVO      X0, X4
+	PUNPCKLBW X7, X0
+	PUNPCKHBW X7, X4
+	MOVO      X2, X5
+	PUNPCKLBW X7, X2
+	PUNPCKHBW X7, X5
+	PADDW     X2, X0
+	PADDW     X5, X4
+	MOVO       X0, X2
+	PUNPCKLQDQ X4, X0
+	PUNPCKHQDQ X4, X2
+	PADDW      X2, X0
+	PADDW      X6, X0
+	PSRLW      $2, X0
+
+	// Pixels 4-7.
+	MOVO      X1, X4
+	PUNPCKLBW X7, X1
+	PUNPCKHBW X7, X4
+	MOVO      X3, X5
+	PUNPCKLBW X7, X3
+	PUNPCKHBW X7, X5
+	PADDW     X3, X1
+	PADDW     X5, X4
+	MOVO       X1, X3
+	PUNPCKLQDQ X4, X1
+	PUNPCKHQDQ X4, X3
+	PADDW      X3, X1
+	PADDW      X6, X1
+	PSRLW      $2, X1
+
+	PACKUSWB X1, X0
+	MOVOU    X0, (DI)
+
+	ADDQ $32, SI
+	ADDQ $32, DX
+	ADDQ $16, DI
+	DECQ CX
+	JNZ  loop
+
+done:
+	RET
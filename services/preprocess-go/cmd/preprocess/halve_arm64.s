@@ -0,0 +1,52 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// func halveRowNEON(dst, r0, r1 *uint8, n int)
+//
+// Each iteration reads 8 pixels from both rows and writes 4. VLD2 on
+// 32-bit lanes splits even and odd pixels into separate registers, so a
+// pair's pixels sit in the same lane; they are widened to 16 bits, summed
+// with the other row's, and (sum+2)>>2 is narrowed back with VUZP1.
+TEXT ·halveRowNEON(SB), NOSPLIT, $0-32
+	MOVD dst+0(FP), R0
+	MOVD r0+8(FP), R1
+	MOVD r1+16(FP), R2
+	MOVD n+24(FP), R3
+	CBZ  R3, done
+
+	MOVD $2, R4
+	VDUP R4, V31.H8
+
+loop:
+	VLD2.P 32(R1), [V0.S4, V1.S4]
+	VLD2.P 32(R2), [V2.S4, V3.S4]
+
+	// Pixels 0-1 of the output in V4, 2-3 in V5.
+	VUXTL  V0.B8, V4.H8
+	VUXTL2 V0.B16, V5.H8
+	VUXTL  V1.B8, V6.H8
+	VUXTL2 V1.B16, V7.H8
+	VADD   V6.H8, V4.H8, V4.H8
+	VADD   V7.H8, V5.H8, V5.H8
+	VUXTL  V2.B8, V6.H8
+	VUXTL2 V2.B16, V7.H8
+	VADD   V6.H8, V4.H8, V4.H8
+	VADD   V7.H8, V5.H8, V5.H8
+	VUXTL  V3.B8, V6.H8
+	VUXTL2 V3.B16, V7.H8
+	VADD   V6.H8, V4.H8, V4.H8
+	VADD   V7.H8, V5.H8, V5.H8
+
+	VADD  V31.H8, V4.H8, V4.H8
+	VADD  V31.H8, V5.H8, V5.H8
+	VUSHR $2, V4.H8, V4.H8
+	VUSHR $2, V5.H8, V5.H8
+	VUZP1 V5.B16, V4.B16, V4.B16
+
+	VST1.P [V4.B16], 16(R0)
+	SUBS   $1, R3, R3
+	BNE    loop
+
+done:
+	RET
@@ -0,0 +1,7 @@
+//go:build (!amd64 && !arm64) || purego
+
+package main
+
+func halveRow(dst, r0, r1 []uint8) {
+	halveRowGeneric(dst, r0, r1)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+func randomRGBA(w, h int, seed int64) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	rand.New(rand.NewSource(seed)).Read(img.Pix)
+	return img
+}
+
+func TestHalveRowMatchesGeneric(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// Past a few SIMD blocks, with every tail length.
+	for px := 0; px <= 70; px++ {
+		r0, r1 := make([]uint8, 8*px), make([]uint8, 8*px)
+		rng.Read(r0)
+		rng.Read(r1)
+		got, want := make([]uint8, 4*px), make([]uint8, 4*px)
+		halveRow(got, r0, r1)
+		halveRowGeneric(want, r0, r1)
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("%d pixels: byte %d = %d, want %d", px, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestHalveRowGenericRounding(t *testing.T) {
+	tests := []struct {
+		a, b, c, d uint8
+		want       uint8
+	}{
+		{0, 0, 0, 0, 0},
+		{255, 255, 255, 255, 255},
+		{0, 0, 0, 1, 0},
+		{0, 0, 1, 1, 1}, // 0.5 rounds up
+		{0, 1, 1, 1, 1},
+		{10, 20, 30, 40, 25},
+		{255, 255, 255, 254, 255},
+	}
+	for _, tt := range tests {
+		r0 := []uint8{tt.a, tt.a, tt.a, tt.a, tt.b, tt.b, tt.b, tt.b}
+		r1 := []uint8{tt.c, tt.c, tt.c, tt.c, tt.d, tt.d, tt.d, tt.d}
+		for name, fn := range map[string]func(dst, r0, r1 []uint8){"generic": halveRowGeneric, "halveRow": halveRow} {
+			dst := make([]uint8, 4)
+			fn(dst, r0, r1)
+			for c, v := range dst {
+				if v != tt.want {
+					t.Errorf("%s(%d %d %d %d) channel %d = %d, want %d", name, tt.a, tt.b, tt.c, tt.d, c, v, tt.want)
+				}
+			}
+		}
+	}
+}
+
+func TestHalveConvertsOtherSources(t *testing.T) {
+	// Odd sizes drop the last row and column; a non-RGBA source must give
+	// the same result as halving its RGBA conversion.
+	src := image.NewYCbCr(image.Rect(3, 5, 3+41, 5+27), image.YCbCrSubsampleRatio420)
+	rng := rand.New(rand.NewSource(2))
+	rng.Read(src.Y)
+	rng.Read(src.Cb)
+	rng.Read(src.Cr)
+	rgba := image.NewRGBA(image.Rect(0, 0, 41, 27))
+	draw.Draw(rgba, rgba.Rect, src, src.Rect.Min, draw.Src)
+
+	got, want := halve(src), halve(rgba)
+	if got.Rect != image.Rect(0, 0, 20, 13) {
+		t.Fatalf("bounds = %v, want 20x13", got.Rect)
+	}
+	for i := range want.Pix {
+		if got.Pix[i] != want.Pix[i] {
+			t.Fatalf("byte %d = %d, want %d", i, got.Pix[i], want.Pix[i])
+		}
+	}
+}
+
+func TestPrehalve(t *testing.T) {
+	tests := []struct {
+		w, h, nw, nh int
+		want         image.Rectangle
+	}{
+		{4000, 3000, 1024, 768, image.Rect(0, 0, 2000, 1500)},
+		{4000, 3000, 1000, 750, image.Rect(0, 0, 1000, 750)},
+		{4000, 3000, 999, 749, image.Rect(0, 0, 1000, 750)},
+		{4000, 3000, 2001, 1500, image.Rect(0, 0, 4000, 3000)}, // already under 2x
+		{4000, 100, 1024, 26, image.Rect(0, 0, 2000, 50)},      // stops at the short side
+	}
+	for _, tt := range tests {
+		img := image.NewRGBA(image.Rect(0, 0, tt.w, tt.h))
+		draw.Draw(img, img.Rect, image.NewUniform(color.RGBA{1, 2, 3, 255}), image.Point{}, draw.Src)
+		out, release := prehalve(img, tt.nw, tt.nh)
+		if out.Bounds() != tt.want {
+			t.Errorf("prehalve(%dx%d, %dx%d) = %v, want %v", tt.w, tt.h, tt.nw, tt.nh, out.Bounds(), tt.want)
+		}
+		if tt.want.Dx() == tt.w && out != image.Image(img) {
+			t.Errorf("prehalve(%dx%d, %dx%d) copied a source it didn't need to halve", tt.w, tt.h, tt.nw, tt.nh)
+		}
+		if c := out.At(0, 0); c != (color.RGBA{1, 2, 3, 255}) {
+			t.Errorf("prehalve(%dx%d) pixel = %v", tt.w, tt.h, c)
+		}
+		release()
+	}
+}
+
+// BenchmarkDownscale compares resizing a 12MP photo to the default
+// 1280px output on its own against the halving path downscale takes.
+func BenchmarkDownscale(b *testing.B) {
+	for _, tc := range []struct {
+		name string
+		src  image.Image
+	}{
+		{"rgba", randomRGBA(4000, 3000, 3)},
+		{"ycbcr", func() image.Image {
+			m := image.NewYCbCr(image.Rect(0, 0, 4000, 3000), image.YCbCrSubsampleRatio420)
+			rand.New(rand.NewSource(4)).Read(m.Y)
+			return m
+		}()},
+	} {
+		nw, nh, _ := scaledSize(tc.src.Bounds(), defaultMaxDim)
+		b.Run(tc.name+"/catmullrom", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dst := newRGBA(image.Rect(0, 0, nw, nh))
+				draw.CatmullRom.Scale(dst, dst.Bounds(), tc.src, tc.src.Bounds(), draw.Src, nil)
+				putRGBA(dst)
+			}
+		})
+		b.Run(tc.name+"/downscale", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				putRGBA(downscale(tc.src, defaultMaxDim).(*image.RGBA))
+			}
+		})
+	}
+}
+
+func BenchmarkHalveRow(b *testing.B) {
+	src := randomRGBA(4000, 2, 5)
+	dst := make([]uint8, 4*2000)
+	r0, r1 := src.Pix[:src.Stride], src.Pix[src.Stride:]
+	for name, fn := range map[string]func(dst, r0, r1 []uint8){"generic": halveRowGeneric, "simd": halveRow} {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(r0) + len(r1)))
+			for i := 0; i < b.N; i++ {
+				fn(dst, r0, r1)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const readinessTimeout = time.Second
+
+// healthHandler is kept for existing docker/compose health checks; it is
+// liveness plus worker-queue depth so autoscaling can key off it.
+func (s *server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		OK bool `json:"ok"`
+		poolStats
+	}{true, s.pool.stats()})
+}
+
+// livezHandler only says the process is up and serving HTTP. It deliberately
+// checks nothing else: a restart can't fix a saturated queue or a down Redis.
+func (s *server) livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true})
+}
+
+// dependency is a downstream service probed by /readyz. Only critical ones
+// take the instance out of rotation; the rest are reported as degraded.
+type dependency struct {
+	name     string
+	critical bool
+	check    func(context.Context) error
+}
+
+// dependencies lists what is configured. The HTTP services are judged by
+// their circuit breakers rather than probed, since their APIs have nothing
+// cheap to call; image hosts and the face detector are critical because
+// uploads asking for them fail without them. The rest only lose work done
+// in the background.
+func (s *server) dependencies() []dependency {
+	var deps []dependency
+	if s.redis != nil {
+		// The Redis cache fails open, so an outage costs latency, not
+		// correctness. Pulling every replica out of rotation would be worse.
+		deps = append(deps, dependency{name: "redis", check: func(ctx context.Context) error {
+			_, err := s.redis.do(ctx, "PING")
+			return err
+		}})
+	}
+	for name, st := range s.stores {
+		if h, ok := st.(interface{ service() *downstream }); ok {
+			deps = append(deps, dependency{name: name, critical: true, check: h.service().check})
+		}
+	}
+	if s.faces != nil {
+		deps = append(deps, dependency{name: "face_detect", critical: true, check: s.faces.client.check})
+	}
+	if s.dishes != nil {
+		deps = append(deps, dependency{name: "backend", check: s.dishes.client.check})
+	}
+	if s.alerter != nil {
+		deps = append(deps, dependency{name: "moderation_webhook", check: s.alerter.client.check})
+	}
+	if s.catalog != nil {
+		deps = append(deps, dependency{name: "postgres", check: s.catalog.ping})
+	}
+	return deps
+}
+
+// readyzHandler reports whether this instance should receive traffic: not
+// draining for shutdown, worker queue not full, and dependencies reachable.
+func (s *server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]string{}
+	ready := true
+	fail := func(name, reason string) {
+		checks[name] = reason
+		ready = false
+	}
+
+	if s.draining.Load() {
+		fail("shutdown", "draining")
+	}
+	stats := s.pool.stats()
+	// With MAX_QUEUE=0 nothing ever waits, so there is no queue to fill.
+	if stats.QueueCapacity > 0 && stats.Queued >= stats.QueueCapacity {
+		fail("queue", "saturated")
+	} else {
+		checks["queue"] = "ok"
+	}
+	for _, dep := range s.dependencies() {
+		switch err := dep.check(ctx); {
+		case err == nil:
+			checks[dep.name] = "ok"
+		case dep.critical:
+			fail(dep.name, err.Error())
+		default:
+			checks[dep.name] = "degraded: " + err.Error()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(struct {
+		Ready  bool              `json:"ready"`
+		Checks map[string]string `json:"checks"`
+		poolStats
+	}{ready, checks, stats})
+}
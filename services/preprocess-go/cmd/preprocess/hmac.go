@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errInvalidSignature = errors.New("invalid signature")
+	errBodyTooLarge     = errors.New("request body too large")
+)
+
+// hmacVerifier authenticates server-to-server callers that sign each request
+// with a shared secret:
+//
+//	X-Signature-Key:       key id
+//	X-Signature-Timestamp: unix seconds
+//	X-Signature:           hex HMAC-SHA256 of
+//	                       "<timestamp>\n<METHOD>\n<request URI>\n<hex sha256(body)>"
+//
+// A signature is accepted once: timestamps outside maxSkew are refused and
+// signatures seen within it are remembered (in Redis when configured, so the
+// whole fleet shares the replay window).
+type hmacVerifier struct {
+	secrets  atomic.Pointer[map[string][][]byte] // several per id while rotating
+	maxSkew  time.Duration
+	redis    *redisClient
+	maxBytes int64 // body buffered for hashing; the largest upload limit
+
+	mu        sync.Mutex
+	seen      map[string]time.Time // signature -> forget after
+	lastSweep time.Time
+}
+
+func newHMACVerifier(entries []namedSecret, maxSkew time.Duration, redis *redisClient, maxBytes int64) *hmacVerifier {
+	v := &hmacVerifier{
+		maxSkew:  maxSkew,
+		redis:    redis,
+		maxBytes: maxBytes,
+		seen:     map[string]time.Time{},
+	}
+	v.setSecrets(entries)
+	return v
+}
+
+func (v *hmacVerifier) setSecrets(entries []namedSecret) {
+	secrets := map[string][][]byte{}
+	for _, e := range entries {
+		secrets[e.name] = append(secrets[e.name], []byte(e.secret))
+	}
+	v.secrets.Store(&secrets)
+}
+
+// verify checks r's signature and returns the key id. It buffers the body
+// to hash it and leaves r.Body readable for the handler.
+func (v *hmacVerifier) verify(r *http.Request) (string, error) {
+	id := r.Header.Get("X-Signature-Key")
+	secrets, ok := (*v.secrets.Load())[id]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown key id", errInvalidSignature)
+	}
+	tsHeader := r.Header.Get("X-Signature-Timestamp")
+	ts, err := strconv.ParseInt(tsHeader, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w: bad timestamp", errInvalidSignature)
+	}
+	signedAt := time.Unix(ts, 0)
+	if d := time.Since(signedAt); d > v.maxSkew || d < -v.maxSkew {
+		return "", fmt.Errorf("%w: timestamp outside allowed skew", errInvalidSignature)
+	}
+	got, err := hex.DecodeString(r.Header.Get("X-Signature"))
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed", errInvalidSignature)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, v.maxBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(body)) > v.maxBytes {
+		return "", errBodyTooLarge
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	bodySum := sha256.Sum256(body)
+	msg := tsHeader + "\n" + r.Method + "\n" + r.URL.RequestURI() + "\n" + hex.EncodeToString(bodySum[:])
+	valid := false
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(msg))
+		if hmac.Equal(mac.Sum(nil), got) {
+			valid = true
+		}
+	}
+	if !valid {
+		return "", fmt.Errorf("%w: mismatch", errInvalidSignature)
+	}
+	if !v.firstUse(r.Context(), hex.EncodeToString(got), signedAt.Add(v.maxSkew)) {
+		return "", fmt.Errorf("%w: replayed", errInvalidSignature)
+	}
+	return id, nil
+}
+
+// firstUse records sig until expires and reports whether it was new. Redis
+// errors fall back to the local set rather than locking callers out.
+func (v *hmacVerifier) firstUse(ctx context.Context, sig string, expires time.Time) bool {
+	if v.redis != nil {
+		ttl := time.Until(expires).Milliseconds()
+		_, err := v.redis.do(ctx, "SET", "pp:hmac:"+sig, "1", "NX", "PX", strconv.Itoa(max(int(ttl), 1)))
+		if err == nil {
+			return true
+		}
+		if errors.Is(err, errRedisNil) {
+			return false
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	if now.Sub(v.lastSweep) > v.maxSkew {
+		for k, exp := range v.seen {
+			if now.After(exp) {
+				delete(v.seen, k)
+			}
+		}
+		v.lastSweep = now
+	}
+	if exp, ok := v.seen[sig]; ok && now.Before(exp) {
+		return false
+	}
+	v.seen[sig] = expires
+	return true
+}
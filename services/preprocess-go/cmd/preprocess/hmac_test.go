@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedRequest signs a request the way hmacVerifier's callers do.
+func signedRequest(method, target, body, id, secret string, at time.Time) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	ts := strconv.FormatInt(at.Unix(), 10)
+	sum := sha256.Sum256([]byte(body))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "\n" + method + "\n" + r.URL.RequestURI() + "\n" + hex.EncodeToString(sum[:])))
+	r.Header.Set("X-Signature-Key", id)
+	r.Header.Set("X-Signature-Timestamp", ts)
+	r.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestHMACVerify(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		req     func() *http.Request
+		wantErr error
+	}{
+		{"valid", func() *http.Request {
+			return signedRequest("POST", "/preprocess?max_dim=512", "img", "web", "s1", now)
+		}, nil},
+		{"second secret while rotating", func() *http.Request {
+			return signedRequest("POST", "/preprocess", "img", "web", "s2", now)
+		}, nil},
+		{"unknown key id", func() *http.Request {
+			return signedRequest("POST", "/preprocess", "img", "ios", "s1", now)
+		}, errInvalidSignature},
+		{"wrong secret", func() *http.Request {
+			return signedRequest("POST", "/preprocess", "img", "web", "nope", now)
+		}, errInvalidSignature},
+		{"too old", func() *http.Request {
+			return signedRequest("POST", "/preprocess", "img", "web", "s1", now.Add(-10*time.Minute))
+		}, errInvalidSignature},
+		{"from the future", func() *http.Request {
+			return signedRequest("POST", "/preprocess", "img", "web", "s1", now.Add(10*time.Minute))
+		}, errInvalidSignature},
+		{"bad timestamp", func() *http.Request {
+			r := signedRequest("POST", "/preprocess", "img", "web", "s1", now)
+			r.Header.Set("X-Signature-Timestamp", "yesterday")
+			return r
+		}, errInvalidSignature},
+		{"malformed signature", func() *http.Request {
+			r := signedRequest("POST", "/preprocess", "img", "web", "s1", now)
+			r.Header.Set("X-Signature", "zz")
+			return r
+		}, errInvalidSignature},
+		{"body swapped", func() *http.Request {
+			r := signedRequest("POST", "/preprocess", "img", "web", "s1", now)
+			r.Body = io.NopCloser(strings.NewReader("other"))
+			return r
+		}, errInvalidSignature},
+		{"query changed", func() *http.Request {
+			r := signedRequest("POST", "/preprocess?max_dim=512", "img", "web", "s1", now)
+			r.URL.RawQuery = "max_dim=4096"
+			return r
+		}, errInvalidSignature},
+		{"method changed", func() *http.Request {
+			r := signedRequest("POST", "/preprocess", "img", "web", "s1", now)
+			r.Method = "PUT"
+			return r
+		}, errInvalidSignature},
+		{"body over the limit", func() *http.Request {
+			return signedRequest("POST", "/preprocess", strings.Repeat("x", 65), "web", "s1", now)
+		}, errBodyTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newHMACVerifier([]namedSecret{{"web", "s1"}, {"web", "s2"}}, 5*time.Minute, nil, 64)
+			r := tt.req()
+			id, err := v.verify(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("verify = %q, %v; want %v", id, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if id != "web" {
+				t.Errorf("key id = %q, want web", id)
+			}
+			if b, _ := io.ReadAll(r.Body); string(b) != "img" {
+				t.Errorf("body left for the handler = %q, want img", b)
+			}
+		})
+	}
+}
+
+func TestHMACReplay(t *testing.T) {
+	v := newHMACVerifier([]namedSecret{{"web", "s1"}}, 5*time.Minute, nil, 64)
+	now := time.Now()
+	if _, err := v.verify(signedRequest("POST", "/preprocess", "img", "web", "s1", now)); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	_, err := v.verify(signedRequest("POST", "/preprocess", "img", "web", "s1", now))
+	if !errors.Is(err, errInvalidSignature) || !strings.Contains(err.Error(), "replayed") {
+		t.Fatalf("replay = %v, want a replayed signature error", err)
+	}
+	// A fresh signature over the same request is fine.
+	if _, err := v.verify(signedRequest("POST", "/preprocess", "img", "web", "s1", now.Add(time.Second))); err != nil {
+		t.Fatalf("new timestamp: %v", err)
+	}
+}
+
+func TestHMACRotation(t *testing.T) {
+	v := newHMACVerifier([]namedSecret{{"web", "old"}}, 5*time.Minute, nil, 64)
+	v.setSecrets([]namedSecret{{"web", "new"}})
+	now := time.Now()
+	if _, err := v.verify(signedRequest("POST", "/preprocess", "img", "web", "old", now)); !errors.Is(err, errInvalidSignature) {
+		t.Errorf("retired secret = %v, want %v", err, errInvalidSignature)
+	}
+	if _, err := v.verify(signedRequest("POST", "/preprocess", "img", "web", "new", now)); err != nil {
+		t.Errorf("new secret: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies are the peers whose X-Forwarded-For is believed. Set once at
+// startup; empty means the connected peer is always the client.
+var trustedProxies []netip.Prefix
+
+// parsePrefixes accepts comma-separated CIDRs or bare IPs.
+func parsePrefixes(v string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, s := range splitList(v) {
+		if !strings.Contains(s, "/") {
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("%q: not an IP or CIDR", s)
+			}
+			out = append(out, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q: not an IP or CIDR", s)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+func containsAddr(ps []netip.Prefix, ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range ps {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the caller's address: the connected peer, or when that peer is
+// a trusted proxy, the rightmost X-Forwarded-For entry not added by one of
+// our own proxies. Leftmost entries are caller-controlled and never trusted.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	// A unix socket peer is a local proxy by construction (the socket's
+	// permissions decide who can connect), so its X-Forwarded-For counts,
+	// and without one the caller is the local host: unix peers have no IP.
+	if fromUnixSocket(r) {
+		host = localPeer
+	}
+	peer, err := netip.ParseAddr(host)
+	if !fromUnixSocket(r) && (err != nil || !containsAddr(trustedProxies, peer)) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip, err := netip.ParseAddr(hop)
+		if err != nil {
+			break
+		}
+		if !containsAddr(trustedProxies, ip) {
+			return ip.Unmap().String()
+		}
+	}
+	return host
+}
+
+// localPeer is the address of a unix socket peer, for filtering, rate
+// limiting and logs.
+const localPeer = "127.0.0.1"
+
+// ipFilter enforces IP_ALLOWLIST/IP_DENYLIST on the client address. Deny
+// entries win; a non-empty allowlist admits nothing else.
+func (s *server) ipFilter(next http.Handler) http.Handler {
+	if len(s.ipAllow) == 0 && len(s.ipDeny) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, err := netip.ParseAddr(clientIP(r))
+		if err != nil || containsAddr(s.ipDeny, ip) || (len(s.ipAllow) > 0 && !containsAddr(s.ipAllow, ip)) {
+			reject(w, r, http.StatusForbidden, "ip_denied", "client address not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Hotel chains export menus from their DAM as JPEG 2000: JP2 files, now and
+// then a bare J2K codestream. Go has no decoder for either, so with
+// FFMPEG_PATH set the image is converted to a PNG that stands in for the
+// upload, as a HEIC's still does in /preprocess. Archive entries are
+// converted too, since menu imports arrive as ZIPs. Without ffmpeg JPEG 2000
+// stays an unsupported format.
+
+var (
+	jp2Signature = []byte{0, 0, 0, 0x0c, 'j', 'P', ' ', ' ', '\r', '\n', 0x87, '\n'}
+	j2kSignature = []byte{0xff, 0x4f, 0xff, 0x51} // SOC, then SIZ
+)
+
+func isJPEG2000(b []byte) bool {
+	return bytes.HasPrefix(b, jp2Signature) || bytes.HasPrefix(b, j2kSignature)
+}
+
+// jp2Size reads the dimensions from JPEG 2000 b's header: the ihdr box of
+// a JP2 file or the SIZ marker of a codestream.
+func jp2Size(b []byte) (image.Config, bool) {
+	if bytes.HasPrefix(b, j2kSignature) {
+		// Lsiz, Rsiz, Xsiz, Ysiz, XOsiz, YOsiz.
+		siz := b[len(j2kSignature):]
+		if len(siz) < 20 {
+			return image.Config{}, false
+		}
+		w := int64(binary.BigEndian.Uint32(siz[4:])) - int64(binary.BigEndian.Uint32(siz[12:]))
+		h := int64(binary.BigEndian.Uint32(siz[8:])) - int64(binary.BigEndian.Uint32(siz[16:]))
+		return image.Config{Width: int(w), Height: int(h)}, w > 0 && h > 0
+	}
+	header, ok := isoBox(b, "jp2h")
+	if !ok {
+		return image.Config{}, false
+	}
+	ihdr, ok := isoBox(header, "ihdr")
+	if !ok || len(ihdr) < 8 {
+		return image.Config{}, false
+	}
+	h, w := binary.BigEndian.Uint32(ihdr), binary.BigEndian.Uint32(ihdr[4:])
+	return image.Config{Width: int(w), Height: int(h)}, w > 0 && h > 0
+}
+
+// jp2Still converts JPEG 2000 b to a PNG. Its size is checked against the
+// limits first, since ffmpeg decodes the whole image whatever it claims.
+func (s *server) jp2Still(ctx context.Context, b []byte) ([]byte, error) {
+	start := time.Now()
+	inputFormats.inc("image/jp2")
+	logAttrs(ctx, "input_format", "image/jp2")
+	cfg, ok := jp2Size(b)
+	if !ok {
+		return nil, errUnsupportedImage
+	}
+	logAttrs(ctx, "input_width", cfg.Width, "input_height", cfg.Height)
+	if err := s.checkLimits(cfg); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "preprocess-jp2-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "still.png")
+	if err := os.WriteFile(in, b, 0o600); err != nil {
+		return nil, err
+	}
+	if err := s.ffmpeg(ctx, "-i", in, "-frames:v", "1", "-map_metadata", "-1", "-c:v", "png", out); err != nil {
+		return nil, err
+	}
+	still, err := os.ReadFile(out)
+	if err != nil {
+		return nil, fmt.Errorf("%w: no image in JPEG 2000", errTranscode)
+	}
+	observeStage(ctx, start, "extract")
+	return still, nil
+}
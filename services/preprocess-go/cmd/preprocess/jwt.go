@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksMinRefetch throttles refetches triggered by unknown key IDs so a
+	// stream of forged tokens can't hammer the auth service.
+	jwksMinRefetch = 30 * time.Second
+	jwtLeeway      = time.Minute
+)
+
+var errInvalidToken = errors.New("invalid token")
+
+// jwtVerifier validates bearer tokens issued by the auth service against its
+// published JWKS. Only RS256 and ES256 are accepted.
+type jwtVerifier struct {
+	url      string
+	issuer   string // empty skips the iss check
+	audience string // empty skips the aud check
+	refresh  time.Duration
+	client   *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time  // last successful fetch
+	attempted time.Time  // last fetch, failed or not; jwksMinRefetch counts from it
+	lastErr   error      // why the last fetch failed, nil if it didn't
+	inflight  *jwksFetch // the fetch under way, if any
+}
+
+// jwksFetch is one fetch of the JWKS, shared by every verification that
+// needs it; done is closed once keys or lastErr reflect it.
+type jwksFetch struct {
+	done chan struct{}
+}
+
+func newJWTVerifier(url, issuer, audience string, refresh time.Duration) *jwtVerifier {
+	return &jwtVerifier{
+		url:      url,
+		issuer:   issuer,
+		audience: audience,
+		refresh:  refresh,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"` // string or array of strings
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// verify checks signature, expiry and (if configured) issuer and audience,
+// returning the token's claims.
+func (v *jwtVerifier) verify(ctx context.Context, token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	key, err := v.key(ctx, hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if hdr.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errInvalidToken
+		}
+	case *ecdsa.PublicKey:
+		if hdr.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errInvalidToken
+		}
+	default:
+		return nil, errInvalidToken
+	}
+
+	var c jwtClaims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if c.ExpiresAt == nil || now.After(time.Unix(int64(*c.ExpiresAt), 0).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("%w: expired", errInvalidToken)
+	}
+	if c.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*c.NotBefore), 0)) {
+		return nil, fmt.Errorf("%w: not yet valid", errInvalidToken)
+	}
+	if v.issuer != "" && c.Issuer != v.issuer {
+		return nil, fmt.Errorf("%w: wrong issuer", errInvalidToken)
+	}
+	if v.audience != "" && !c.hasAudience(v.audience) {
+		return nil, fmt.Errorf("%w: wrong audience", errInvalidToken)
+	}
+	return &c, nil
+}
+
+func (c *jwtClaims) hasAudience(aud string) bool {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == aud
+	}
+	var many []string
+	return json.Unmarshal(c.Audience, &many) == nil && slices.Contains(many, aud)
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil || json.Unmarshal(b, v) != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// key returns the public key for kid, refetching the JWKS when the cached
+// set is stale or doesn't know kid (rotation). The fetch runs outside the
+// lock and is shared: concurrent verifications wait for the one under way
+// rather than each starting their own, and a stale but known key is served
+// while it runs.
+func (v *jwtVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	k, known := v.keys[kid]
+	if known && time.Since(v.fetched) < v.refresh {
+		v.mu.Unlock()
+		return k, nil
+	}
+	f := v.inflight
+	if f == nil && time.Since(v.attempted) >= jwksMinRefetch {
+		f = &jwksFetch{done: make(chan struct{})}
+		v.inflight, v.attempted = f, time.Now()
+		go v.refetch(f)
+	}
+	v.mu.Unlock()
+	if known {
+		return k, nil
+	}
+	if f != nil {
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if k, ok := v.keys[kid]; ok {
+		return k, nil
+	}
+	if v.keys == nil && v.lastErr != nil {
+		return nil, fmt.Errorf("jwks: %w", v.lastErr)
+	}
+	return nil, fmt.Errorf("%w: unknown key id", errInvalidToken)
+}
+
+// refetch runs f. It isn't tied to any one request, so a caller giving up
+// doesn't fail the fetch for the others waiting on it.
+func (v *jwtVerifier) refetch(f *jwksFetch) {
+	keys, err := v.fetch(context.Background())
+	v.mu.Lock()
+	// Keep serving with the old set if the auth service blips.
+	if err == nil {
+		v.keys, v.fetched = keys, time.Now()
+	}
+	v.lastErr, v.inflight = err, nil
+	v.mu.Unlock()
+	close(f.done)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (v *jwtVerifier) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b := func(s string) *big.Int {
+		raw, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(raw)
+	}
+	switch {
+	case k.Kty == "RSA" && k.N != "" && k.E != "":
+		return &rsa.PublicKey{N: b(k.N), E: int(b(k.E).Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: b(k.X), Y: b(k.Y)}
+		if _, err := pub.ECDH(); err != nil { // rejects points off the curve
+			return nil, err
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func b64JSON(v any) string {
+	b, _ := json.Marshal(v)
+	return b64(b)
+}
+
+// makeJWT signs claims with key under alg; alg and key needn't match, so
+// tests can forge what an attacker would send.
+func makeJWT(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	signing := b64JSON(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + b64JSON(claims)
+	digest := sha256.Sum256([]byte(signing))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signing))
+		sig = mac.Sum(nil)
+	case nil:
+	}
+	return signing + "." + b64(sig)
+}
+
+// jwksServer publishes the test keys as "rsa" and "ec" and counts fetches.
+func jwksServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var fetches atomic.Int32
+	keys := []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(testRSAKey.N.Bytes()), "e": b64(big.NewInt(int64(testRSAKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(testECKey.X.Bytes()), "y": b64(testECKey.Y.Bytes())},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(testRSAKey.N.Bytes()), "e": "AQAB"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		writeJSON(w, map[string]any{"keys": keys})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &fetches
+}
+
+func TestJWTVerify(t *testing.T) {
+	srv, _ := jwksServer(t)
+	now := time.Now().Unix()
+	valid := map[string]any{"sub": "app", "iss": "auth", "aud": "preprocess", "exp": now + 600}
+	with := func(k string, v any) map[string]any {
+		c := map[string]any{}
+		for k, v := range valid {
+			c[k] = v
+		}
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+	rsaModulus := testRSAKey.N.Bytes()
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", makeJWT(t, "RS256", "rsa", testRSAKey, valid), true},
+		{"ES256", makeJWT(t, "ES256", "ec", testECKey, valid), true},
+		{"audience list", makeJWT(t, "RS256", "rsa", testRSAKey, with("aud", []string{"other", "preprocess"})), true},
+		{"expired within leeway", makeJWT(t, "RS256", "rsa", testRSAKey, with("exp", now-30)), true},
+
+		{"alg none", makeJWT(t, "none", "rsa", nil, valid), false},
+		{"HS256 keyed with the public key", makeJWT(t, "HS256", "rsa", rsaModulus, valid), false},
+		{"ES256 header on an RSA key", makeJWT(t, "ES256", "rsa", testRSAKey, valid), false},
+		{"RS256 header on an EC key", makeJWT(t, "RS256", "ec", testECKey, valid), false},
+		{"signed by another key", makeJWT(t, "ES256", "ec", mustECKey(t), valid), false},
+		{"encryption key", makeJWT(t, "RS256", "enc", testRSAKey, valid), false},
+		{"unknown kid", makeJWT(t, "RS256", "nope", testRSAKey, valid), false},
+		{"expired", makeJWT(t, "RS256", "rsa", testRSAKey, with("exp", now-600)), false},
+		{"no exp", makeJWT(t, "RS256", "rsa", testRSAKey, with("exp", nil)), false},
+		{"not yet valid", makeJWT(t, "RS256", "rsa", testRSAKey, with("nbf", now+600)), false},
+		{"wrong issuer", makeJWT(t, "RS256", "rsa", testRSAKey, with("iss", "evil")), false},
+		{"wrong audience", makeJWT(t, "RS256", "rsa", testRSAKey, with("aud", "other")), false},
+		{"two segments", "a.b", false},
+		{"garbage header", "!!.e30.sig", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newJWTVerifier(srv.URL, "auth", "preprocess", time.Hour)
+			c, err := v.verify(context.Background(), tt.token)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("verify: %v", err)
+				}
+				if c.Subject != "app" {
+					t.Errorf("sub = %q, want app", c.Subject)
+				}
+				return
+			}
+			if !errors.Is(err, errInvalidToken) {
+				t.Fatalf("verify = %v, want %v", err, errInvalidToken)
+			}
+		})
+	}
+}
+
+func mustECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestJWKSRefetch(t *testing.T) {
+	srv, fetches := jwksServer(t)
+	v := newJWTVerifier(srv.URL, "", "", time.Hour)
+	claims := map[string]any{"sub": "app", "exp": time.Now().Unix() + 600}
+	for i := 0; i < 3; i++ {
+		if _, err := v.verify(context.Background(), makeJWT(t, "RS256", "rsa", testRSAKey, claims)); err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("JWKS fetched %d times for a cached key, want 1", n)
+	}
+	// Unknown kids trigger a refetch only once per jwksMinRefetch.
+	for i := 0; i < 3; i++ {
+		if _, err := v.verify(context.Background(), makeJWT(t, "RS256", "forged", testRSAKey, claims)); !errors.Is(err, errInvalidToken) {
+			t.Fatalf("unknown kid = %v, want %v", err, errInvalidToken)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("JWKS fetched %d times after unknown kids within jwksMinRefetch, want 1", n)
+	}
+}
+
+func TestJWKRejectsOffCurvePoints(t *testing.T) {
+	k := jwk{Kty: "EC", Crv: "P-256", X: b64([]byte{1}), Y: b64([]byte{2})}
+	if _, err := k.publicKey(); err == nil {
+		t.Fatal("publicKey accepted a point off the curve")
+	}
+}
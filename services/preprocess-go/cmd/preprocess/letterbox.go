@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// ar=16:9&fit=letterbox&bg=000000 pads outputs to an exact aspect ratio,
+// image centered, for the hero carousel, which can't crop wide panoramas.
+// The canvas, not the image, is what fits max_dim.
+
+// maxAspect bounds ratios either way; past 10:1 letterboxing is mostly bars.
+const maxAspect = 10
+
+// aspect is a W:H ratio such as 16:9.
+type aspect struct{ w, h int }
+
+func (a aspect) ratio() float64 {
+	return float64(a.w) / float64(a.h)
+}
+
+func (a aspect) String() string {
+	return fmt.Sprintf("%d:%d", a.w, a.h)
+}
+
+func parseAspect(s string) (aspect, error) {
+	ws, hs, ok := strings.Cut(s, ":")
+	w, errW := strconv.Atoi(ws)
+	h, errH := strconv.Atoi(hs)
+	if !ok || errW != nil || errH != nil || w < 1 || h < 1 {
+		return aspect{}, fmt.Errorf("aspect ratio must be W:H, got %q", s)
+	}
+	a := aspect{w, h}
+	if r := a.ratio(); r > maxAspect || r < 1.0/maxAspect {
+		return aspect{}, fmt.Errorf("aspect ratio %s is beyond %d:1", a, maxAspect)
+	}
+	return a, nil
+}
+
+type letterbox struct {
+	ar aspect // zero when not letterboxing
+	bg color.NRGBA
+}
+
+func letterboxParam(r *http.Request) (letterbox, error) {
+	q := r.URL.Query()
+	fit, ar, bg := q.Get("fit"), q.Get("ar"), q.Get("bg")
+	switch {
+	case fit == "" && ar == "" && bg == "":
+		return letterbox{}, nil
+	case fit == "":
+		return letterbox{}, fmt.Errorf("ar and bg need fit=letterbox")
+	case fit != "letterbox":
+		return letterbox{}, fmt.Errorf("fit must be letterbox, got %q", fit)
+	case ar == "":
+		return letterbox{}, fmt.Errorf("fit=letterbox needs ar")
+	}
+	lb := letterbox{bg: color.NRGBA{A: 0xff}}
+	var err error
+	if lb.ar, err = parseAspect(ar); err != nil {
+		return letterbox{}, err
+	}
+	if bg != "" {
+		if lb.bg, err = parseHexColor(bg); err != nil {
+			return letterbox{}, fmt.Errorf("bg: %w", err)
+		}
+	}
+	return lb, nil
+}
+
+// fit returns the canvas size for an image of bounds b, no larger than
+// maxDim and never upscaling, and the maxDim to resize the image itself to.
+func (lb letterbox) fit(b image.Rectangle, maxDim int) (cw, ch, imgMax int) {
+	w, h := float64(b.Dx()), float64(b.Dy())
+	fw, fh := w, h
+	if w/h > lb.ar.ratio() {
+		fh = w / lb.ar.ratio()
+	} else {
+		fw = h * lb.ar.ratio()
+	}
+	s := math.Min(1, float64(maxDim)/math.Max(fw, fh))
+	cw, ch = max(1, int(math.Round(fw*s))), max(1, int(math.Round(fh*s)))
+	imgMax = max(1, int(math.Round(math.Max(w, h)*s)))
+	return cw, ch, imgMax
+}
+
+// place centers img on a cw×ch canvas filled with the background, keeping
+// 16-bit depth. Plain canvases come from the pool.
+func (lb letterbox) place(img image.Image, cw, ch int) draw.Image {
+	r := image.Rect(0, 0, cw, ch)
+	var canvas draw.Image
+	if is16Bit(img.ColorModel()) {
+		canvas = image.NewRGBA64(r)
+	} else {
+		canvas = newRGBA(r)
+	}
+	draw.Draw(canvas, r, image.NewUniform(lb.bg), image.Point{}, draw.Src)
+	b := img.Bounds()
+	at := image.Pt((cw-b.Dx())/2, (ch-b.Dy())/2)
+	draw.Draw(canvas, b.Sub(b.Min).Add(at), img, b.Min, draw.Over)
+	return canvas
+}
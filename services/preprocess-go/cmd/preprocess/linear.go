@@ -0,0 +1,90 @@
+package main
+
+import (
+	"image"
+	"math"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+// Averaging sRGB-encoded values darkens edges between bright and dark areas
+// (white plates on dark tables); linear=true averages in linear light
+// instead. It costs a 16-bit working copy of the input, so it's a per-request
+// choice for hero images rather than the default.
+
+var (
+	linearOnce sync.Once
+	toLinear   [256]uint16   // sRGB byte -> linear 16-bit
+	fromLinear [1 << 16]byte // linear 16-bit -> sRGB byte
+)
+
+func buildLinearTables() {
+	for i := range toLinear {
+		v := float64(i) / 255
+		if v <= 0.04045 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		toLinear[i] = uint16(math.Round(v * 0xffff))
+	}
+	for i := range fromLinear {
+		v := float64(i) / 0xffff
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		fromLinear[i] = byte(math.Round(v * 255))
+	}
+}
+
+// downscaleLinear is downscale with the filter applied to linear-light
+// values. Alpha is not gamma-encoded, so it is scaled as-is and colors are
+// converted unpremultiplied.
+func downscaleLinear(src image.Image, maxDim int) image.Image {
+	nw, nh, ok := scaledSize(src.Bounds(), maxDim)
+	if !ok {
+		return src
+	}
+	linearOnce.Do(buildLinearTables)
+
+	b := src.Bounds()
+	in := newRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	defer putRGBA(in)
+	draw.Draw(in, in.Bounds(), src, b.Min, draw.Src)
+
+	lin := image.NewRGBA64(in.Rect)
+	for i := 0; i < len(in.Pix); i += 4 {
+		a := uint32(in.Pix[i+3])
+		if a == 0 {
+			continue
+		}
+		a16 := a * 0x101
+		for c := 0; c < 3; c++ {
+			v := uint32(toLinear[uint32(in.Pix[i+c])*0xff/a]) * a16 / 0xffff
+			lin.Pix[2*(i+c)], lin.Pix[2*(i+c)+1] = byte(v>>8), byte(v)
+		}
+		lin.Pix[2*(i+3)], lin.Pix[2*(i+3)+1] = byte(a16>>8), byte(a16)
+	}
+
+	scaled := image.NewRGBA64(image.Rect(0, 0, nw, nh))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), lin, lin.Bounds(), draw.Src, nil)
+
+	dst := newRGBA(scaled.Rect)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		a := uint32(scaled.Pix[2*(i+3)])<<8 | uint32(scaled.Pix[2*(i+3)+1])
+		if a == 0 {
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = 0, 0, 0, 0
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			v := uint32(scaled.Pix[2*(i+c)])<<8 | uint32(scaled.Pix[2*(i+c)+1])
+			v = min(v*0xffff/a, 0xffff) // CatmullRom can overshoot past alpha
+			dst.Pix[i+c] = byte(uint32(fromLinear[v]) * a / 0xffff)
+		}
+		dst.Pix[i+3] = byte(a >> 8)
+	}
+	return dst
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func setupLogging(level string) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: lvl})))
+}
+
+type ctxKey int
+
+const requestStateKey ctxKey = iota
+
+// requestState accumulates what the handler and pipeline learn about a
+// request so it can be logged as one line when the request finishes. The
+// pipeline goroutine may still be writing after a timeout, hence the mutex.
+type requestState struct {
+	id     string
+	path   string
+	start  time.Time
+	caller string // API key name or "jwt:<sub>" once authenticated
+	group  string // bounded-cardinality caller label for metrics
+	tenant string // from scopeTenant; empty without TENANTS
+	lane   int    // worker queue lane, from prioritize
+	client string // clientKey, the worker queue's fairness key
+
+	mu         sync.Mutex
+	outcome    string // rejection reason, or "ok"
+	attrs      []any
+	stages     map[string]time.Duration // summed across outputs in sizes mode
+	stored     []storedImage            // store= uploads, one per output
+	camera     *cameraInfo              // from the upload's EXIF, for store= responses
+	screenshot *screenshotInfo          // set when the upload is likely a screenshot
+}
+
+func stateFrom(ctx context.Context) *requestState {
+	st, _ := ctx.Value(requestStateKey).(*requestState)
+	return st
+}
+
+func requestID(ctx context.Context) string {
+	if st := stateFrom(ctx); st != nil {
+		return st.id
+	}
+	return ""
+}
+
+func requestPath(ctx context.Context) string {
+	if st := stateFrom(ctx); st != nil {
+		return st.path
+	}
+	return ""
+}
+
+// logAttrs attaches key/value pairs to the request's completion log line.
+func logAttrs(ctx context.Context, args ...any) {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		st.attrs = append(st.attrs, args...)
+		st.mu.Unlock()
+	}
+}
+
+func recordStage(ctx context.Context, stage string, d time.Duration) {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		if st.stages == nil {
+			st.stages = map[string]time.Duration{}
+		}
+		st.stages[stage] += d
+		st.mu.Unlock()
+	}
+}
+
+func setCaller(ctx context.Context, name, group string) {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		st.caller, st.group = name, group
+		st.mu.Unlock()
+	}
+	logAttrs(ctx, "caller", name)
+}
+
+func callerName(ctx context.Context) string {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.caller
+	}
+	return ""
+}
+
+func callerGroup(ctx context.Context) string {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.group
+	}
+	return ""
+}
+
+func setTenant(ctx context.Context, tenant string) {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		st.tenant = tenant
+		st.mu.Unlock()
+	}
+	logAttrs(ctx, "tenant", tenant)
+}
+
+func tenantName(ctx context.Context) string {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.tenant
+	}
+	return ""
+}
+
+func setSchedule(ctx context.Context, lane int, client string) {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		st.lane, st.client = lane, client
+		st.mu.Unlock()
+	}
+	if lane != laneInteractive {
+		logAttrs(ctx, "priority", laneNames[lane])
+	}
+}
+
+// schedule is where the request waits for a worker: its lane, interactive
+// unless prioritize said otherwise, and the client it takes turns as.
+func schedule(ctx context.Context) (lane int, client string) {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.lane, st.client
+	}
+	return laneInteractive, ""
+}
+
+func setStored(ctx context.Context, stored []storedImage) {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		st.stored = stored
+		st.mu.Unlock()
+	}
+}
+
+func storedImages(ctx context.Context) []storedImage {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.stored
+	}
+	return nil
+}
+
+func setCamera(ctx context.Context, cam *cameraInfo) {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		st.camera = cam
+		st.mu.Unlock()
+	}
+	logAttrs(ctx, "camera_model", cam.Model, "camera_lens", cam.Lens, "camera_iso", cam.ISO)
+}
+
+func camera(ctx context.Context) *cameraInfo {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.camera
+	}
+	return nil
+}
+
+func setScreenshot(ctx context.Context, sc *screenshotInfo) {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		st.screenshot = sc
+		st.mu.Unlock()
+	}
+}
+
+func screenshot(ctx context.Context) *screenshotInfo {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.screenshot
+	}
+	return nil
+}
+
+func setOutcome(ctx context.Context, outcome string) {
+	if st := stateFrom(ctx); st != nil {
+		st.mu.Lock()
+		if st.outcome == "" {
+			st.outcome = outcome
+		}
+		st.mu.Unlock()
+	}
+}
+
+func (st *requestState) stagesMillisLocked() map[string]float64 {
+	stages := make(map[string]float64, len(st.stages))
+	for k, d := range st.stages {
+		stages[k] = float64(d.Microseconds()) / 1000
+	}
+	return stages
+}
+
+// snapshot returns what has been recorded so far as one object: the log
+// attributes, rejection reason and per-stage timings.
+func (st *requestState) snapshot() map[string]any {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	m := make(map[string]any, len(st.attrs)/2+1)
+	for i := 0; i+1 < len(st.attrs); i += 2 {
+		if k, ok := st.attrs[i].(string); ok {
+			m[k] = st.attrs[i+1]
+		}
+	}
+	if st.outcome != "" {
+		m["outcome"] = st.outcome
+	}
+	m["stages_ms"] = st.stagesMillisLocked()
+	return m
+}
+
+// newRequestID accepts a caller-supplied X-Request-ID so IDs correlate across
+// services, but only if it is short and printable; otherwise mints one.
+func newRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= 128 && !strings.ContainsFunc(id, func(c rune) bool {
+		return c < 0x21 || c > 0x7e
+	}) {
+		return id
+	}
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// logRequests assigns a request ID and emits one structured line per request
+// with whatever the handler recorded: format, dimensions, outcome, timing.
+// Requests slower than slow (if non-zero) get an extra warning carrying the
+// query parameters and per-stage timings.
+func logRequests(slow time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := &requestState{id: newRequestID(r), path: r.URL.Path, start: time.Now()}
+		w.Header().Set("X-Request-ID", st.id)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestStateKey, st)))
+
+		elapsed := time.Since(st.start)
+		st.mu.Lock()
+		outcome := st.outcome
+		if outcome == "" {
+			outcome = "ok"
+		}
+		args := append([]any{
+			"request_id", st.id,
+			"status", rec.status,
+			"outcome", outcome,
+			"duration_ms", elapsed.Milliseconds(),
+		}, st.attrs...)
+		stages := st.stagesMillisLocked()
+		st.mu.Unlock()
+
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case rec.status >= 400:
+			level = slog.LevelWarn
+		}
+		slog.Log(r.Context(), level, "preprocess", args...)
+
+		if slow > 0 && elapsed > slow {
+			slog.Warn("slow request", append([]any{
+				"threshold_ms", slow.Milliseconds(),
+				"query", r.URL.RawQuery,
+				"content_length", r.ContentLength,
+				"stages_ms", stages,
+			}, args...)...)
+		}
+	})
+}
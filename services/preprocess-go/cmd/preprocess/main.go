@@ -1,123 +1,937 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"image"
-	"image/jpeg"
-	"image/png"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"mime/multipart"
 	"net/http"
+	"net/netip"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"golang.org/x/image/draw"
-	"golang.org/x/image/webp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const (
-	maxUploadBytes = 10 << 20 // 10MB
-	defaultMaxDim  = 1280
-	defaultJpegQ   = 82
+	defaultMaxUploadBytes = 10 << 20 // 10MB
+	// /archive takes a whole ZIP of photos in one upload.
+	defaultArchiveMaxBytes   = 200 << 20
+	defaultArchiveMaxEntries = 100
+	defaultMaxDim            = 1280
+	defaultJpegQ             = 82
+	// max_dim, sizes= and quality are clamped into MIN_*/MAX_* ranges.
+	defaultMinDim     = 256
+	defaultMaxDimCap  = 3000
+	defaultMinQuality = 40
+	defaultMaxQuality = 95
+	dimCeiling        = 16384 // no configured MAX_DIM may exceed this
+	maxSizes          = 8     // entries allowed in sizes=
+
+	// Pixel-count ceiling checked via DecodeConfig before a full decode. A
+	// 40MP RGBA buffer is ~160MB; anything larger is almost certainly a bomb.
+	defaultMaxPixels = 40_000_000
+	// Longest side over shortest; real photos and panoramas stay well below.
+	defaultMaxAspectRatio = 50
+
+	defaultProcessTimeout   = 30 * time.Second
+	defaultShutdownTimeout  = 25 * time.Second // inside the usual 30s k8s grace period
+	defaultCacheMaxBytes    = 64 << 20
+	defaultCacheTTL         = time.Hour
+	defaultCacheDirMaxBytes = 1 << 30
+	defaultRateLimitBurst   = 10
+
+	defaultSlowRequestThreshold = 5 * time.Second
+	defaultJWKSRefresh          = time.Hour
+	defaultHMACMaxSkew          = 5 * time.Minute
+	defaultCORSMaxAge           = 10 * time.Minute
+	defaultURLFetchTimeout      = 10 * time.Second
+	defaultMalwareScanTimeout   = 10 * time.Second
+	defaultFaceDetectTimeout    = 10 * time.Second
+	defaultVideoMaxDuration     = 15 * time.Second
+	defaultVideoFrameSamples    = 5
+	defaultValidateMinSide      = 480
+	defaultValidateMinSharpness = 0.02
+	defaultStoreTimeout         = 30 * time.Second
+	defaultEventsStreamMaxLen   = 100000
+	defaultBackendTimeout       = 10 * time.Second
+	defaultDownstreamRetries    = 2
+	defaultDownstreamBackoff    = 200 * time.Millisecond
+	defaultBreakerThreshold     = 5
+	defaultBreakerCooldown      = 30 * time.Second
+	defaultSecretsRefresh       = 5 * time.Minute
+
+	// Uploads come from phones on slow links, so reads get generous room;
+	// writes must outlast PROCESS_TIMEOUT plus the response transfer.
+	defaultReadTimeout       = 2 * time.Minute
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultWriteTimeout      = 2 * time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
 )
 
+type server struct {
+	cfg     config
+	cache   resultCache  // nil when disabled
+	limiter *rateLimiter // passes everything while RATE_LIMIT_RPS is 0
+	live    atomic.Pointer[liveConfig]
+	watcher *configWatcher          // nil without a config file
+	apiKeys atomic.Pointer[apiKeys] // nil unless API keys are configured
+	secrets *secretResolver
+	jwt     *jwtVerifier   // nil unless JWKS_URL is set
+	hmac    *hmacVerifier  // nil unless HMAC keys are configured
+	fetcher *fetcher       // nil unless URL_FETCH is on
+	scanner malwareScanner // nil unless MALWARE_SCAN_URL is set
+	alerter *flagAlerter   // nil unless MODERATION_WEBHOOK_URL is set
+	dishes  *dishCallback  // nil unless BACKEND_URL is set
+
+	sidecarDir string                // SIDECAR_DIR with symlinks resolved; empty disables file=
+	faces      *faceDetector         // nil unless FACE_DETECT_URL is set
+	stores     map[string]imageStore // store= targets with credentials configured
+	catalog    *catalog              // nil unless POSTGRES_URL is set
+	quotas     *quotaTracker         // nil unless QUOTAS is set
+	tenants    map[string]bool       // TENANTS; empty disables tenant scoping
+	tenantKeys map[string]string     // caller name -> tenant
+	ipAllow    []netip.Prefix
+	ipDeny     []netip.Prefix
+
+	uploadLimits map[string]int64 // per-caller MAX_UPLOAD_BYTES overrides
+	priorities   map[string]int   // PRIORITY_CLASSES: caller name -> lane
+	disabled     map[string]bool  // DISABLE_FEATURES
+	debugCallers map[string]bool  // may request X-Debug-Info
+	debugNets    []netip.Prefix
+	pool         *workPool
+	jobs         *jobRegistry // for GET /admin/jobs
+	switchedOff  sync.Map     // features turned off through /admin/features
+	redis        *redisClient // nil unless REDIS_URL is set
+
+	reporter errorReporter   // nil unless SENTRY_DSN is set
+	auditLog *auditLog       // nil unless AUDIT_LOG or AUDIT_REDIS_KEY is set
+	events   *eventPublisher // nil unless EVENTS_REDIS_CHANNEL or EVENTS_REDIS_STREAM is set
+
+	adminToken secretValue       // ADMIN_TOKEN, as last resolved
+	thumborKey secretValue       // THUMBOR_SECURITY_KEY, as last resolved
+	rotating   []*rotatingSecret // secret references re-resolved every SECRETS_REFRESH
+
+	draining atomic.Bool // set once shutdown starts; fails readiness
+}
+
 func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML config file; env vars and flags override its values")
+	registerSettingFlags(flag.CommandLine)
+	flag.Parse()
+	fileErr := loadConfigFile(*configPath)
 	mux := http.NewServeMux()
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true})
-	})
-	mux.HandleFunc("/preprocess", preprocessHandler)
+	setupLogging(setting("LOG_LEVEL"))
+	if fileErr != nil {
+		slog.Error("config file", "err", fileErr)
+		os.Exit(1)
+	}
+	applyCPUQuota()
+	s := &server{cfg: loadConfig()}
+	if err := s.cfg.validate(); err != nil {
+		slog.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	var err error
+	if s.disabled, err = parseDisabledFeatures(s.cfg.DisableFeatures); err != nil {
+		slog.Error("bad DISABLE_FEATURES", "err", err)
+		os.Exit(1)
+	}
+	if *configPath != "" {
+		s.watcher = newConfigWatcher(*configPath, s.cfg)
+	}
+	s.pool = newWorkPool(s.cfg.Workers, s.cfg.MaxQueue)
+	s.jobs = newJobRegistry()
+	s.registerPoolMetrics()
+	mux.HandleFunc("/health", s.healthHandler)
+	mux.HandleFunc("/livez", s.livezHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	if s.cfg.AdminAddr == "" {
+		if s.enabled("metrics") {
+			mux.Handle("/metrics", compress(s.gate("metrics", metricsHandler)))
+		}
+		if s.enabled("stats") {
+			mux.Handle("/stats", compress(s.gate("stats", statsHandler)))
+		}
+	}
+	s.secrets = newSecretResolver()
+	warnUnusedSettings()
+	secretRefs := map[string]string{}
+	for name, v := range s.secretSettings() {
+		if isSecretRef(*v) {
+			secretRefs[name] = *v
+		}
+		if *v, err = s.secrets.resolve(context.Background(), *v); err != nil {
+			slog.Error("secret lookup failed", "setting", name, "err", err)
+			os.Exit(1)
+		}
+	}
+	s.adminToken.set(s.cfg.AdminToken)
+	s.thumborKey.set(s.cfg.ThumborSecurityKey)
+	if s.cfg.RedisURL != "" {
+		if s.redis, err = newRedisClient(s.cfg.RedisURL); err != nil {
+			slog.Error("redis setup failed", "err", err)
+			os.Exit(1)
+		}
+	}
+	if s.cfg.SentryDSN != "" {
+		if s.reporter, err = newSentryReporter(s.cfg.SentryDSN, s.cfg.SentryEnvironment); err != nil {
+			slog.Error("error reporter setup failed", "err", err)
+			os.Exit(1)
+		}
+	}
+	if s.cfg.AuditLog != "" || s.cfg.AuditRedisKey != "" {
+		if s.cfg.AuditRedisKey != "" && s.redis == nil {
+			slog.Error("AUDIT_REDIS_KEY requires REDIS_URL")
+			os.Exit(1)
+		}
+		if s.auditLog, err = newAuditLog(s.cfg.AuditLog, s.redis, s.cfg.AuditRedisKey); err != nil {
+			slog.Error("audit log setup failed", "err", err)
+			os.Exit(1)
+		}
+	}
+	if (s.cfg.EventsRedisChannel != "" || s.cfg.EventsRedisStream != "") && s.redis == nil {
+		slog.Error("EVENTS_REDIS_CHANNEL and EVENTS_REDIS_STREAM require REDIS_URL")
+		os.Exit(1)
+	}
+	if s.cfg.EventsStreamMaxLen < 1 {
+		slog.Error("EVENTS_STREAM_MAXLEN must be positive")
+		os.Exit(1)
+	}
+	if s.cfg.EventsRedisChannel != "" || s.cfg.EventsRedisStream != "" {
+		s.events = newEventPublisher(s.redis, s.cfg.EventsRedisChannel, s.cfg.EventsRedisStream, s.cfg.EventsStreamMaxLen)
+	}
+	if s.cfg.DownstreamRetries < 0 || s.cfg.BreakerThreshold < 0 {
+		slog.Error("DOWNSTREAM_RETRIES and BREAKER_THRESHOLD must not be negative")
+		os.Exit(1)
+	}
+	if s.cfg.CacheRedis && s.redis == nil {
+		slog.Error("CACHE_REDIS requires REDIS_URL")
+		os.Exit(1)
+	}
+	if s.cache, err = newResultCache(s.cfg, s.redis); err != nil {
+		slog.Error("cache setup failed", "err", err)
+		os.Exit(1)
+	}
+	if s.uploadLimits, err = parseUploadLimits(s.cfg.UploadLimits); err != nil {
+		slog.Error("bad UPLOAD_LIMITS", "err", err)
+		os.Exit(1)
+	}
+	if s.priorities, err = parsePriorityClasses(s.cfg.PriorityClasses); err != nil {
+		slog.Error("bad PRIORITY_CLASSES", "err", err)
+		os.Exit(1)
+	}
+	if s.tenants, s.tenantKeys, err = parseTenants(s.cfg.Tenants, s.cfg.TenantKeys); err != nil {
+		slog.Error("bad TENANTS", "err", err)
+		os.Exit(1)
+	}
+	if err := s.loadCredentials(context.Background()); err != nil {
+		slog.Error("credentials setup failed", "err", err)
+		os.Exit(1)
+	}
+	if s.cfg.MalwareScanURL != "" {
+		if s.scanner, err = newMalwareScanner(s.cfg.MalwareScanURL, s.cfg.MalwareScanTimeout); err != nil {
+			slog.Error("malware scanner setup failed", "err", err)
+			os.Exit(1)
+		}
+	}
+	if s.cfg.FFmpegPath != "" {
+		if s.cfg.FFmpegPath, err = exec.LookPath(s.cfg.FFmpegPath); err != nil {
+			slog.Error("FFMPEG_PATH is not runnable", "err", err)
+			os.Exit(1)
+		}
+	}
+	if s.cfg.PdftoppmPath != "" {
+		if s.cfg.PdftoppmPath, err = exec.LookPath(s.cfg.PdftoppmPath); err == nil {
+			_, err = exec.LookPath(filepath.Join(filepath.Dir(s.cfg.PdftoppmPath), "pdfinfo"))
+		}
+		if err != nil {
+			slog.Error("PDFTOPPM_PATH is not runnable", "err", err)
+			os.Exit(1)
+		}
+	}
+	if s.cfg.ModerationWebhookURL != "" {
+		s.alerter = newFlagAlerter(s.cfg.ModerationWebhookURL, newDownstream("moderation_webhook", moderationWebhookTimeout, s.cfg))
+	}
+	if s.cfg.FaceDetectURL != "" {
+		s.faces = newFaceDetector(s.cfg.FaceDetectURL, newDownstream("face_detect", s.cfg.FaceDetectTimeout, s.cfg))
+	}
+	if s.stores, err = newImageStores(s.cfg); err != nil {
+		slog.Error("image host setup failed", "err", err)
+		os.Exit(1)
+	}
+	if s.cfg.SidecarDir != "" {
+		if s.sidecarDir, err = filepath.EvalSymlinks(s.cfg.SidecarDir); err == nil {
+			s.sidecarDir, err = filepath.Abs(s.sidecarDir)
+		}
+		if err != nil {
+			slog.Error("SIDECAR_DIR unusable", "err", err)
+			os.Exit(1)
+		}
+	}
+	if s.cfg.BackendURL != "" {
+		if s.dishes, err = newDishCallback(s.cfg.BackendURL, s.cfg.BackendDishPath, s.cfg.BackendToken, newDownstream("backend", s.cfg.BackendTimeout, s.cfg)); err != nil {
+			slog.Error("backend callback setup failed", "err", err)
+			os.Exit(1)
+		}
+	}
+	if s.cfg.PostgresURL != "" {
+		if s.catalog, err = newCatalog(s.cfg.PostgresURL, s.cfg.PostgresTable); err != nil {
+			slog.Error("image catalog setup failed", "err", err)
+			os.Exit(1)
+		}
+	}
+	s.watchSecrets(secretRefs)
+	for _, l := range []struct {
+		dst *[]netip.Prefix
+		env string
+		v   string
+	}{
+		{&trustedProxies, "TRUSTED_PROXIES", s.cfg.TrustedProxies},
+		{&s.ipAllow, "IP_ALLOWLIST", s.cfg.IPAllowlist},
+		{&s.ipDeny, "IP_DENYLIST", s.cfg.IPDenylist},
+		{&s.debugNets, "DEBUG_NETWORKS", s.cfg.DebugNetworks},
+	} {
+		if *l.dst, err = parsePrefixes(l.v); err != nil {
+			slog.Error("bad address list", "env", l.env, "err", err)
+			os.Exit(1)
+		}
+	}
+	s.debugCallers = map[string]bool{}
+	for _, name := range splitList(s.cfg.DebugCallers) {
+		s.debugCallers[name] = true
+	}
+	if s.cfg.Quotas != "" {
+		limits, err := parseQuotas(s.cfg.Quotas)
+		if err != nil {
+			slog.Error("quota setup failed", "err", err)
+			os.Exit(1)
+		}
+		s.quotas = newQuotaTracker(limits, s.redis)
+	}
+	if s.cfg.URLFetch && s.enabled("url_fetch") {
+		s.fetcher = newFetcher(s.cfg)
+	}
+	if s.cfg.JWKSURL != "" {
+		s.jwt = newJWTVerifier(s.cfg.JWKSURL, s.cfg.JWTIssuer, s.cfg.JWTAudience, s.cfg.JWKSRefresh)
+	}
+	// Always built, even when RATE_LIMIT_RPS is 0, so a reload can enable it.
+	s.limiter = newRateLimiter(s.cfg.RateLimitRPS, s.cfg.RateLimitBurst)
+	live, err := s.cfg.live()
+	if err != nil {
+		slog.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	s.applyConfig(s.cfg, live)
+	mux.Handle("/preprocess", s.cors(s.imageRoute(querySemicolons(http.HandlerFunc(s.preprocessHandler)), s.authenticate, true)))
+	for _, rt := range []struct {
+		path, feature string
+		h             http.HandlerFunc
+		quota         bool
+	}{
+		{"/sprite", "sprite", s.spriteHandler, true},
+		{"/archive", "archive", s.archiveHandler, true},
+		{"/compare/side-by-side", "compare", s.compareHandler, true},
+		{"/validate", "validate", s.validateHandler, false},
+	} {
+		if s.enabled(rt.feature) {
+			mux.Handle(rt.path, s.cors(s.imageRoute(s.gate(rt.feature, rt.h), s.authenticate, rt.quota)))
+		}
+	}
+	if s.enabled("usage") {
+		mux.Handle("/usage", chain(s.gate("usage", s.usageHandler), s.cors, logging(0), s.ipFilter, s.authenticate, s.scopeTenant, compress))
+	}
+
+	var root http.Handler = mux
+	if s.enabled("thumbor") && (s.cfg.ThumborSecurityKey != "" || s.cfg.ThumborAllowUnsafe) {
+		if s.fetcher == nil {
+			slog.Error("Thumbor URLs need URL_FETCH")
+			os.Exit(1)
+		}
+		if s.cfg.ThumborAllowUnsafe && !s.authConfigured() {
+			slog.Error("THUMBOR_ALLOW_UNSAFE needs authentication configured")
+			os.Exit(1)
+		}
+		root = thumborRouter(s.cfg.ThumborPathPrefix, s.imageRoute(s.gate("thumbor", s.thumborHandler), s.thumborAuth, true), mux)
+	}
+
+	addr := s.cfg.Addr
+	handler := accessLog(s.cfg.AccessLog, root)
+	if s.cfg.H2C {
+		// Cleartext HTTP/2 for load balancers that speak h2 to backends
+		// without TLS; HTTP/1.1 clients are still served as before.
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: s.cfg.IdleTimeout})
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       s.cfg.ReadTimeout,
+		ReadHeaderTimeout: s.cfg.ReadHeaderTimeout,
+		WriteTimeout:      s.cfg.WriteTimeout,
+		IdleTimeout:       s.cfg.IdleTimeout,
+	}
+	if srv.TLSConfig, err = s.tlsConfig(); err != nil {
+		slog.Error("tls setup failed", "err", err)
+		os.Exit(1)
+	}
 
-	addr := ":8080"
-	log.Println("preprocess-go listening on", addr)
-	log.Fatal(http.ListenAndServe(addr, mux))
+	// On SIGTERM stop accepting connections but let in-flight images finish,
+	// so a rolling deploy doesn't reset uploads mid-encode.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		s.draining.Store(true)
+		slog.Info("shutting down, draining in-flight requests", "timeout", s.cfg.ShutdownTimeout.String())
+		drainCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(drainCtx); err != nil {
+			slog.Error("shutdown incomplete", "err", err)
+		}
+	}()
+
+	if s.cfg.SecretsRefresh > 0 && s.rotatableCredentials() {
+		go s.rotateCredentials(ctx)
+	}
+
+	if s.watcher != nil {
+		go s.watcher.watch(ctx, s)
+	}
+
+	if s.cfg.AdminAddr != "" {
+		if err := s.startAdminServer(ctx, s.cfg.AdminAddr); err != nil {
+			slog.Error("admin listener failed", "addr", s.cfg.AdminAddr, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if s.cfg.DebugAddr != "" && s.enabled("debug") {
+		startDebugServer(s.cfg.DebugAddr)
+	}
+
+	ln, err := listen(addr, s.cfg.UnixSocketMode)
+	if err != nil {
+		slog.Error("listen failed", "addr", addr, "err", err)
+		os.Exit(1)
+	}
+	slog.Info("preprocess-go listening", "addr", addr, "tls", srv.TLSConfig != nil)
+	serve := func() error { return srv.Serve(ln) }
+	if srv.TLSConfig != nil {
+		serve = func() error { return srv.ServeTLS(ln, "", "") }
+	}
+	if err := serve(); !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("server failed", "err", err)
+		os.Exit(1)
+	}
+	// Serve returns as soon as Shutdown starts; wait for the drain.
+	<-drained
 }
 
-func preprocessHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) preprocessHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		reject(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "POST only")
 		return
 	}
 
-	// Optional tuning via query params
-	maxDim := intParam(r, "max_dim", defaultMaxDim)
-	jpegQ := intParam(r, "quality", defaultJpegQ)
-	if maxDim < 256 {
-		maxDim = 256
+	live := s.live.Load()
+	p, err := s.preprocessParams(r, live)
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "invalid_param", err.Error())
+		return
 	}
-	if maxDim > 3000 {
-		maxDim = 3000
+	st := s.stores[p.store]
+	switch {
+	case p.store != "" && st == nil:
+		reject(w, r, http.StatusBadRequest, "store_disabled", p.store+" uploads are not configured")
+		return
+	case p.dishID != "" && s.dishes == nil:
+		reject(w, r, http.StatusBadRequest, "callback_disabled", "dish_id needs BACKEND_URL")
+		return
+	case p.video != "" && (s.cfg.FFmpegPath == "" || !s.serving("video")):
+		reject(w, r, http.StatusBadRequest, "video_disabled", "GIF to video conversion is not configured")
+		return
+	case p.opts.blurFaces && s.faces == nil:
+		reject(w, r, http.StatusBadRequest, "face_detect_disabled", "face blurring is not configured")
+		return
 	}
-	if jpegQ < 40 {
-		jpegQ = 40
+
+	origBytes, origCT, ok := s.readInput(w, r)
+	if !ok || !s.scanInput(w, r, origBytes) {
+		return
 	}
-	if jpegQ > 95 {
-		jpegQ = 95
+	inputLen := len(origBytes)
+	inputBytes.add(float64(inputLen))
+	inputHash := hashHex(origBytes)
+	setInputHeaders(w, inputHash, inputLen)
+	logAttrs(r.Context(), "input_bytes", inputLen)
+	if cam := readCamera(origBytes); cam != nil {
+		setCamera(r.Context(), cam)
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
-	if err := r.ParseMultipartForm(maxUploadBytes); err != nil {
-		http.Error(w, "failed to parse multipart form", http.StatusBadRequest)
+	withFFmpeg := s.cfg.FFmpegPath != "" && s.serving("video")
+	fromVideo, fromHEIF := withFFmpeg && isVideo(origBytes), withFFmpeg && isHEIF(origBytes)
+	fromJP2 := withFFmpeg && isJPEG2000(origBytes)
+	fromPDF := s.cfg.PdftoppmPath != "" && isPDF(origBytes)
+	if err := checkParams(
+		paramCheck{p.page > 0 && !fromPDF && !isTIFF(origBytes), "page needs a TIFF or PDF upload"},
+		paramCheck{p.dryRun && (fromVideo || fromHEIF || fromJP2 || fromPDF), "dry_run can't be combined with tiles or video, or preview video, HEIC, JPEG 2000 and PDF uploads"},
+		paramCheck{p.video != "" && (fromVideo || http.DetectContentType(origBytes) != "image/gif"), "video needs a GIF upload"},
+	); err != nil {
+		reject(w, r, http.StatusBadRequest, "invalid_param", err.Error())
 		return
 	}
+	if p.focus != nil {
+		logAttrs(r.Context(), "focus_box", r.URL.Query().Get("focus_box"))
+	}
+	if st != nil {
+		logAttrs(r.Context(), "store", p.store)
+	}
+	if p.dishID != "" {
+		logAttrs(r.Context(), "dish_id", p.dishID)
+	}
+	if p.video != "" {
+		logAttrs(r.Context(), "video", p.video)
+	}
+	if p.file != "" && st == nil {
+		// Checked by readInput already.
+		input, _ := s.sidecarPath(p.file)
+		st = &sidecarStore{dir: s.sidecarDir, input: input}
+	}
+	if p.opts.sanitize {
+		// Re-encoding from decoded pixels is what strips metadata: the
+		// encoders write no EXIF/XMP/ICC or ancillary chunks at all.
+		w.Header().Set("X-Sanitized", "true")
+		logAttrs(r.Context(), "sanitize", "strict")
+	}
 
-	file, fh, err := r.FormFile("image")
-	if err != nil {
-		http.Error(w, "missing form field 'image'", http.StatusBadRequest)
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ProcessTimeout)
+	defer cancel()
+	opts := p.opts
+
+	// A video's frame, a HEIF's still or a PDF's page stands in for the
+	// upload from here on; the headers, logs and quota charge still
+	// describe the upload.
+	cacheHash := inputHash
+	if isTIFF(origBytes) {
+		pages, b, err := tiffPage(origBytes, p.page)
+		if pages > 0 {
+			w.Header().Set("X-Page-Count", strconv.Itoa(pages))
+		}
+		if err != nil {
+			s.writeJobError(w, r, err)
+			return
+		}
+		logAttrs(r.Context(), "pages", pages, "page", max(p.page, 1))
+		if p.page > 1 {
+			origBytes, cacheHash = b, hashHex(b)
+		}
+		origCT = "image/tiff"
+	}
+	if fromVideo || fromHEIF || fromJP2 || fromPDF {
+		var still []byte
+		var pages int
+		err := s.runJob(ctx, func(ctx context.Context) (err error) {
+			switch {
+			case fromPDF:
+				pages, still, err = s.pdfPage(ctx, origBytes, p.page, live.maxDim)
+			case fromHEIF:
+				still, err = s.heifStill(ctx, origBytes)
+			case fromJP2:
+				still, err = s.jp2Still(ctx, origBytes)
+			default:
+				still, err = s.videoFrame(ctx, origBytes, p.frameMode)
+			}
+			return err
+		})
+		if err != nil {
+			if errors.Is(err, errPageRange) {
+				w.Header().Set("X-Page-Count", strconv.Itoa(pages))
+			}
+			s.writeJobError(w, r, err)
+			return
+		}
+		if fromPDF {
+			w.Header().Set("X-Page-Count", strconv.Itoa(pages))
+		}
+		origBytes, origCT = still, "image/png"
+		opts.forceEncode = true
+		cacheHash = hashHex(still)
+	}
+	if !checkMinSize(w, r, origBytes, origCT, p.atLeast) {
 		return
 	}
-	defer file.Close()
+	if opts.trim, ok = s.photoAspect(w, r, origBytes, origCT); !ok {
+		return
+	}
+	opts.forceEncode = opts.forceEncode || opts.edits()
+	if p.dryRun {
+		s.writeDryRun(w, r, origBytes, origCT, p.sizes, p.crops, p.focus, opts)
+		return
+	}
+	if !fromVideo && !fromHEIF && !fromJP2 && !fromPDF {
+		sc, err := s.detectScreenshot(ctx, origBytes, origCT)
+		if err != nil {
+			s.writeJobError(w, r, err)
+			return
+		}
+		flagScreenshot(w, r, sc)
+	}
 
-	// Read all bytes
-	origBytes, err := io.ReadAll(file)
-	if err != nil {
-		http.Error(w, "failed to read upload", http.StatusBadRequest)
+	if p.video != "" {
+		var res *result
+		err := s.runJob(ctx, func(ctx context.Context) (err error) {
+			res, err = s.transcodeGIF(ctx, origBytes, p.video, opts.maxDim)
+			return err
+		})
+		if err != nil {
+			s.writeJobError(w, r, err)
+			return
+		}
+		logAttrs(r.Context(), "output_format", res.ct, "output_width", res.width, "output_height", res.height,
+			"output_bytes", len(res.body))
+		set := []*result{res}
+		if !s.writeOutputs(w, r, st, set, false) {
+			return
+		}
+		s.completed(r, inputHash, inputLen, 1, set)
+		return
+	}
+
+	if p.tiles {
+		var set []*result
+		err := s.runJob(ctx, func(ctx context.Context) (err error) {
+			set, err = s.processTiles(ctx, origBytes, origCT, opts)
+			return err
+		})
+		if err != nil {
+			s.writeJobError(w, r, err)
+			return
+		}
+		defer releaseAll(set)
+		logAttrs(r.Context(), "outputs", len(set))
+		s.writeOutputs(w, r, nil, set, true)
+		s.completed(r, inputHash, inputLen, 1, set)
 		return
 	}
 
-	origCT := sniffContentType(origBytes, fh)
+	if len(p.crops) > 0 {
+		var set []*result
+		err := s.runJob(ctx, func(ctx context.Context) (err error) {
+			set, err = s.processCrops(ctx, origBytes, origCT, p.crops, p.smartCrop, p.focus, opts)
+			return err
+		})
+		if err != nil {
+			s.writeJobError(w, r, err)
+			return
+		}
+		defer releaseAll(set)
+		if set, ok = s.withOriginal(ctx, w, r, set, origBytes, origCT, opts); !ok {
+			return
+		}
+		defer releaseAll(set)
+		logAttrs(r.Context(), "outputs", len(set))
+		if !s.writeOutputs(w, r, st, set, true) {
+			return
+		}
+		s.completed(r, inputHash, inputLen, len(set), set)
+		return
+	}
 
-	img, ct, err := decodeImage(origBytes, origCT)
+	if len(p.sizes) > 0 {
+		var set []*result
+		err := s.runJob(ctx, func(ctx context.Context) (err error) {
+			set, err = s.processSizes(ctx, origBytes, origCT, p.sizes, opts)
+			return err
+		})
+		if err != nil {
+			s.writeJobError(w, r, err)
+			return
+		}
+		defer releaseAll(set)
+		if set, ok = s.withOriginal(ctx, w, r, set, origBytes, origCT, opts); !ok {
+			return
+		}
+		defer releaseAll(set)
+		logAttrs(r.Context(), "outputs", len(set))
+		if !s.writeOutputs(w, r, st, set, true) {
+			return
+		}
+		s.completed(r, inputHash, inputLen, len(set), set)
+		return
+	}
+
+	var key string
+	if s.cache != nil {
+		key = cacheKey(cacheHash, origCT, opts)
+		if res, ok := s.cache.Get(ctx, key); ok {
+			cacheLookups.inc("hit")
+			logAttrs(r.Context(), "cache", "hit")
+			w.Header().Set("X-Cache", "HIT")
+			set, ok := s.withOriginal(ctx, w, r, []*result{res}, origBytes, origCT, opts)
+			if !ok {
+				return
+			}
+			defer releaseAll(set)
+			if !s.writeOutputs(w, r, st, set, false) {
+				return
+			}
+			s.completed(r, inputHash, inputLen, len(set), set)
+			return
+		}
+		cacheLookups.inc("miss")
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	var res *result
+	err = s.runJob(ctx, func(ctx context.Context) (err error) {
+		res, err = s.process(ctx, origBytes, origCT, opts)
+		return err
+	})
 	if err != nil {
-		http.Error(w, "unsupported or invalid image", http.StatusBadRequest)
+		s.writeJobError(w, r, err)
 		return
 	}
+	defer res.release()
+
+	if s.cache != nil {
+		s.cache.Set(ctx, key, res)
+	}
+	logAttrs(r.Context(), "output_format", res.ct, "output_width", res.width, "output_height", res.height,
+		"output_bytes", len(res.body), "passthrough", res.passthrough)
+	if res.passthrough {
+		logAttrs(r.Context(), "passthrough_reason", res.reason)
+	}
+	set, ok := s.withOriginal(ctx, w, r, []*result{res}, origBytes, origCT, opts)
+	if !ok {
+		return
+	}
+	defer releaseAll(set)
+	if !s.writeOutputs(w, r, st, set, false) {
+		return
+	}
+	s.completed(r, inputHash, inputLen, len(set), set)
+}
+
+// completed does the post-response bookkeeping for a successful request.
+// images is what the caller's quota is charged: one per output, except that
+// a whole tile pyramid counts as one.
+func (s *server) completed(r *http.Request, inputHash string, inputLen, images int, outputs []*result) {
+	stats.recordProcessed(inputLen, outputs)
+	tenant := tenantName(r.Context())
+	if tenant != "" {
+		tenantImages.add(float64(images), tenant)
+	}
+	if s.quotas != nil {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), redisTimeout)
+		if name := callerName(r.Context()); name != "" {
+			s.quotas.charge(ctx, name, int64(images), int64(inputLen))
+		}
+		if tenant != "" {
+			s.quotas.charge(ctx, "@"+tenant, int64(images), int64(inputLen))
+		}
+		cancel()
+	}
+	s.audit(r, inputHash, inputLen, outputs)
+	s.catalogOutputs(r, inputHash, inputLen, outputs)
+	s.publishProcessed(r, inputHash, inputLen, outputs)
+	s.updateDish(r, inputHash, outputs)
+}
+
+// runJob runs fn on a worker slot. fn runs in its own goroutine so a stuck
+// decode or resize can't hold the response past the deadline; the pipeline
+// notices the cancelled context at the next stage boundary and stops there.
+func (s *server) runJob(ctx context.Context, fn func(context.Context) error) error {
+	queued := time.Now()
+	job := s.jobs.add(ctx)
+	lane, client := schedule(ctx)
+	if err := s.pool.acquire(ctx, lane, client); err != nil {
+		s.jobs.done(job)
+		return err
+	}
+	recordStage(ctx, "queue", time.Since(queued))
+	s.jobs.start(job)
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer s.jobs.done(job)
+		defer s.pool.release()
+		defer func() {
+			if v := recover(); v != nil {
+				err = newPanicError(v)
+			}
+		}()
+		err = fn(ctx)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *server) writeJobError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errOverloaded):
+		w.Header().Set("Retry-After", "1")
+		reject(w, r, http.StatusServiceUnavailable, "overloaded", "server busy, retry shortly")
+	case errors.Is(err, errTooManyPixels):
+		rejectJSON(w, r, http.StatusRequestEntityTooLarge, "too_many_pixels",
+			fmt.Sprintf("image exceeds %d pixel limit", s.cfg.MaxPixels), map[string]any{"limit_pixels": s.cfg.MaxPixels})
+	case errors.Is(err, errAspectRatio):
+		reject(w, r, http.StatusUnprocessableEntity, "aspect_ratio_exceeded",
+			fmt.Sprintf("image aspect ratio exceeds %g:1 limit", s.cfg.MaxAspectRatio))
+	case errors.Is(err, errBlankImage):
+		reject(w, r, http.StatusUnprocessableEntity, "blank_image", "image is blank or nearly uniform")
+	case errors.Is(err, errFaceDetect):
+		slog.Warn("face detection failed", "request_id", requestID(r.Context()), "err", err)
+		reject(w, r, http.StatusServiceUnavailable, "face_detect_unavailable", "face detector unavailable")
+	case errors.Is(err, errUnsupportedImage):
+		reject(w, r, http.StatusBadRequest, "unsupported_format", "unsupported or invalid image")
+	case errors.Is(err, errTranscode):
+		slog.Warn("transcode failed", "request_id", requestID(r.Context()), "err", err)
+		reject(w, r, http.StatusUnprocessableEntity, "transcode_failed", "the upload could not be converted")
+	case errors.Is(err, errPageRange):
+		reject(w, r, http.StatusBadRequest, "page_out_of_range", err.Error())
+	case r.Context().Err() != nil:
+		// Client went away; nobody to answer.
+		rejections.inc("client_gone")
+		setOutcome(r.Context(), "client_gone")
+	case errors.Is(err, context.DeadlineExceeded):
+		reject(w, r, http.StatusServiceUnavailable, "timeout", "image processing timed out")
+	default:
+		var stack string
+		var perr *panicError
+		if errors.As(err, &perr) {
+			stack = perr.stack
+		}
+		slog.Error("processing failed", "request_id", requestID(r.Context()), "err", err)
+		s.reportError(r, err, stack)
+		msg := err.Error()
+		if perr != nil {
+			msg = "internal error"
+		}
+		reject(w, r, http.StatusInternalServerError, "internal_error", msg)
+	}
+}
+
+func writeResult(w http.ResponseWriter, res *result) {
+	w.Header().Set("Content-Type", res.ct)
+	w.Header().Set("X-Original-Content-Type", res.origCT)
+	w.Header().Set("X-Image-Width", strconv.Itoa(res.width))
+	w.Header().Set("X-Image-Height", strconv.Itoa(res.height))
+	w.Header().Set("X-Object-Name", res.objectName())
+	w.Header().Set("X-Content-SHA256", res.digest())
+	setSizeHeaders(textproto.MIMEHeader(w.Header()), w.Header(), res)
+	if res.passthrough {
+		w.Header().Set("X-Passthrough", "true")
+		w.Header().Set("X-Passthrough-Reason", res.reason)
+	}
+	w.WriteHeader(http.StatusOK)
+	n, _ := w.Write(res.body)
+	outputBytes.add(float64(n))
+}
+
+// setInputHeaders describes the single input a response was made from.
+func setInputHeaders(w http.ResponseWriter, hash string, n int) {
+	w.Header().Set("X-Input-SHA256", hash)
+	w.Header().Set("X-Original-Bytes", strconv.Itoa(n))
+}
 
-	// Downscale if needed
-	resized := downscale(img, maxDim)
+// setSizeHeaders sets X-Output-Bytes on h, and X-Compression-Ratio (output
+// over input, so 0.22 means 78% saved) when the response has a single input
+// whose size setInputHeaders recorded in resp.
+func setSizeHeaders(h textproto.MIMEHeader, resp http.Header, res *result) {
+	h.Set("X-Output-Bytes", strconv.Itoa(len(res.body)))
+	if in, err := strconv.Atoi(resp.Get("X-Original-Bytes")); err == nil && in > 0 {
+		h.Set("X-Compression-Ratio", strconv.FormatFloat(float64(len(res.body))/float64(in), 'f', 4, 64))
+	}
+}
 
-	// Decide output format:
-	// - If alpha exists => PNG (preserve transparency)
-	// - Else => JPEG (smaller for photos)
-	hasAlpha := imageHasAlpha(resized)
-	var out bytes.Buffer
-	var outCT string
+// writeOutputs answers with set, uploaded to st when store= asked for it,
+// zipped for bundle=zip, and otherwise as the image itself or, when multi,
+// multipart/mixed. It
+// reports false if it answered with an error instead.
+func (s *server) writeOutputs(w http.ResponseWriter, r *http.Request, st imageStore, set []*result, multi bool) bool {
+	zipped, _, _ := bundleParam(r)
+	switch {
+	case st != nil:
+		return s.writeStored(w, r, st, set)
+	case zipped:
+		writeZip(w, set)
+	case acceptsTar(r):
+		writeTar(w, set)
+	case multi:
+		writeResultSet(w, set)
+	default:
+		writeResult(w, set[0])
+	}
+	return true
+}
 
-	if hasAlpha {
-		outCT = "image/png"
-		enc := png.Encoder{CompressionLevel: png.BestCompression}
-		if err := enc.Encode(&out, resized); err != nil {
-			http.Error(w, "failed to encode png", http.StatusInternalServerError)
+// writeResultSet answers a multi-size or tiles request as multipart/mixed,
+// one part per output in order.
+func writeResultSet(w http.ResponseWriter, set []*result) {
+	mw := multipart.NewWriter(w)
+	_ = mw.SetBoundary(contentBoundary(set))
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.Header().Set("X-Original-Content-Type", set[0].origCT)
+	w.WriteHeader(http.StatusOK)
+	for _, res := range set {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", res.ct)
+		h.Set("X-Image-Width", strconv.Itoa(res.width))
+		h.Set("X-Image-Height", strconv.Itoa(res.height))
+		h.Set("X-Object-Name", res.objectName())
+		h.Set("X-Content-SHA256", res.digest())
+		setSizeHeaders(h, w.Header(), res)
+		if res.passthrough {
+			h.Set("X-Passthrough", "true")
+			h.Set("X-Passthrough-Reason", res.reason)
+		}
+		if res.name != "" {
+			h.Set("Content-Location", res.name)
+		}
+		part, err := mw.CreatePart(h)
+		if err != nil {
 			return
 		}
-	} else {
-		outCT = "image/jpeg"
-		if err := jpeg.Encode(&out, resized, &jpeg.Options{Quality: jpegQ}); err != nil {
-			http.Error(w, "failed to encode jpeg", http.StatusInternalServerError)
+		n, err := part.Write(res.body)
+		outputBytes.add(float64(n))
+		if err != nil {
 			return
 		}
 	}
+	_ = mw.Close()
+}
 
-	bounds := resized.Bounds()
-	w.Header().Set("Content-Type", outCT)
-	w.Header().Set("X-Original-Content-Type", ct)
-	w.Header().Set("X-Image-Width", strconv.Itoa(bounds.Dx()))
-	w.Header().Set("X-Image-Height", strconv.Itoa(bounds.Dy()))
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(out.Bytes())
+// contentBoundary derives the multipart boundary from the outputs instead
+// of picking a random one, so the same outputs make the same response body
+// and CDNs can cache and dedupe it like a single image.
+func contentBoundary(set []*result) string {
+	var digests []byte
+	for _, res := range set {
+		digests = append(digests, res.digest()...)
+	}
+	return hashHex(digests)[:40]
 }
 
 func intParam(r *http.Request, key string, def int) int {
@@ -132,102 +946,374 @@ func intParam(r *http.Request, key string, def int) int {
 	return n
 }
 
-func sniffContentType(b []byte, fh *multipart.FileHeader) string {
-	// Prefer browser-provided extension hint; else sniff.
-	name := strings.ToLower(fh.Filename)
+// sizesParam parses sizes=320,640,1280 for thumbnail-set mode. Each entry is
+// a max dimension, clamped like max_dim.
+func sizesParam(r *http.Request, lo, hi int) ([]int, error) {
+	v := r.URL.Query().Get("sizes")
+	if v == "" {
+		return nil, nil
+	}
+	parts := strings.Split(v, ",")
+	if len(parts) > maxSizes {
+		return nil, fmt.Errorf("at most %d sizes per request", maxSizes)
+	}
+	sizes := make([]int, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q", p)
+		}
+		sizes = append(sizes, min(max(n, lo), hi))
+	}
+	return sizes, nil
+}
+
+// scanInput runs the malware hook before any decoder sees the bytes. A
+// scanner outage fails closed unless MALWARE_SCAN_FAIL_OPEN is set.
+func (s *server) scanInput(w http.ResponseWriter, r *http.Request, b []byte) bool {
+	reason, err := s.scanUpload(r, b)
 	switch {
-	case strings.HasSuffix(name, ".jpg"), strings.HasSuffix(name, ".jpeg"):
-		return "image/jpeg"
-	case strings.HasSuffix(name, ".png"):
-		return "image/png"
-	case strings.HasSuffix(name, ".webp"):
-		return "image/webp"
-	default:
-		return http.DetectContentType(b)
-	}
-}
-
-func decodeImage(b []byte, ct string) (image.Image, string, error) {
-	// Allow only jpg/jpeg/png/webp
-	switch ct {
-	case "image/jpeg", "image/jpg":
-		img, err := jpeg.Decode(bytes.NewReader(b))
-		return img, "image/jpeg", err
-	case "image/png":
-		img, err := png.Decode(bytes.NewReader(b))
-		return img, "image/png", err
-	case "image/webp":
-		img, err := webp.Decode(bytes.NewReader(b))
-		return img, "image/webp", err
-	default:
-		// Sometimes sniff returns "application/octet-stream"; try decode based on content too
-		// but still restrict to supported decoders:
-		if img, err := jpeg.Decode(bytes.NewReader(b)); err == nil {
-			return img, "image/jpeg", nil
+	case reason != "":
+		reject(w, r, http.StatusUnprocessableEntity, "malware_detected", "upload rejected by malware scan")
+		return false
+	case err != nil && r.Context().Err() != nil:
+		setOutcome(r.Context(), "client_gone")
+		return false
+	case err != nil:
+		reject(w, r, http.StatusServiceUnavailable, "scan_unavailable", "malware scanner unavailable")
+		return false
+	}
+	return true
+}
+
+// scanUpload is scanInput without the response: it returns the scanner's
+// reason for flagging b, or an error if the scan couldn't be done and
+// MALWARE_SCAN_FAIL_OPEN doesn't let b through anyway.
+func (s *server) scanUpload(r *http.Request, b []byte) (string, error) {
+	if s.scanner == nil {
+		return "", nil
+	}
+	start := time.Now()
+	err := s.scanner.scan(r.Context(), b)
+	recordStage(r.Context(), "scan", time.Since(start))
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.Is(err, errMalwareFound):
+		reason := strings.TrimPrefix(err.Error(), errMalwareFound.Error()+": ")
+		logAttrs(r.Context(), "malware", reason)
+		s.alertFlagged(r, reason, b)
+		return reason, nil
+	case r.Context().Err() != nil:
+		return "", r.Context().Err()
+	}
+	slog.Warn("malware scan failed", "request_id", requestID(r.Context()), "err", err)
+	if s.cfg.MalwareScanFailOpen {
+		logAttrs(r.Context(), "malware_scan", "skipped")
+		return "", nil
+	}
+	return "", err
+}
+
+// uploadLimit is the request body cap for the caller: its UPLOAD_LIMITS
+// override when authenticated with one, else MAX_UPLOAD_BYTES.
+func (s *server) uploadLimit(ctx context.Context) int64 {
+	if n, ok := s.uploadLimits[callerName(ctx)]; ok {
+		return n
+	}
+	return s.cfg.MaxUploadBytes
+}
+
+// maxUploadLimit is the largest cap any caller has, for code that must
+// bound a body before the caller is known.
+func (s *server) maxUploadLimit() int64 {
+	m := s.cfg.MaxUploadBytes
+	for _, n := range s.uploadLimits {
+		if n > m {
+			m = n
 		}
-		if img, err := png.Decode(bytes.NewReader(b)); err == nil {
-			return img, "image/png", nil
+	}
+	return m
+}
+
+// parseUploadLimits reads "name:bytes" entries keyed by caller name (API key
+// name, "cert:<cn>", "hmac:<id>" or "jwt:<sub>").
+func parseUploadLimits(v string) (map[string]int64, error) {
+	limits := map[string]int64{}
+	for _, e := range splitList(v) {
+		// Split on the last ':' since names like "cert:backend" contain one.
+		i := strings.LastIndex(e, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q: want name:bytes", e)
 		}
-		if img, err := webp.Decode(bytes.NewReader(b)); err == nil {
-			return img, "image/webp", nil
+		limit, err := strconv.ParseInt(e[i+1:], 10, 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("%q: want name:bytes", e)
 		}
-		return nil, "", io.ErrUnexpectedEOF
+		limits[e[:i]] = limit
 	}
+	return limits, nil
 }
 
-func downscale(src image.Image, maxDim int) image.Image {
-	b := src.Bounds()
-	w := b.Dx()
-	h := b.Dy()
+func (s *server) rejectTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	rejectJSON(w, r, http.StatusRequestEntityTooLarge, "upload_too_large",
+		fmt.Sprintf("upload exceeds the %s limit", humanBytes(limit)), map[string]any{"limit_bytes": limit})
+}
 
-	longest := w
-	if h > longest {
-		longest = h
+// humanBytes formats a limit the way people write it: 10MB, 512KB, 1.5GB.
+func humanBytes(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
 	}
-	if longest <= maxDim {
-		return src // no upscaling
+	v, suffix := float64(n), "B"
+	for _, s := range []string{"KB", "MB", "GB"} {
+		if v < unit {
+			break
+		}
+		v, suffix = v/unit, s
 	}
+	return strconv.FormatFloat(math.Round(v*10)/10, 'f', -1, 64) + suffix
+}
 
-	var nw, nh int
-	if w >= h {
-		nw = maxDim
-		nh = int(float64(h) * (float64(maxDim) / float64(w)))
-	} else {
-		nh = maxDim
-		nw = int(float64(w) * (float64(maxDim) / float64(h)))
+// readInput returns the image to process and its content type: the
+// multipart "image" upload, the ?file= in SIDECAR_DIR, or with URL fetching
+// enabled, the body of the ?url= the caller names. On failure it has already
+// written the response.
+func (s *server) readInput(w http.ResponseWriter, r *http.Request) ([]byte, string, bool) {
+	if rel := r.URL.Query().Get("file"); rel != "" {
+		return s.readSidecarFile(w, r, rel)
+	}
+	if u := r.URL.Query().Get("url"); u != "" {
+		if s.fetcher == nil || !s.serving("url_fetch") {
+			reject(w, r, http.StatusBadRequest, "url_fetch_disabled", "URL fetching is disabled")
+			return nil, "", false
+		}
+		start := time.Now()
+		b, err := s.fetcher.fetch(r.Context(), u)
+		recordStage(r.Context(), "fetch", time.Since(start))
+		if err != nil {
+			s.writeFetchError(w, r, err)
+			return nil, "", false
+		}
+		b = motionStill(r.Context(), b)
+		return b, http.DetectContentType(b), true
 	}
-	if nw < 1 {
-		nw = 1
+
+	uploadStart := time.Now()
+	if !s.parseUpload(w, r) {
+		return nil, "", false
+	}
+	b, ct, ok := s.formImage(w, r, "image")
+	recordStage(r.Context(), "upload", time.Since(uploadStart))
+	return b, ct, ok
+}
+
+// formImage reads one file field of an already parsed upload. On failure it
+// has already written the response.
+func (s *server) formImage(w http.ResponseWriter, r *http.Request, field string) ([]byte, string, bool) {
+	file, fh, err := r.FormFile(field)
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "missing_image", fmt.Sprintf("missing form field '%s'", field))
+		return nil, "", false
 	}
-	if nh < 1 {
-		nh = 1
+	defer file.Close()
+
+	b, err := io.ReadAll(file)
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "malformed_upload", "failed to read upload")
+		return nil, "", false
 	}
+	b = motionStill(r.Context(), b)
+	ct, ok := s.uploadType(w, r, b, fh)
+	return b, ct, ok
+}
 
-	dst := image.NewRGBA(image.Rect(0, 0, nw, nh))
-	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
-	return dst
+// parseUpload reads the multipart body within the caller's upload limit.
+// On failure it has already written the response.
+func (s *server) parseUpload(w http.ResponseWriter, r *http.Request) bool {
+	return s.parseUploadWithin(w, r, s.uploadLimit(r.Context()))
 }
 
-func imageHasAlpha(img image.Image) bool {
-	// Cheap check: sample pixels in a grid; if any alpha < 255, treat as alpha.
-	b := img.Bounds()
-	stepX := max(1, b.Dx()/40)
-	stepY := max(1, b.Dy()/40)
+// parseUploadWithin is parseUpload with an explicit limit.
+func (s *server) parseUploadWithin(w http.ResponseWriter, r *http.Request, limit int64) bool {
+	if r.ContentLength > limit {
+		// Declared too large: answer before reading any of it, and drop
+		// the connection rather than drain the rest.
+		w.Header().Set("Connection", "close")
+		s.rejectTooLarge(w, r, limit)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	if !s.decodeBody(w, r, limit) {
+		return false
+	}
+	if err := r.ParseMultipartForm(limit); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.rejectTooLarge(w, r, limit)
+			return false
+		}
+		reject(w, r, http.StatusBadRequest, "malformed_upload", "failed to parse multipart form")
+		return false
+	}
+	return true
+}
 
-	for y := b.Min.Y; y < b.Max.Y; y += stepY {
-		for x := b.Min.X; x < b.Max.X; x += stepX {
-			_, _, _, a := img.At(x, y).RGBA()
-			if a != 0xffff {
-				return true
+// decodeBody undoes a gzip Content-Encoding, which server-to-server callers
+// use for PNG-heavy uploads. The decompressed body is held to limit as well,
+// so a small gzip bomb is a 413 like any other oversized upload. On failure
+// it has already written the response.
+func (s *server) decodeBody(w http.ResponseWriter, r *http.Request, limit int64) bool {
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return true
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				s.rejectTooLarge(w, r, limit)
+			} else {
+				reject(w, r, http.StatusBadRequest, "malformed_upload", "request body is not valid gzip")
 			}
+			return false
 		}
+		logAttrs(r.Context(), "content_encoding", enc)
+		r.Body = http.MaxBytesReader(w, zr, limit)
+		r.Header.Del("Content-Encoding")
+		return true
+	default:
+		w.Header().Set("Accept-Encoding", "gzip")
+		reject(w, r, http.StatusUnsupportedMediaType, "unsupported_encoding", fmt.Sprintf("Content-Encoding %q is not supported; use gzip or none", enc))
+		return false
+	}
+}
+
+// uploadType picks the content type for one uploaded file, enforcing
+// STRICT_CONTENT_TYPE. On failure it has already written the response.
+func (s *server) uploadType(w http.ResponseWriter, r *http.Request, b []byte, fh *multipart.FileHeader) (string, bool) {
+	ct := sniffContentType(b, fh)
+	if s.cfg.StrictContentType {
+		sniffed := detectContentType(b)
+		if claimed := claimedContentType(fh); claimed != "" && claimed != sniffed {
+			logAttrs(r.Context(), "claimed_type", claimed, "sniffed_type", sniffed)
+			reject(w, r, http.StatusUnsupportedMediaType, "content_type_mismatch",
+				fmt.Sprintf("upload is named/labelled %s but its content is %s", claimed, sniffed))
+			return "", false
+		}
+		ct = sniffed
 	}
-	return false
+	return ct, true
 }
 
-func max(a, b int) int {
-	if a > b {
-		return a
+// sanitizeParam reports whether the output must be a fresh re-encode, never
+// the uploaded bytes. SANITIZE=strict forces it for every request.
+func (s *server) sanitizeParam(r *http.Request) (bool, error) {
+	if s.cfg.Sanitize == "strict" {
+		return true, nil
+	}
+	switch v := r.URL.Query().Get("sanitize"); v {
+	case "", "off":
+		return false, nil
+	case "strict":
+		return true, nil
+	default:
+		return false, fmt.Errorf("sanitize must be strict or off, got %q", v)
+	}
+}
+
+// boolParam reads an optional name=true|false query param.
+func boolParam(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false, got %q", name, v)
+	}
+	return b, nil
+}
+
+// privacyParam reads privacy=faces.
+func privacyParam(r *http.Request) (bool, error) {
+	switch v := r.URL.Query().Get("privacy"); v {
+	case "":
+		return false, nil
+	case "faces":
+		return true, nil
+	default:
+		return false, fmt.Errorf("privacy must be faces, got %q", v)
+	}
+}
+
+// tilesParam reads tiles=dzi, the only pyramid layout so far.
+func tilesParam(r *http.Request) (bool, error) {
+	switch v := r.URL.Query().Get("tiles"); v {
+	case "":
+		return false, nil
+	case "dzi":
+		if r.URL.Query().Has("sizes") {
+			return false, fmt.Errorf("tiles and sizes can't be combined")
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("tiles must be dzi, got %q", v)
+	}
+}
+
+// depthParam reads depth=8|16; 16 asks for 16-bit PNG inputs to stay 16-bit.
+func depthParam(r *http.Request) (bool, error) {
+	switch v := r.URL.Query().Get("depth"); v {
+	case "", "8":
+		return false, nil
+	case "16":
+		return true, nil
+	default:
+		return false, fmt.Errorf("depth must be 8 or 16, got %q", v)
+	}
+}
+
+func sniffContentType(b []byte, fh *multipart.FileHeader) string {
+	// Prefer browser-provided extension hint; else sniff.
+	if ct := extensionType(fh.Filename); ct != "" {
+		return ct
+	}
+	return detectContentType(b)
+}
+
+func extensionType(filename string) string {
+	name := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(name, ".jpg"), strings.HasSuffix(name, ".jpeg"):
+		return "image/jpeg"
+	case strings.HasSuffix(name, ".png"):
+		return "image/png"
+	case strings.HasSuffix(name, ".webp"):
+		return "image/webp"
+	case strings.HasSuffix(name, ".tif"), strings.HasSuffix(name, ".tiff"):
+		return "image/tiff"
+	case strings.HasSuffix(name, ".jp2"), strings.HasSuffix(name, ".j2k"), strings.HasSuffix(name, ".jpf"), strings.HasSuffix(name, ".jpx"):
+		return "image/jp2"
+	}
+	return ""
+}
+
+// claimedContentType is what the client says the upload is: the filename
+// extension, else the part's Content-Type when it names an image type.
+// Strict mode rejects uploads whose magic bytes disagree with it.
+func claimedContentType(fh *multipart.FileHeader) string {
+	if ct := extensionType(fh.Filename); ct != "" {
+		return ct
+	}
+	ct, _, _ := strings.Cut(fh.Header.Get("Content-Type"), ";")
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	if ct == "image/jpg" {
+		ct = "image/jpeg"
+	}
+	if strings.HasPrefix(ct, "image/") {
+		return ct
 	}
-	return b
+	return ""
 }
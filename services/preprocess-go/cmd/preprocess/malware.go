@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const clamdChunkSize = 64 << 10
+
+// errMalwareFound is returned by a scanner that flagged the upload; the
+// wrapped message carries the signature name.
+var errMalwareFound = errors.New("malware detected")
+
+// malwareScanner inspects raw upload bytes before anything decodes them.
+type malwareScanner interface {
+	scan(ctx context.Context, b []byte) error
+}
+
+// newMalwareScanner picks the protocol from the URL scheme:
+//
+//	tcp://clamav:3310, unix:///run/clamav/clamd.ctl  clamd INSTREAM
+//	icap://scanner:1344/avscan                       ICAP RESPMOD
+func newMalwareScanner(rawURL string, timeout time.Duration) (malwareScanner, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "tcp":
+		return &clamdScanner{network: "tcp", addr: u.Host, timeout: timeout}, nil
+	case "unix":
+		return &clamdScanner{network: "unix", addr: u.Path, timeout: timeout}, nil
+	case "icap":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "1344")
+		}
+		return &icapScanner{url: u, addr: addr, timeout: timeout}, nil
+	}
+	return nil, fmt.Errorf("malware scan: unsupported scheme %q", u.Scheme)
+}
+
+func dialScanner(ctx context.Context, network, addr string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	_ = conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// clamdScanner streams the upload to clamd with the INSTREAM command.
+type clamdScanner struct {
+	network, addr string
+	timeout       time.Duration
+}
+
+func (c *clamdScanner) scan(ctx context.Context, b []byte) error {
+	conn, err := dialScanner(ctx, c.network, c.addr, c.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for len(b) > 0 {
+		n := min(len(b), clamdChunkSize)
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		w.Write(size[:])
+		w.Write(b[:n])
+		b = b[n:]
+	}
+	w.Write([]byte{0, 0, 0, 0})
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return err
+	}
+	// "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return nil
+	case strings.HasSuffix(reply, " FOUND"):
+		sig := strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")
+		return fmt.Errorf("%w: %s", errMalwareFound, sig)
+	}
+	return fmt.Errorf("clamd: %s", reply)
+}
+
+// icapScanner submits the upload as an HTTP response body via ICAP RESPMOD
+// (RFC 3507). 204 means clean; anything the server modified or blocked is
+// treated as flagged.
+type icapScanner struct {
+	url     *url.URL
+	addr    string
+	timeout time.Duration
+}
+
+func (s *icapScanner) scan(ctx context.Context, b []byte) error {
+	conn, err := dialScanner(ctx, "tcp", s.addr, s.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resHdr := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: " +
+		strconv.Itoa(len(b)) + "\r\n\r\n"
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "RESPMOD %s ICAP/1.0\r\n", s.url.String())
+	fmt.Fprintf(&req, "Host: %s\r\n", s.url.Host)
+	req.WriteString("Allow: 204\r\n")
+	fmt.Fprintf(&req, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(resHdr))
+	req.WriteString(resHdr)
+	fmt.Fprintf(&req, "%x\r\n", len(b))
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return err
+	}
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(conn, "\r\n0\r\n\r\n"); err != nil {
+		return err
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	status, err := tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	hdr, err := tp.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	_, code, _ := strings.Cut(status, " ")
+	code, _, _ = strings.Cut(code, " ")
+	switch code {
+	case "204":
+		return nil
+	case "200":
+		name := hdr.Get("X-Infection-Found")
+		if name == "" {
+			name = hdr.Get("X-Violations-Found")
+		}
+		if name == "" {
+			name = "blocked by ICAP server"
+		}
+		return fmt.Errorf("%w: %s", errMalwareFound, name)
+	}
+	return fmt.Errorf("icap: %s", status)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small Prometheus text-format registry. The service needs a handful of
+// counters and histograms, which doesn't justify pulling in client_golang.
+
+type collector interface {
+	write(w io.Writer)
+}
+
+var registry []collector
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64 // key: label values joined by labelSep
+}
+
+const labelSep = "\xff"
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	registry = append(registry, c)
+	return c
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSep)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) inc(labelValues ...string) { c.add(1, labelValues...) }
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatFloat(c.values[key]))
+	}
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, non-cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+	registry = append(registry, h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSep)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) since(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// observeStage records a pipeline stage in the histogram and in the request's
+// own timings, which the slow-request log reports.
+func observeStage(ctx context.Context, start time.Time, stage string) {
+	d := time.Since(start)
+	stageDuration.observe(d.Seconds(), stage)
+	recordStage(ctx, stage, d)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cum uint64
+		for i, le := range h.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, formatFloat(le)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), s.count)
+	}
+}
+
+// gaugeFunc is sampled at scrape time.
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) {
+	registry = append(registry, &gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.fn()))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(names []string, key, le string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, labelSep) {
+			pairs = append(pairs, names[i]+"="+strconv.Quote(v))
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range registry {
+		c.write(w)
+	}
+}
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+	httpRequests = newCounterVec("preprocess_http_requests_total",
+		"Requests to /preprocess by response status.", "code")
+	httpDuration = newHistogramVec("preprocess_http_request_duration_seconds",
+		"End-to-end /preprocess latency.", latencyBuckets)
+	stageDuration = newHistogramVec("preprocess_stage_duration_seconds",
+		"Time spent in each pipeline stage.", latencyBuckets, "stage")
+	inputBytes = newCounterVec("preprocess_input_bytes_total",
+		"Bytes of uploaded images accepted for processing.")
+	outputBytes = newCounterVec("preprocess_output_bytes_total",
+		"Bytes of images returned.")
+	inputFormats = newCounterVec("preprocess_input_format_total",
+		"Decoded inputs by detected format.", "format")
+	apiKeyRequests = newCounterVec("preprocess_api_key_requests_total",
+		"Requests to /preprocess by API key name (or \"jwt\") and response status.", "key", "code")
+	tenantRequests = newCounterVec("preprocess_tenant_requests_total",
+		"Requests by tenant and response status.", "tenant", "code")
+	tenantImages = newCounterVec("preprocess_tenant_images_total",
+		"Images processed, by tenant.", "tenant")
+	rejections = newCounterVec("preprocess_rejections_total",
+		"Requests refused before producing an image, by reason.", "reason")
+	formatDuration = newHistogramVec("preprocess_format_duration_seconds",
+		"Pipeline time (decode through encode) by input format.", latencyBuckets, "format")
+	formatRatio = newHistogramVec("preprocess_compression_ratio",
+		"Output bytes divided by input bytes, by input format.",
+		[]float64{.05, .1, .2, .3, .4, .5, .75, 1, 1.5, 2}, "format")
+	formatInputBytes = newCounterVec("preprocess_format_input_bytes_total",
+		"Input bytes by input format.", "format")
+	formatOutputBytes = newCounterVec("preprocess_format_output_bytes_total",
+		"Output bytes by input format.", "format")
+	cacheLookups = newCounterVec("preprocess_cache_lookups_total",
+		"Result cache lookups.", "result")
+)
+
+// observeFormat records a completed pipeline run against its input format,
+// which is what tells us whether a format is worth a faster decoder.
+func observeFormat(format string, start time.Time, in, out int) {
+	formatDuration.since(start, format)
+	formatInputBytes.add(float64(in), format)
+	formatOutputBytes.add(float64(out), format)
+	if in > 0 {
+		formatRatio.observe(float64(out)/float64(in), format)
+	}
+}
+
+func (s *server) registerPoolMetrics() {
+	newGaugeFunc("preprocess_workers_active", "Jobs currently holding a worker slot.",
+		func() float64 { return float64(s.pool.stats().Active) })
+	newGaugeFunc("preprocess_queue_depth", "Requests waiting for a worker slot.",
+		func() float64 { return float64(s.pool.stats().Queued) })
+}
+
+// statusRecorder captures the status code and body size for metrics/logs.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection's Flush through
+// the recorder.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		httpRequests.inc(strconv.Itoa(rec.status))
+		if group := callerGroup(r.Context()); group != "" {
+			apiKeyRequests.inc(group, strconv.Itoa(rec.status))
+		}
+		if t := tenantName(r.Context()); t != "" {
+			tenantRequests.inc(t, strconv.Itoa(rec.status))
+		}
+		httpDuration.since(start)
+	})
+}
+
+// writeError sends the error envelope every endpoint uses:
+//
+//	{"error": {"code": "UNSUPPORTED_FORMAT", "message": "...", ...detail}}
+//
+// code is the reason in upper case, stable for clients to branch on;
+// message is English prose meant for logs, not for end users.
+func writeError(w http.ResponseWriter, status int, reason, msg string, detail map[string]any) {
+	body := map[string]any{"code": strings.ToUpper(reason), "message": msg}
+	for k, v := range detail {
+		body[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": body})
+}
+
+// rejectJSON is reject with extra detail fields in the error object, for
+// errors where the client needs more than the code (e.g. the limit hit).
+func rejectJSON(w http.ResponseWriter, r *http.Request, status int, reason, msg string, detail map[string]any) {
+	rejections.inc(reason)
+	stats.recordReject(reason)
+	setOutcome(r.Context(), reason)
+	writeError(w, status, reason, msg, detail)
+}
+
+// reject answers with an error and records reason in metrics and the
+// request's log line.
+func reject(w http.ResponseWriter, r *http.Request, status int, reason, msg string) {
+	rejectJSON(w, r, status, reason, msg, nil)
+}
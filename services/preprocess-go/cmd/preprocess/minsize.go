@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// min_width and min_height turn away uploads too small to be worth
+// listing, such as 120px thumbnails scraped off the web, with a 422
+// IMAGE_TOO_SMALL the app can show as is. They are checked against the
+// header, before anything is decoded, and against a video's frame or a
+// document's page rather than the upload when one stands in for it.
+
+type minSize struct {
+	width, height int
+}
+
+func minSizeParam(r *http.Request) (minSize, error) {
+	var m minSize
+	for _, p := range []struct {
+		key string
+		v   *int
+	}{{"min_width", &m.width}, {"min_height", &m.height}} {
+		v := r.URL.Query().Get(p.key)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return minSize{}, fmt.Errorf("%s must be a positive integer, got %q", p.key, v)
+		}
+		*p.v = n
+	}
+	return m, nil
+}
+
+// checkMinSize answers 422 if b is smaller than m. An upload whose header
+// can't be read is left for the pipeline to reject. On failure it has
+// already written the response.
+func checkMinSize(w http.ResponseWriter, r *http.Request, b []byte, ct string, m minSize) bool {
+	if m == (minSize{}) {
+		return true
+	}
+	_, cfg, err := probeImage(b, ct)
+	if err != nil || (cfg.Width >= m.width && cfg.Height >= m.height) {
+		return true
+	}
+	logAttrs(r.Context(), "input_width", cfg.Width, "input_height", cfg.Height)
+	extra := map[string]any{"width": cfg.Width, "height": cfg.Height}
+	var need []string
+	if m.width > 0 {
+		extra["min_width"] = m.width
+		need = append(need, fmt.Sprintf("%dpx wide", m.width))
+	}
+	if m.height > 0 {
+		extra["min_height"] = m.height
+		need = append(need, fmt.Sprintf("%dpx tall", m.height))
+	}
+	rejectJSON(w, r, http.StatusUnprocessableEntity, "image_too_small",
+		fmt.Sprintf("image is %dx%d; it must be at least %s", cfg.Width, cfg.Height, strings.Join(need, " and ")), extra)
+	return false
+}
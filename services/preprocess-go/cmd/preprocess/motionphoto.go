@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Phones save moving pictures as a still with a clip attached. Samsung and
+// Google motion photos are a JPEG with an MP4 appended after its end; the
+// decoders stop at the JPEG's end, but a passthrough would hand back the
+// whole file, video and all. motionStill cuts those down to the JPEG.
+//
+// Apple Live Photos and newer motion photos are HEIC, which nothing here
+// decodes. With FFMPEG_PATH set, their primary image is extracted the way a
+// video's frame is and processed in its place; without it they are still an
+// unsupported format.
+
+// motionStill returns the still of a JPEG motion photo, or b unchanged.
+func motionStill(ctx context.Context, b []byte) []byte {
+	end := jpegEnd(b)
+	if end <= 0 || end == len(b) {
+		return b
+	}
+	// Samsung puts its own trailer ahead of the MP4, so look past the
+	// start of what follows.
+	rest := b[end:]
+	if i := bytes.Index(rest[:min(len(rest), 64<<10)], []byte("ftyp")); i < 4 {
+		return b
+	}
+	logAttrs(ctx, "motion_photo", true, "motion_bytes", len(rest))
+	return b[:end]
+}
+
+// jpegEnd is the offset just past b's EOI marker, or -1 if b isn't a
+// well-formed JPEG. Segments are skipped by their length, so an EXIF
+// thumbnail's own EOI inside APP1 isn't mistaken for the end.
+func jpegEnd(b []byte) int {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return -1
+	}
+	for i := 2; i+2 <= len(b); {
+		if b[i] != 0xFF {
+			return -1
+		}
+		m := b[i+1]
+		switch {
+		case m == 0xFF: // fill byte
+			i++
+			continue
+		case m == 0xD9:
+			return i + 2
+		case m >= 0xD0 && m <= 0xD7, m == 0x01: // no length
+			i += 2
+			continue
+		}
+		if i+4 > len(b) {
+			return -1
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return -1
+		}
+		i += 2 + n
+		if m != 0xDA {
+			continue
+		}
+		// Entropy-coded data follows a scan header. Within it 0xFF is
+		// only ever stuffed (FF 00) or a restart marker; anything else
+		// starts the next segment (another scan's tables, or EOI).
+		for ; i+1 < len(b); i++ {
+			if b[i] == 0xFF && b[i+1] != 0x00 && (b[i+1] < 0xD0 || b[i+1] > 0xD7) {
+				break
+			}
+		}
+	}
+	return -1
+}
+
+// isHEIF reports whether b is a HEIF still, HEIC or AVIF.
+func isHEIF(b []byte) bool {
+	if len(b) < 12 || string(b[4:8]) != "ftyp" {
+		return false
+	}
+	switch string(b[8:12]) {
+	case "heic", "heix", "hevc", "mif1", "msf1", "avif", "avis":
+		return true
+	}
+	return false
+}
+
+// heifStill extracts the primary image of HEIF b as a PNG. ffmpeg 7 or
+// later is needed for the tiled images phones write; older builds return a
+// single tile.
+func (s *server) heifStill(ctx context.Context, b []byte) ([]byte, error) {
+	start := time.Now()
+	inputFormats.inc("image/heif")
+	logAttrs(ctx, "input_format", "image/heif")
+	dir, err := os.MkdirTemp("", "preprocess-video-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "still.png")
+	if err := os.WriteFile(in, b, 0o600); err != nil {
+		return nil, err
+	}
+	if err := s.ffmpeg(ctx, "-i", in, "-frames:v", "1", "-an", "-map_metadata", "-1", "-c:v", "png", out); err != nil {
+		return nil, err
+	}
+	still, err := os.ReadFile(out)
+	if err != nil {
+		return nil, fmt.Errorf("%w: no image in HEIF", errTranscode)
+	}
+	observeStage(ctx, start, "extract")
+	return still, nil
+}
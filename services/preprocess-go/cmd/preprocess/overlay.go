@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// White-labelled partner apps get their logo composited on outputs. Each
+// caller registers one overlay in the config file's overlays section,
+//
+//	overlays:
+//	  partner-a: {file: /etc/preprocess/partner-a.png, position: bottom-right, width: 0.2}
+//
+// and asks for it with overlay=tenant_logo. Assets are decoded when the
+// config is applied, so a bad file fails startup or the reload rather than
+// a request.
+
+// overlaySpec is an overlays entry as configured.
+type overlaySpec struct {
+	File     string
+	Position string  // top-left, top-right, bottom-left, bottom-right or center
+	Width    float64 // overlay width as a fraction of the output width
+	Margin   float64 // gap to the edges as a fraction of the output's shorter side
+	Opacity  float64
+}
+
+var overlayPositions = map[string]bool{
+	"top-left": true, "top-right": true, "bottom-left": true, "bottom-right": true, "center": true,
+}
+
+func defaultOverlaySpec() overlaySpec {
+	return overlaySpec{Position: "bottom-right", Width: 0.2, Margin: 0.02, Opacity: 1}
+}
+
+func (o overlaySpec) validate() error {
+	switch {
+	case o.File == "":
+		return fmt.Errorf("file is required")
+	case !overlayPositions[o.Position]:
+		return fmt.Errorf("position %q: want top-left, top-right, bottom-left, bottom-right or center", o.Position)
+	case o.Width <= 0 || o.Width > 1:
+		return fmt.Errorf("width %g: want a fraction in (0, 1]", o.Width)
+	case o.Margin < 0 || o.Margin >= 0.5:
+		return fmt.Errorf("margin %g: want a fraction in [0, 0.5)", o.Margin)
+	case o.Opacity <= 0 || o.Opacity > 1:
+		return fmt.Errorf("opacity %g: want a fraction in (0, 1]", o.Opacity)
+	}
+	return nil
+}
+
+// overlay is a loaded asset. id changes whenever the file or placement
+// does, and stands in for the overlay in cache keys.
+type overlay struct {
+	id   string
+	img  image.Image
+	spec overlaySpec
+}
+
+func loadOverlays(specs map[string]overlaySpec) (map[string]*overlay, error) {
+	overlays := make(map[string]*overlay, len(specs))
+	for name, spec := range specs {
+		b, err := os.ReadFile(spec.File)
+		if err != nil {
+			return nil, fmt.Errorf("overlay %s: %w", name, err)
+		}
+		img, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("overlay %s: %s: %w", name, spec.File, err)
+		}
+		sum := sha256.Sum256(append(b, fmt.Sprintf("%+v", spec)...))
+		overlays[name] = &overlay{id: name + "@" + hex.EncodeToString(sum[:8]), img: img, spec: spec}
+	}
+	return overlays, nil
+}
+
+// overlayParam resolves overlay=tenant_logo to the caller's registered
+// overlay; nil when none was asked for.
+func overlayParam(r *http.Request, overlays map[string]*overlay) (*overlay, error) {
+	switch v := r.URL.Query().Get("overlay"); v {
+	case "":
+		return nil, nil
+	case "tenant_logo":
+		ov, ok := overlays[callerName(r.Context())]
+		if !ok {
+			return nil, fmt.Errorf("no overlay is registered for this caller")
+		}
+		return ov, nil
+	default:
+		return nil, fmt.Errorf("overlay must be tenant_logo, got %q", v)
+	}
+}
+
+// applyOverlay composites ov onto img; see drawable for when that is in
+// place.
+func applyOverlay(img image.Image, owned bool, ov *overlay) image.Image {
+	dst := drawable(img, owned)
+	b := dst.Bounds()
+	ob := ov.img.Bounds()
+	w := max(1, int(math.Round(ov.spec.Width*float64(b.Dx()))))
+	h := max(1, int(math.Round(float64(w)*float64(ob.Dy())/float64(ob.Dx()))))
+	margin := int(ov.spec.Margin * float64(min(b.Dx(), b.Dy())))
+	var x, y int
+	switch ov.spec.Position {
+	case "top-left":
+		x, y = margin, margin
+	case "top-right":
+		x, y = b.Dx()-w-margin, margin
+	case "bottom-left":
+		x, y = margin, b.Dy()-h-margin
+	case "bottom-right":
+		x, y = b.Dx()-w-margin, b.Dy()-h-margin
+	case "center":
+		x, y = (b.Dx()-w)/2, (b.Dy()-h)/2
+	}
+	r := image.Rect(x, y, x+w, y+h).Add(b.Min)
+
+	var mask image.Image
+	if ov.spec.Opacity < 1 {
+		mask = image.NewUniform(color.Alpha16{A: uint16(ov.spec.Opacity * 0xffff)})
+	}
+	opts := &draw.Options{SrcMask: mask}
+	draw.CatmullRom.Scale(dst, r, ov.img, ob, draw.Over, opts)
+	return dst
+}
+
+func parseOverlays(v any) (map[string]overlaySpec, error) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("want a map of caller names")
+	}
+	specs := make(map[string]overlaySpec, len(m))
+	for name, ov := range m {
+		fields, ok := ov.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: want a map with file, position, width, margin, opacity", name)
+		}
+		spec := defaultOverlaySpec()
+		for k, val := range fields {
+			s, err := settingValue(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", name, k, err)
+			}
+			var f *float64
+			switch k {
+			case "file":
+				spec.File = s
+				continue
+			case "position":
+				spec.Position = s
+				continue
+			case "width":
+				f = &spec.Width
+			case "margin":
+				f = &spec.Margin
+			case "opacity":
+				f = &spec.Opacity
+			default:
+				return nil, fmt.Errorf("%s: unknown field %q", name, k)
+			}
+			if *f, err = strconv.ParseFloat(s, 64); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", name, k, err)
+			}
+		}
+		if err := spec.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		specs[name] = spec
+	}
+	return specs, nil
+}
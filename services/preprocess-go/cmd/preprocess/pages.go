@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scanned menus and supplier spec sheets arrive as multi-page TIFFs and
+// PDFs. page=N, 1-based, picks the page that goes through the pipeline, the
+// first by default, and X-Page-Count reports how many the document has.
+//
+// TIFFs are decoded in-process; the decoder only ever reads the first page,
+// so the header is pointed at page N's directory instead. PDFs need
+// poppler's pdftoppm at PDFTOPPM_PATH, with pdfinfo next to it, to render
+// the page to a PNG that stands in for the upload, the way a video's frame
+// does. Without it, a PDF is an unsupported format.
+
+// errPageRange is page= past the end of the document.
+var errPageRange = errors.New("page out of range")
+
+func pageParam(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("page")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("page must be a positive integer, got %q", v)
+	}
+	return n, nil
+}
+
+// detectContentType is http.DetectContentType plus TIFF, which the standard
+// sniffer doesn't know.
+func detectContentType(b []byte) string {
+	if isTIFF(b) {
+		return "image/tiff"
+	}
+	if isJPEG2000(b) {
+		return "image/jp2"
+	}
+	return http.DetectContentType(b)
+}
+
+func isTIFF(b []byte) bool {
+	return len(b) >= 8 && (string(b[:4]) == "II*\x00" || string(b[:4]) == "MM\x00*")
+}
+
+func isPDF(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("%PDF-"))
+}
+
+// tiffPage returns the number of pages in TIFF b and b with page n, or the
+// first if n is 0, as its first page. b itself is never modified.
+func tiffPage(b []byte, n int) (int, []byte, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if b[0] == 'M' {
+		order = binary.BigEndian
+	}
+	// Every page is a directory holding the offset of the next; the
+	// pixels are found through offsets inside it, so they stay put.
+	var ifds []uint32
+	seen := map[uint32]bool{}
+	for off := order.Uint32(b[4:]); off != 0; {
+		if seen[off] || uint64(off)+2 > uint64(len(b)) {
+			break // a loop or a truncated file; count what was readable
+		}
+		seen[off] = true
+		ifds = append(ifds, off)
+		next := uint64(off) + 2 + 12*uint64(order.Uint16(b[off:]))
+		if next+4 > uint64(len(b)) {
+			break
+		}
+		off = order.Uint32(b[next:])
+	}
+	if len(ifds) == 0 {
+		return 0, nil, errUnsupportedImage
+	}
+	if n > len(ifds) {
+		return len(ifds), nil, fmt.Errorf("%w: the document has %d pages", errPageRange, len(ifds))
+	}
+	if n <= 1 {
+		return len(ifds), b, nil
+	}
+	page := bytes.Clone(b)
+	order.PutUint32(page[4:], ifds[n-1])
+	return len(ifds), page, nil
+}
+
+// pdfPage renders page n, or the first if n is 0, of PDF b to a PNG whose
+// long side is maxDim, and reports the page count.
+func (s *server) pdfPage(ctx context.Context, b []byte, n, maxDim int) (int, []byte, error) {
+	start := time.Now()
+	inputFormats.inc("application/pdf")
+	logAttrs(ctx, "input_format", "application/pdf")
+	dir, err := os.MkdirTemp("", "preprocess-pdf-")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "in.pdf")
+	if err := os.WriteFile(in, b, 0o600); err != nil {
+		return 0, nil, err
+	}
+	out, err := s.poppler(ctx, "pdfinfo", in)
+	if err != nil {
+		return 0, nil, err
+	}
+	pages := 0
+	for sc := bufio.NewScanner(bytes.NewReader(out)); sc.Scan(); {
+		if v, ok := strings.CutPrefix(sc.Text(), "Pages:"); ok {
+			pages, _ = strconv.Atoi(strings.TrimSpace(v))
+		}
+	}
+	if pages < 1 {
+		return 0, nil, fmt.Errorf("%w: pdfinfo found no pages", errTranscode)
+	}
+	n = max(n, 1)
+	if n > pages {
+		return pages, nil, fmt.Errorf("%w: the document has %d pages", errPageRange, pages)
+	}
+	p := strconv.Itoa(n)
+	if _, err := s.poppler(ctx, "pdftoppm", "-f", p, "-l", p, "-singlefile", "-png",
+		"-scale-to", strconv.Itoa(maxDim), in, filepath.Join(dir, "page")); err != nil {
+		return 0, nil, err
+	}
+	png, err := os.ReadFile(filepath.Join(dir, "page.png"))
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: pdftoppm wrote no page", errTranscode)
+	}
+	observeStage(ctx, start, "extract")
+	logAttrs(ctx, "pages", pages, "page", n)
+	return pages, png, nil
+}
+
+// poppler runs tool, pdfinfo or pdftoppm from PDFTOPPM_PATH's directory,
+// and returns its output. Like ffmpeg, its complaints about the input are
+// wrapped in errTranscode.
+func (s *server) poppler(ctx context.Context, tool string, args ...string) ([]byte, error) {
+	path := s.cfg.PdftoppmPath
+	if tool != "pdftoppm" {
+		path = filepath.Join(filepath.Dir(path), tool)
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var exit *exec.ExitError
+		if !errors.As(err, &exit) {
+			return nil, err
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 512 {
+			msg = msg[len(msg)-512:]
+		}
+		return nil, fmt.Errorf("%w: %s: %v: %s", errTranscode, tool, err, msg)
+	}
+	return out, nil
+}
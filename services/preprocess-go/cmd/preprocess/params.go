@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// preprocessParams is a /preprocess query parsed in one place, so every
+// bad or contradictory parameter is a 400 invalid_param before the upload
+// is read. Whether the server is set up for what's asked (store, dish_id,
+// video, privacy=faces) and checks that depend on the upload itself stay
+// with the handler.
+type preprocessParams struct {
+	opts options
+
+	sizes     []int
+	tiles     bool
+	crops     []aspect
+	smartCrop bool
+	focus     *focusBox
+
+	store, file, dishID  string
+	zipped, withOriginal bool
+
+	video, frameMode string
+	page             int
+	atLeast          minSize
+	dryRun           bool
+}
+
+// paramCheck is a combination of parameters that can't work together.
+type paramCheck struct {
+	bad bool
+	msg string
+}
+
+func checkParams(checks ...paramCheck) error {
+	for _, c := range checks {
+		if c.bad {
+			return errors.New(c.msg)
+		}
+	}
+	return nil
+}
+
+// preprocessParams applies the preset, if any, and parses the rest of the
+// query against live's limits.
+func (s *server) preprocessParams(r *http.Request, live *liveConfig) (preprocessParams, error) {
+	var p preprocessParams
+	if err := s.applyPreset(r, live.presets); err != nil {
+		return p, err
+	}
+	q := r.URL.Query()
+	o := &p.opts
+	o.maxDim = min(max(intParam(r, "max_dim", live.defaultMaxDim), live.minDim), live.maxDim)
+	o.quality = min(max(intParam(r, "quality", live.defaultQuality), live.minQuality), live.maxQuality)
+	p.file = q.Get("file")
+
+	for _, parse := range []func() error{
+		func() (err error) { p.sizes, err = sizesParam(r, live.minDim, live.maxDim); return },
+		func() (err error) { o.sanitize, err = s.sanitizeParam(r); return },
+		func() (err error) { o.depth16, err = depthParam(r); return },
+		func() (err error) { o.interlace, err = boolParam(r, "interlace"); return },
+		func() (err error) { o.linear, err = boolParam(r, "linear"); return },
+		func() (err error) { p.tiles, err = tilesParam(r); return },
+		func() (err error) { o.blurFaces, err = privacyParam(r); return },
+		func() (err error) { o.redact, err = redactParam(r); return },
+		func() (err error) { o.overlay, err = overlayParam(r, live.overlays); return },
+		func() (err error) { o.border, err = borderParam(r); return },
+		func() (err error) { o.letterbox, err = letterboxParam(r); return },
+		func() (err error) { p.crops, p.smartCrop, err = cropsParam(r); return },
+		func() (err error) { p.focus, err = focusParam(r); return },
+		func() (err error) { p.store, err = storeParam(r); return },
+		func() (err error) { p.dishID, err = dishParam(r); return },
+		func() (err error) { p.zipped, p.withOriginal, err = bundleParam(r); return },
+		func() (err error) { p.video, err = videoParam(r); return },
+		func() (err error) { p.frameMode, err = frameParam(r); return },
+		func() (err error) { p.page, err = pageParam(r); return },
+		func() (err error) { p.atLeast, err = minSizeParam(r); return },
+		func() (err error) { p.dryRun, err = boolParam(r, "dry_run"); return },
+	} {
+		if err := parse(); err != nil {
+			return p, err
+		}
+	}
+	o.forceEncode = q.Has("quality") || o.sanitize || o.edits()
+
+	framed := o.overlay != nil || o.border.width > 0
+	boxed := o.letterbox.ar != (aspect{})
+	err := checkParams(
+		paramCheck{p.tiles && (framed || boxed), "overlay, border and letterboxing can't be combined with tiles"},
+		paramCheck{len(p.crops) > 0 && (p.tiles || len(p.sizes) > 0 || boxed), "crops can't be combined with sizes, tiles or letterboxing"},
+		paramCheck{p.focus != nil && len(p.crops) == 0, "focus_box needs crops"},
+		paramCheck{p.dishID != "" && p.tiles, "dish_id can't be combined with tiles"},
+		paramCheck{p.store != "" && p.tiles, "store can't be combined with tiles"},
+		paramCheck{p.file != "" && p.tiles, "file can't be combined with tiles"},
+		paramCheck{p.zipped && (p.store != "" || p.file != ""), "bundle can't be combined with store or file"},
+		paramCheck{p.withOriginal && p.tiles, "bundle_original can't be combined with tiles"},
+		paramCheck{p.dryRun && (p.tiles || p.video != ""), "dry_run can't be combined with tiles or video, or preview video, HEIC, JPEG 2000 and PDF uploads"},
+		paramCheck{p.video != "" && (p.tiles || len(p.sizes) > 0 || len(p.crops) > 0 || p.store != "" || p.withOriginal ||
+			o.blurFaces || len(o.redact.regions) > 0 || framed || boxed),
+			"video can't be combined with sizes, crops, tiles, store, bundle_original or image edits"},
+	)
+	return p, err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPreprocessParams(t *testing.T) {
+	live := &liveConfig{
+		defaultMaxDim: 1280, minDim: 64, maxDim: 4096,
+		defaultQuality: 85, minQuality: 30, maxQuality: 95,
+		presets: map[string]url.Values{"thumb": {"max_dim": {"320"}, "quality": {"70"}}},
+	}
+	tests := []struct {
+		query   string
+		wantErr string // substring; "" for success
+		check   func(t *testing.T, p preprocessParams)
+	}{
+		{"", "", func(t *testing.T, p preprocessParams) {
+			if p.opts.maxDim != 1280 || p.opts.quality != 85 || p.opts.forceEncode {
+				t.Errorf("defaults = %+v", p.opts)
+			}
+		}},
+		{"max_dim=99999&quality=5", "", func(t *testing.T, p preprocessParams) {
+			if p.opts.maxDim != 4096 || p.opts.quality != 30 || !p.opts.forceEncode {
+				t.Errorf("clamped = %+v", p.opts)
+			}
+		}},
+		{"preset=thumb&quality=90", "", func(t *testing.T, p preprocessParams) {
+			if p.opts.maxDim != 320 || p.opts.quality != 90 {
+				t.Errorf("preset = %+v, want max_dim 320 and the caller's quality", p.opts)
+			}
+		}},
+		{"sizes=100,9000&store=cloudinary", "", func(t *testing.T, p preprocessParams) {
+			if len(p.sizes) != 2 || p.sizes[0] != 100 || p.sizes[1] != 4096 || p.store != "cloudinary" {
+				t.Errorf("sizes = %v, store = %q", p.sizes, p.store)
+			}
+		}},
+		{"border=4,000000", "", func(t *testing.T, p preprocessParams) {
+			if !p.opts.forceEncode {
+				t.Error("an edit didn't force a re-encode")
+			}
+		}},
+
+		{"preset=nope", "unknown preset", nil},
+		{"sanitize=maybe", "sanitize", nil},
+		{"interlace=sure", "interlace", nil},
+		{"store=s3", "store", nil},
+		{"tiles=dzi&border=4,000000", "can't be combined with tiles", nil},
+		{"crops=1:1&sizes=100", "crops can't be combined", nil},
+		{"focus_box=0.1,0.1,0.5,0.5", "focus_box needs crops", nil},
+		{"tiles=dzi&store=cloudflare", "store can't be combined with tiles", nil},
+		{"tiles=dzi&file=a.jpg", "file can't be combined with tiles", nil},
+		{"bundle=zip&file=a.jpg", "bundle can't be combined", nil},
+		{"dry_run=true&tiles=dzi", "dry_run can't be combined", nil},
+		{"video=mp4&sizes=100", "video can't be combined", nil},
+		{"video=mp4&privacy=faces", "video can't be combined", nil},
+	}
+	s := &server{}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/preprocess?"+tt.query, nil)
+		p, err := s.preprocessParams(r, live)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%q: err = %v, want %q", tt.query, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		tt.check(t, p)
+	}
+}
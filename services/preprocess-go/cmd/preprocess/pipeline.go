@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+)
+
+var (
+	errTooManyPixels    = errors.New("image exceeds pixel limit")
+	errAspectRatio      = errors.New("image aspect ratio exceeds limit")
+	errUnsupportedImage = errors.New("unsupported or invalid image")
+)
+
+// options is what a request asks the pipeline for. Each field must also be
+// part of cacheKey.
+type options struct {
+	maxDim  int
+	quality int
+
+	// forceEncode disables passthrough of inputs that already satisfy every
+	// constraint, e.g. because the caller asked for an explicit quality or
+	// sanitize=strict.
+	forceEncode bool
+
+	// sanitize also rules out falling back to the input when the re-encode
+	// comes out larger; the re-encode is the point.
+	sanitize bool
+
+	// depth16 keeps 16-bit PNG inputs at 16 bits per channel through resize
+	// and encode, always producing PNG; 8-bit inputs are unaffected.
+	depth16 bool
+
+	// interlace writes PNG outputs as Adam7 so they render progressively.
+	// JPEG outputs are unaffected.
+	interlace bool
+
+	// blurFaces blurs detected faces (privacy=faces) and redact hides the
+	// listed regions. Like sanitize, either rules out returning the input.
+	blurFaces bool
+	redact    redaction
+
+	// overlay is the caller's logo (overlay=tenant_logo), composited onto
+	// each output after resizing.
+	overlay *overlay
+
+	// border frames each output (border=width,color).
+	border border
+
+	// letterbox pads each output to an aspect ratio (ar=, fit=letterbox).
+	letterbox letterbox
+
+	// linear resizes in linear light rather than on sRGB values. Slower and
+	// hungrier, for hero images; 16-bit outputs keep the default path.
+	linear bool
+
+	// trim crops an over-elongated upload to the middle of it at this
+	// aspect (PHOTO_ASPECT_MODE=crop) before anything else is cut out of it.
+	trim aspect
+}
+
+// edits reports whether the pixels are changed beyond resizing, which makes
+// the upload itself unfit to return.
+func (o options) edits() bool {
+	return o.blurFaces || len(o.redact.regions) > 0 || o.overlay != nil ||
+		o.border.width > 0 || o.letterbox.ar != (aspect{}) || o.trim != (aspect{})
+}
+
+type result struct {
+	body          []byte
+	buf           *bytes.Buffer // backing pooled buffer, if any
+	ct            string
+	origCT        string
+	width, height int
+	passthrough   bool        // body is the untouched input
+	reason        string      // why passthrough: "within-limits" or "smaller-than-output"
+	name          string      // path within a tile pyramid, sent as Content-Location
+	stats         *imageStats // outputStats, once computed
+	sha256        string      // digest(), once computed
+}
+
+// digest is the hex SHA-256 of body, computed once: responses, the audit
+// log, the catalog and events all want it.
+func (res *result) digest() string {
+	if res.sha256 == "" {
+		res.sha256 = hashHex(res.body)
+	}
+	return res.sha256
+}
+
+// objectName is res's content-addressed storage name,
+// <sha256>-<w>x<h>.<ext>: identical outputs get identical names, so storing
+// them under it dedupes by key.
+func (res *result) objectName() string {
+	return fmt.Sprintf("%s-%dx%d.%s", res.digest(), res.width, res.height, fileExt(res.ct))
+}
+
+// fileExt is the usual file extension for an output content type.
+func fileExt(ct string) string {
+	switch ct {
+	case "image/jpeg":
+		return "jpg"
+	case "image/png":
+		return "png"
+	case "image/webp":
+		return "webp"
+	case "image/tiff":
+		return "tif"
+	case "video/mp4":
+		return "mp4"
+	case "video/webm":
+		return "webm"
+	}
+	return "bin"
+}
+
+// release returns the pooled buffer behind body; body is invalid afterwards.
+func (res *result) release() {
+	if res.buf != nil {
+		putBuffer(res.buf)
+		res.buf = nil
+	}
+}
+
+// process runs decode -> downscale -> encode, checking ctx between stages so
+// a timed-out or abandoned request stops burning CPU at the next boundary.
+//
+// Inputs that are already the format we'd output and within max_dim are
+// returned as-is: JPEGs without decoding at all, PNGs after the decode needed
+// to confirm they really carry alpha.
+func (s *server) process(ctx context.Context, b []byte, ct string, opts options) (res *result, err error) {
+	start := time.Now()
+	f, cfg, err := s.probe(ctx, b, ct)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if res != nil {
+			observeFormat(f.ct, start, len(b), len(res.body))
+		}
+	}()
+	fits := max(cfg.Width, cfg.Height) <= opts.maxDim
+	if fits && !opts.forceEncode && f.ct == "image/jpeg" && !isCMYK(cfg) {
+		if err := s.checkBlank(ctx, f, b, cfg, nil); err != nil {
+			return nil, err
+		}
+		return passthroughResult(b, f.ct, cfg), nil
+	}
+
+	if fits && !opts.forceEncode && !opts.interlace && f.ct == "image/png" && opts.depth16 && is16Bit(cfg.ColorModel) {
+		if err := s.checkBlank(ctx, f, b, cfg, nil); err != nil {
+			return nil, err
+		}
+		return passthroughResult(b, f.ct, cfg), nil
+	}
+
+	img, err := s.decodeFor(ctx, f, b, cfg, opts.maxDim)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkBlank(ctx, f, b, cfg, img); err != nil {
+		return nil, err
+	}
+	if img, err = s.editImage(ctx, img, b, f.ct, cfg, opts); err != nil {
+		return nil, err
+	}
+	if fits && !opts.forceEncode && !opts.interlace && f.ct == "image/png" && imageHasAlpha(img) {
+		return passthroughResult(b, f.ct, cfg), nil
+	}
+	res, err = render(ctx, img, f.ct, opts.maxDim, opts)
+	if err != nil {
+		return nil, err
+	}
+	logAttrs(ctx, "scale", math.Round(float64(res.width)/float64(cfg.Width)*1000)/1000)
+	return keepSmaller(b, f, cfg, res, opts.maxDim, opts), nil
+}
+
+func passthroughResult(b []byte, ct string, cfg image.Config) *result {
+	return &result{body: b, ct: ct, origCT: ct, width: cfg.Width, height: cfg.Height, passthrough: true, reason: "within-limits"}
+}
+
+// keepSmaller returns the input instead of res when re-encoding made an
+// image that already fit maxDim bigger, which is common for small,
+// already-optimized uploads. Only JPEG and PNG inputs qualify, being formats
+// we'd output anyway.
+func keepSmaller(b []byte, f imageFormat, cfg image.Config, res *result, maxDim int, opts options) *result {
+	// Interlacing costs bytes by design; don't undo the caller's choice.
+	if opts.interlace && res.ct == "image/png" {
+		return res
+	}
+	if opts.sanitize || opts.edits() || len(res.body) <= len(b) || max(cfg.Width, cfg.Height) > maxDim || isCMYK(cfg) ||
+		(f.ct != "image/jpeg" && f.ct != "image/png") {
+		return res
+	}
+	res.release()
+	keep := passthroughResult(b, f.ct, cfg)
+	keep.reason = "smaller-than-output"
+	return keep
+}
+
+// processSizes decodes once and renders every size concurrently, bounded by
+// ResizeParallelism, so a 4-size request costs roughly one decode plus the slowest
+// encode rather than four full pipelines.
+func (s *server) processSizes(ctx context.Context, b []byte, ct string, sizes []int, opts options) ([]*result, error) {
+	start := time.Now()
+	f, cfg, err := s.probe(ctx, b, ct)
+	if err != nil {
+		return nil, err
+	}
+	img, err := s.decodeFor(ctx, f, b, cfg, slices.Max(sizes))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkBlank(ctx, f, b, cfg, img); err != nil {
+		return nil, err
+	}
+	if img, err = s.editImage(ctx, img, b, f.ct, cfg, opts); err != nil {
+		return nil, err
+	}
+
+	set, err := s.renderAll(len(sizes), func(i int) (*result, error) {
+		res, err := render(ctx, img, f.ct, sizes[i], opts)
+		if err == nil {
+			res = keepSmaller(b, f, cfg, res, sizes[i], opts)
+		}
+		return res, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out int
+	for _, res := range set {
+		out += len(res.body)
+	}
+	observeFormat(f.ct, start, len(b), out)
+	return set, nil
+}
+
+// renderAll runs fn for 0..n-1, RESIZE_PARALLELISM at a time, and returns
+// every result or, if any failed, none.
+func (s *server) renderAll(n int, fn func(i int) (*result, error)) ([]*result, error) {
+	set := make([]*result, n)
+	errs := make([]error, n)
+	sem := make(chan struct{}, s.cfg.ResizeParallelism)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			defer func() {
+				if v := recover(); v != nil {
+					errs[i] = newPanicError(v)
+				}
+			}()
+			set[i], errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		releaseAll(set)
+		return nil, err
+	}
+	return set, nil
+}
+
+func (s *server) probe(ctx context.Context, b []byte, ct string) (imageFormat, image.Config, error) {
+	f, cfg, err := probeImage(b, ct)
+	if err != nil {
+		return f, cfg, errUnsupportedImage
+	}
+	inputFormats.inc(f.ct)
+	logAttrs(ctx, "input_format", f.ct, "input_width", cfg.Width, "input_height", cfg.Height)
+	return f, cfg, s.checkLimits(cfg)
+}
+
+func (s *server) decode(ctx context.Context, f imageFormat, b []byte) (image.Image, error) {
+	start := time.Now()
+	img, err := f.decode(bytes.NewReader(b))
+	observeStage(ctx, start, "decode")
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cmyk, ok := img.(*image.CMYK); ok {
+		// Print-exported JPEGs (including Adobe's inverted CMYK and YCCK,
+		// which the decoder normalizes) would otherwise go through the slow
+		// generic resize path and out to clients that can't render them.
+		start = time.Now()
+		img = cmykToRGBA(cmyk)
+		observeStage(ctx, start, "convert")
+		logAttrs(ctx, "color_model", "cmyk")
+	}
+	return img, nil
+}
+
+// decodeFor is decode for an output no larger than maxDim, which may be
+// served from the EXIF thumbnail instead.
+func (s *server) decodeFor(ctx context.Context, f imageFormat, b []byte, cfg image.Config, maxDim int) (image.Image, error) {
+	if s.cfg.ExifThumbnail && f.ct == "image/jpeg" && max(cfg.Width, cfg.Height) > maxDim {
+		if img := exifThumbnail(ctx, b, cfg, maxDim); img != nil {
+			return img, nil
+		}
+	}
+	return s.decode(ctx, f, b)
+}
+
+// editImage applies the requested pixel edits, face blurring then
+// redaction, to a copy of img, and trims it.
+func (s *server) editImage(ctx context.Context, img image.Image, b []byte, ct string, cfg image.Config, opts options) (image.Image, error) {
+	if opts.blurFaces {
+		var err error
+		if img, err = s.blurFaces(ctx, img, b, ct, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.redact.regions) > 0 {
+		start := time.Now()
+		img = redactImage(img, cfg, opts.redact)
+		observeStage(ctx, start, "redact")
+		logAttrs(ctx, "redacted_regions", len(opts.redact.regions))
+	}
+	if opts.trim != (aspect{}) {
+		// Last, since faces and redactions are placed on the whole upload.
+		img = subImage(img, cropRect(img.Bounds(), opts.trim, nil, nil))
+	}
+	return img, nil
+}
+
+// isCMYK reports a four-channel JPEG; these are never passed through, as
+// many browsers and image viewers show them with inverted or washed-out
+// colors.
+func isCMYK(cfg image.Config) bool {
+	return cfg.ColorModel == color.CMYKModel
+}
+
+// cmykToRGBA converts with the naive device-CMYK formula; embedded ICC
+// profiles are not applied.
+func cmykToRGBA(src *image.CMYK) *image.RGBA {
+	dst := image.NewRGBA(src.Bounds())
+	draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Src)
+	return dst
+}
+
+// render downscales and encodes one output. img is only read, so several
+// renders may share it.
+func render(ctx context.Context, img image.Image, ct string, maxDim int, opts options) (*result, error) {
+	deep := opts.depth16 && is16Bit(img.ColorModel())
+	gray, isGray := img.(*image.Gray)
+	var cw, ch int
+	if opts.letterbox.ar != (aspect{}) {
+		cw, ch, maxDim = opts.letterbox.fit(img.Bounds(), maxDim)
+	}
+
+	// Downscale if needed
+	start := time.Now()
+	var resized image.Image
+	switch {
+	case deep:
+		resized = downscale16(img, maxDim)
+	case opts.linear:
+		resized = downscaleLinear(img, maxDim)
+	case isGray:
+		resized = downscaleGray(gray, maxDim)
+	default:
+		resized = downscale(img, maxDim)
+	}
+	observeStage(ctx, start, "resize")
+	if resized != img {
+		switch m := resized.(type) {
+		case *image.RGBA:
+			defer putRGBA(m)
+		case *image.Gray:
+			defer putGray(m)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cw > 0 {
+		canvas := opts.letterbox.place(resized, cw, ch)
+		if m, ok := canvas.(*image.RGBA); ok {
+			defer putRGBA(m)
+		}
+		resized = canvas
+	}
+	if opts.overlay != nil {
+		// After the resize so the logo is sized to this output.
+		start = time.Now()
+		resized = applyOverlay(resized, resized != img, opts.overlay)
+		observeStage(ctx, start, "overlay")
+	}
+	if opts.border.width > 0 {
+		// Framed last, over any overlay.
+		resized = drawBorder(resized, resized != img, opts.border)
+	}
+
+	// Decide output format:
+	// - If 16-bit depth is being kept => PNG (JPEG is 8-bit only)
+	// - If alpha exists => PNG (preserve transparency)
+	// - Else => JPEG (smaller for photos; single-channel for grayscale)
+	out := getBuffer()
+	var outCT string
+	var err error
+
+	_, grayOut := resized.(*image.Gray)
+	alpha := !grayOut && imageHasAlpha(resized)
+	start = time.Now()
+	switch {
+	case (deep || alpha) && opts.interlace:
+		outCT = "image/png"
+		err = encodeInterlacedPNG(out, resized, deep)
+	case deep || alpha:
+		outCT = "image/png"
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		err = enc.Encode(out, resized)
+	default:
+		outCT = "image/jpeg"
+		err = jpeg.Encode(out, resized, &jpeg.Options{Quality: opts.quality})
+	}
+	observeStage(ctx, start, "encode")
+	if err != nil {
+		putBuffer(out)
+		return nil, fmt.Errorf("failed to encode %s", outCT)
+	}
+
+	bounds := resized.Bounds()
+	return &result{
+		body:   out.Bytes(),
+		buf:    out,
+		ct:     outCT,
+		origCT: ct,
+		width:  bounds.Dx(),
+		height: bounds.Dy(),
+	}, nil
+}
+
+type imageFormat struct {
+	ct           string
+	decode       func(io.Reader) (image.Image, error)
+	decodeConfig func(io.Reader) (image.Config, error)
+}
+
+// Allow only jpg/jpeg/png/webp/tiff
+var imageFormats = []imageFormat{
+	{"image/jpeg", jpeg.Decode, jpeg.DecodeConfig},
+	{"image/png", png.Decode, png.DecodeConfig},
+	{"image/webp", webp.Decode, webp.DecodeConfig},
+	{"image/tiff", tiff.Decode, tiff.DecodeConfig},
+}
+
+// probeImage identifies the format and reads only the header, so oversized
+// images are rejected before a decoder allocates the full pixel buffer.
+func probeImage(b []byte, ct string) (imageFormat, image.Config, error) {
+	if ct == "image/jpg" {
+		ct = "image/jpeg"
+	}
+	for _, f := range imageFormats {
+		if f.ct == ct {
+			cfg, err := f.decodeConfig(bytes.NewReader(b))
+			return f, cfg, err
+		}
+	}
+	// Sometimes sniff returns "application/octet-stream"; try decode based on content too
+	// but still restrict to supported decoders:
+	for _, f := range imageFormats {
+		if cfg, err := f.decodeConfig(bytes.NewReader(b)); err == nil {
+			return f, cfg, nil
+		}
+	}
+	return imageFormat{}, image.Config{}, io.ErrUnexpectedEOF
+}
+
+// checkLimits guards against decompression bombs using only the header:
+// a small PNG or WebP can declare dimensions whose pixel buffer would take
+// gigabytes, or a 1×100000 strip that defeats the pixel limit's intent.
+func (s *server) checkLimits(cfg image.Config) error {
+	w, h := int64(cfg.Width), int64(cfg.Height)
+	if w <= 0 || h <= 0 {
+		return errUnsupportedImage
+	}
+	if w*h > int64(s.cfg.MaxPixels) {
+		return errTooManyPixels
+	}
+	long, short := w, h
+	if short > long {
+		long, short = short, long
+	}
+	if s.cfg.MaxAspectRatio > 0 && float64(long)/float64(short) > s.cfg.MaxAspectRatio {
+		return errAspectRatio
+	}
+	return nil
+}
+
+func downscale(src image.Image, maxDim int) image.Image {
+	nw, nh, ok := scaledSize(src.Bounds(), maxDim)
+	if !ok {
+		return src // no upscaling
+	}
+	src, release := prehalve(src, nw, nh)
+	defer release()
+
+	// draw.Src writes every destination pixel, so a recycled buffer needs no clearing.
+	dst := newRGBA(image.Rect(0, 0, nw, nh))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// downscaleGray keeps grayscale inputs at one byte per pixel; expanding
+// them to RGBA would quadruple the resize buffer and make the JPEG encoder
+// write three channels of identical data.
+func downscaleGray(src *image.Gray, maxDim int) image.Image {
+	nw, nh, ok := scaledSize(src.Bounds(), maxDim)
+	if !ok {
+		return src
+	}
+	dst := newGray(image.Rect(0, 0, nw, nh))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// downscale16 is downscale into a 16-bit-per-channel buffer. These are rare
+// enough (archival masters) not to be pooled.
+func downscale16(src image.Image, maxDim int) image.Image {
+	nw, nh, ok := scaledSize(src.Bounds(), maxDim)
+	if !ok {
+		return src
+	}
+	dst := image.NewRGBA64(image.Rect(0, 0, nw, nh))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// scaledSize fits b within maxDim keeping the aspect ratio; ok is false when
+// it already fits.
+func scaledSize(b image.Rectangle, maxDim int) (nw, nh int, ok bool) {
+	w := b.Dx()
+	h := b.Dy()
+
+	longest := w
+	if h > longest {
+		longest = h
+	}
+	if longest <= maxDim {
+		return w, h, false
+	}
+
+	if w >= h {
+		nw = maxDim
+		nh = int(float64(h) * (float64(maxDim) / float64(w)))
+	} else {
+		nh = maxDim
+		nw = int(float64(w) * (float64(maxDim) / float64(h)))
+	}
+	if nw < 1 {
+		nw = 1
+	}
+	if nh < 1 {
+		nh = 1
+	}
+	return nw, nh, true
+}
+
+func is16Bit(m color.Model) bool {
+	return m == color.RGBA64Model || m == color.NRGBA64Model || m == color.Gray16Model
+}
+
+func imageHasAlpha(img image.Image) bool {
+	// Cheap check: sample pixels in a grid; if any alpha < 255, treat as alpha.
+	b := img.Bounds()
+	stepX := max(1, b.Dx()/40)
+	stepY := max(1, b.Dy()/40)
+
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			_, _, _, a := img.At(x, y).RGBA()
+			if a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
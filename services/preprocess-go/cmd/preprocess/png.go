@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// image/png can only write non-interlaced files, so interlace=true outputs
+// go through this Adam7 encoder instead. It writes truecolor (with alpha
+// unless the image is opaque) at 8 or 16 bits, choosing a filter per row
+// the same way image/png does.
+
+// adam7 lists each pass as xStart, yStart, xStep, yStep.
+var adam7 = [7][4]int{
+	{0, 0, 8, 8}, {4, 0, 8, 8}, {0, 4, 4, 8}, {2, 0, 4, 4},
+	{0, 2, 2, 4}, {1, 0, 2, 2}, {0, 1, 1, 2},
+}
+
+func encodeInterlacedPNG(w io.Writer, img image.Image, deep bool) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+
+	// Flatten to non-premultiplied pixels, 4 channels of 1 or 2 bytes each.
+	var pix []byte
+	var stride, depth int
+	var opaque bool
+	if deep {
+		n := image.NewNRGBA64(image.Rect(0, 0, width, height))
+		draw.Draw(n, n.Bounds(), img, b.Min, draw.Src)
+		pix, stride, depth, opaque = n.Pix, n.Stride, 2, n.Opaque()
+	} else {
+		n, ok := img.(*image.NRGBA)
+		if !ok || n.Rect.Min != (image.Point{}) {
+			n = image.NewNRGBA(image.Rect(0, 0, width, height))
+			draw.Draw(n, n.Bounds(), img, b.Min, draw.Src)
+		}
+		pix, stride, depth, opaque = n.Pix, n.Stride, 1, n.Opaque()
+	}
+	channels, colorType := 4, byte(6)
+	if opaque {
+		channels, colorType = 3, 2
+	}
+	bpp := channels * depth
+
+	bw := bufio.NewWriter(w)
+	if _, err := io.WriteString(bw, "\x89PNG\r\n\x1a\n"); err != nil {
+		return err
+	}
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = byte(depth * 8)
+	ihdr[9] = colorType
+	ihdr[12] = 1 // Adam7
+	if err := writeChunk(bw, "IHDR", ihdr[:]); err != nil {
+		return err
+	}
+
+	idat := &chunkWriter{w: bw, name: "IDAT"}
+	zw, err := zlib.NewWriterLevel(idat, zlib.BestCompression)
+	if err != nil {
+		return err
+	}
+	for _, p := range adam7 {
+		pw := (width - p[0] + p[2] - 1) / p[2]
+		ph := (height - p[1] + p[3] - 1) / p[3]
+		if pw <= 0 || ph <= 0 {
+			continue
+		}
+		rowLen := pw * bpp
+		prev := make([]byte, rowLen)
+		cur := make([]byte, rowLen)
+		filtered := make([][]byte, 5)
+		for i := range filtered {
+			filtered[i] = make([]byte, 1+rowLen)
+			filtered[i][0] = byte(i)
+		}
+		for y := p[1]; y < height; y += p[3] {
+			row := pix[y*stride:]
+			i := 0
+			for x := p[0]; x < width; x += p[2] {
+				px := row[x*4*depth:]
+				copy(cur[i:i+bpp], px[:bpp]) // RGB(A), dropping A when opaque
+				i += bpp
+			}
+			if _, err := zw.Write(filterRow(filtered, cur, prev, bpp)); err != nil {
+				return err
+			}
+			prev, cur = cur, prev
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := idat.flush(); err != nil {
+		return err
+	}
+	if err := writeChunk(bw, "IEND", nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// filterRow applies all five PNG filters to cur and returns the one with the
+// smallest sum of absolute values, image/png's heuristic.
+func filterRow(out [][]byte, cur, prev []byte, bpp int) []byte {
+	copy(out[0][1:], cur)
+	for i := range cur {
+		var a, c int
+		if i >= bpp {
+			a, c = int(cur[i-bpp]), int(prev[i-bpp])
+		}
+		b := int(prev[i])
+		out[1][1+i] = cur[i] - byte(a)
+		out[2][1+i] = cur[i] - byte(b)
+		out[3][1+i] = cur[i] - byte((a+b)/2)
+		out[4][1+i] = cur[i] - paeth(a, b, c)
+	}
+	best, bestSum := out[0], -1
+	for _, f := range out {
+		sum := 0
+		for _, v := range f[1:] {
+			sum += abs8(v)
+		}
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = f, sum
+		}
+	}
+	return best
+}
+
+func paeth(a, b, c int) byte {
+	p := a + b - c
+	pa, pb, pc := absInt(p-a), absInt(p-b), absInt(p-c)
+	switch {
+	case pa <= pb && pa <= pc:
+		return byte(a)
+	case pb <= pc:
+		return byte(b)
+	}
+	return byte(c)
+}
+
+func abs8(v byte) int {
+	if int8(v) < 0 {
+		return -int(int8(v))
+	}
+	return int(v)
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func writeChunk(w io.Writer, name string, data []byte) error {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(data)))
+	copy(hdr[4:], name)
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(data)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	for _, p := range [][]byte{hdr[:], data, sum[:]} {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkWriter splits a stream into chunks of up to 64KB.
+type chunkWriter struct {
+	w    io.Writer
+	name string
+	buf  []byte
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		k := min(len(p), 1<<16-len(c.buf))
+		c.buf = append(c.buf, p[:k]...)
+		p = p[k:]
+		if len(c.buf) == 1<<16 {
+			if err := c.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (c *chunkWriter) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	err := writeChunk(c.w, c.name, c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"sync"
+)
+
+// Per-request output buffers and resize targets dominate allocations, so
+// both are recycled. Anything bigger than the largest default output is left
+// to the GC rather than pinned in the pool.
+const maxPooledBytes = 4 * 3000 * 3000
+
+var bufPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+func getBuffer() *bytes.Buffer {
+	b := bufPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBytes {
+		return
+	}
+	bufPool.Put(b)
+}
+
+var pixPool sync.Pool // *[]uint8
+
+// newRGBA returns an RGBA image that may reuse a previous Pix slice. The
+// contents are NOT zeroed; callers must overwrite every pixel (draw.Src).
+func newRGBA(r image.Rectangle) *image.RGBA {
+	n := 4 * r.Dx() * r.Dy()
+	if p, ok := pixPool.Get().(*[]uint8); ok && cap(*p) >= n {
+		return &image.RGBA{Pix: (*p)[:n], Stride: 4 * r.Dx(), Rect: r}
+	}
+	return image.NewRGBA(r)
+}
+
+func putRGBA(img *image.RGBA) {
+	putPix(img.Pix)
+}
+
+// newGray is newRGBA for grayscale outputs, drawing from the same pool.
+func newGray(r image.Rectangle) *image.Gray {
+	n := r.Dx() * r.Dy()
+	if p, ok := pixPool.Get().(*[]uint8); ok && cap(*p) >= n {
+		return &image.Gray{Pix: (*p)[:n], Stride: r.Dx(), Rect: r}
+	}
+	return image.NewGray(r)
+}
+
+func putGray(img *image.Gray) {
+	putPix(img.Pix)
+}
+
+func putPix(pix []uint8) {
+	if cap(pix) > maxPooledBytes {
+		return
+	}
+	pix = pix[:0]
+	pixPool.Put(&pix)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Requests wait for a worker in one of two lanes: interactive, the default,
+// for real-time app uploads, and batch for backfills, which only get a slot
+// when no interactive request is waiting. A request picks its lane with
+// X-Priority: interactive|batch. PRIORITY_CLASSES ties callers to a lane; a
+// caller tied to batch stays there whatever it sends, so a backfill can't
+// jump the queue, while any caller may volunteer for batch.
+//
+// Within a lane, clients take turns: each freed slot goes to the next
+// client, by clientKey as for rate limiting, that has a request waiting, so
+// one tenant's bulk import adds one job's latency to everyone else's
+// requests, not the length of its backlog. Clients are the verified caller
+// or the IP, never a header the client picks, or a bulk importer could take
+// a turn per request by varying it.
+
+// parseLane reads a lane name.
+func parseLane(v string) (int, bool) {
+	for lane, name := range laneNames {
+		if v == name {
+			return lane, true
+		}
+	}
+	return 0, false
+}
+
+// parsePriorityClasses reads "caller:lane" entries.
+func parsePriorityClasses(v string) (map[string]int, error) {
+	classes := map[string]int{}
+	for _, e := range splitList(v) {
+		// Callers like cert:<cn> contain a colon themselves.
+		i := strings.LastIndex(e, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q: want caller:interactive or caller:batch", e)
+		}
+		lane, ok := parseLane(e[i+1:])
+		if !ok {
+			return nil, fmt.Errorf("%q: class must be interactive or batch", e)
+		}
+		classes[e[:i]] = lane
+	}
+	return classes, nil
+}
+
+// prioritize puts the request in its lane and records its client. It sits
+// after authenticate: the caller's class bounds what X-Priority can ask for,
+// and its name is the client.
+func (s *server) prioritize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lane := s.priorities[callerName(r.Context())]
+		if v := r.Header.Get("X-Priority"); v != "" {
+			asked, ok := parseLane(strings.ToLower(strings.TrimSpace(v)))
+			if !ok {
+				reject(w, r, http.StatusBadRequest, "invalid_param", fmt.Sprintf("X-Priority must be interactive or batch, got %q", v))
+				return
+			}
+			lane = max(lane, asked)
+		}
+		setSchedule(r.Context(), lane, clientKey(r))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quotaLimit is a per-caller daily allowance; zero means unlimited.
+type quotaLimit struct {
+	Images int64 `json:"images"`
+	Bytes  int64 `json:"bytes"`
+}
+
+type quotaUsage struct {
+	Images int64 `json:"images"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// quotaTracker accounts processed images and input bytes per authenticated
+// caller per UTC day. Counters live in Redis when configured so every
+// instance charges the same budget, with a local fallback if Redis errors.
+// Usage is charged after a request succeeds, so a burst of concurrent
+// requests can overshoot a limit by at most that burst.
+type quotaTracker struct {
+	limits map[string]quotaLimit // by caller name; "*" applies to the rest
+	redis  *redisClient
+
+	mu    sync.Mutex
+	day   string
+	local map[string]*quotaUsage
+}
+
+// parseQuotas reads "name:images:bytes" entries; either number may be 0 for
+// no limit on that dimension, name "*" sets the default and "@tenant" a
+// tenant's shared budget.
+func parseQuotas(v string) (map[string]quotaLimit, error) {
+	limits := map[string]quotaLimit{}
+	for _, e := range splitList(v) {
+		parts := strings.Split(e, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("quota %q: want name:images:bytes", e)
+		}
+		images, err1 := strconv.ParseInt(parts[1], 10, 64)
+		bytes, err2 := strconv.ParseInt(parts[2], 10, 64)
+		if err1 != nil || err2 != nil || images < 0 || bytes < 0 {
+			return nil, fmt.Errorf("quota %q: bad number", e)
+		}
+		limits[parts[0]] = quotaLimit{images, bytes}
+	}
+	return limits, nil
+}
+
+func newQuotaTracker(limits map[string]quotaLimit, redis *redisClient) *quotaTracker {
+	return &quotaTracker{limits: limits, redis: redis, local: map[string]*quotaUsage{}}
+}
+
+func (q *quotaTracker) limitFor(name string) (quotaLimit, bool) {
+	if l, ok := q.limits[name]; ok {
+		return l, true
+	}
+	l, ok := q.limits["*"]
+	return l, ok
+}
+
+// tenantLimit is the budget a tenant's callers share. The "*" default is
+// per caller and doesn't apply.
+func (q *quotaTracker) tenantLimit(tenant string) (quotaLimit, bool) {
+	l, ok := q.limits["@"+tenant]
+	return l, ok
+}
+
+func quotaDay(now time.Time) string { return now.UTC().Format("2006-01-02") }
+
+func quotaResetsAt(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+func (q *quotaTracker) redisKey(day, name string) string {
+	return "pp:quota:" + day + ":" + name
+}
+
+func (q *quotaTracker) usage(ctx context.Context, name string) quotaUsage {
+	day := quotaDay(time.Now())
+	if q.redis != nil {
+		reply, err := q.redis.do(ctx, "HMGET", q.redisKey(day, name), "images", "bytes")
+		if items, ok := reply.([]any); err == nil && ok && len(items) == 2 {
+			return quotaUsage{Images: redisInt(items[0]), Bytes: redisInt(items[1])}
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover(day)
+	if u := q.local[name]; u != nil {
+		return *u
+	}
+	return quotaUsage{}
+}
+
+func (q *quotaTracker) charge(ctx context.Context, name string, images, bytes int64) {
+	day := quotaDay(time.Now())
+	if q.redis != nil {
+		key := q.redisKey(day, name)
+		_, err1 := q.redis.do(ctx, "HINCRBY", key, "images", strconv.FormatInt(images, 10))
+		_, err2 := q.redis.do(ctx, "HINCRBY", key, "bytes", strconv.FormatInt(bytes, 10))
+		if err1 == nil && err2 == nil {
+			_, _ = q.redis.do(ctx, "EXPIRE", key, "172800") // keep yesterday for /usage lookbacks
+			return
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover(day)
+	u := q.local[name]
+	if u == nil {
+		u = &quotaUsage{}
+		q.local[name] = u
+	}
+	u.Images += images
+	u.Bytes += bytes
+}
+
+// rollover drops local counters at the UTC day boundary. Callers hold mu.
+func (q *quotaTracker) rollover(day string) {
+	if q.day != day {
+		q.day = day
+		clear(q.local)
+	}
+}
+
+func redisInt(v any) int64 {
+	b, _ := v.([]byte)
+	n, _ := strconv.ParseInt(string(b), 10, 64)
+	return n
+}
+
+func (u quotaUsage) exceeds(l quotaLimit) bool {
+	return (l.Images > 0 && u.Images >= l.Images) || (l.Bytes > 0 && u.Bytes >= l.Bytes)
+}
+
+// enforceQuota refuses callers that have used up today's allowance, or
+// whose tenant has. It sits after authenticate and scopeTenant; anonymous
+// requests are only metered against their tenant.
+func (s *server) enforceQuota(next http.Handler) http.Handler {
+	if s.quotas == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := callerName(r.Context())
+		exhausted := ""
+		if limit, ok := s.quotas.limitFor(name); name != "" && ok && s.quotas.usage(r.Context(), name).exceeds(limit) {
+			exhausted = "daily quota exhausted"
+		}
+		tenant := tenantName(r.Context())
+		if limit, ok := s.quotas.tenantLimit(tenant); tenant != "" && ok && s.quotas.usage(r.Context(), "@"+tenant).exceeds(limit) {
+			exhausted = "tenant's daily quota exhausted"
+		}
+		if exhausted != "" {
+			now := time.Now()
+			w.Header().Set("Retry-After", strconv.Itoa(int(quotaResetsAt(now).Sub(now).Seconds())+1))
+			reject(w, r, http.StatusTooManyRequests, "quota_exceeded", exhausted)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// usageHandler reports the calling key's consumption for the current day,
+// and its tenant's.
+func (s *server) usageHandler(w http.ResponseWriter, r *http.Request) {
+	name := callerName(r.Context())
+	if name == "" {
+		reject(w, r, http.StatusUnauthorized, "unauthorized", "usage is only tracked for authenticated callers")
+		return
+	}
+	type tenantUsage struct {
+		Name  string      `json:"name"`
+		Used  quotaUsage  `json:"used"`
+		Limit *quotaLimit `json:"limit,omitempty"`
+	}
+	body := struct {
+		Caller   string       `json:"caller"`
+		Day      string       `json:"day"`
+		Used     quotaUsage   `json:"used"`
+		Limit    *quotaLimit  `json:"limit,omitempty"`
+		Tenant   *tenantUsage `json:"tenant,omitempty"`
+		ResetsAt time.Time    `json:"resets_at"`
+	}{Caller: name, Day: quotaDay(time.Now()), ResetsAt: quotaResetsAt(time.Now())}
+	if t := tenantName(r.Context()); t != "" {
+		body.Tenant = &tenantUsage{Name: t}
+	}
+	if s.quotas != nil {
+		body.Used = s.quotas.usage(r.Context(), name)
+		if l, ok := s.quotas.limitFor(name); ok {
+			body.Limit = &l
+		}
+		if body.Tenant != nil {
+			body.Tenant.Used = s.quotas.usage(r.Context(), "@"+body.Tenant.Name)
+			if l, ok := s.quotas.tenantLimit(body.Tenant.Name); ok {
+				body.Tenant.Limit = &l
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket per client key.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // tokens per second; 0 lets everything through
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: map[string]*bucket{}, lastSweep: time.Now()}
+}
+
+// setRate changes the limits in place; existing buckets keep their tokens,
+// capped at the new burst on their next refill.
+func (l *rateLimiter) setRate(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate <= 0 {
+		clear(l.buckets)
+	}
+	l.rate, l.burst = rate, float64(burst)
+}
+
+func (l *rateLimiter) limits() (rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate, int(l.burst)
+}
+
+// allow takes a token for key, or reports how long until one is available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.sweepLocked(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweepLocked drops buckets that have refilled completely; they are
+// indistinguishable from a fresh bucket, so forgetting them is free.
+func (l *rateLimiter) sweepLocked(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, k)
+		}
+	}
+	l.lastSweep = now
+}
+
+// clientKey identifies the caller: the verified caller name, otherwise the
+// remote IP. An unverified X-Api-Key is not used, since a client could send
+// a new one with every request to get a fresh bucket each time.
+func clientKey(r *http.Request) string {
+	if name := callerName(r.Context()); name != "" {
+		return "name:" + name
+	}
+	return "ip:" + clientIP(r)
+}
+
+func (s *server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := s.limiter.allow(clientKey(r), time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			reject(w, r, http.StatusTooManyRequests, "rate_limited", "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// redact=x,y,w,h;... hides moderator-chosen regions (phone numbers, names
+// on receipts) before resizing. Regions are in the upload's pixel
+// coordinates and may run off its edges.
+const maxRedactRegions = 32
+
+// redactBlocks is roughly how many pixelation blocks span a region's
+// shorter side: few enough that text can't be read back.
+const redactBlocks = 6
+
+type redaction struct {
+	regions  []image.Rectangle
+	pixelate bool // otherwise filled black
+}
+
+func redactParam(r *http.Request) (redaction, error) {
+	q := r.URL.Query()
+	var red redaction
+	switch v := q.Get("redact_mode"); v {
+	case "", "black":
+	case "pixelate":
+		red.pixelate = true
+	default:
+		return redaction{}, fmt.Errorf("redact_mode must be black or pixelate, got %q", v)
+	}
+	v := q.Get("redact")
+	if v == "" {
+		return red, nil
+	}
+	for _, e := range strings.Split(v, ";") {
+		parts := strings.Split(e, ",")
+		var n [4]int
+		ok := len(parts) == 4
+		for i := 0; ok && i < 4; i++ {
+			var err error
+			n[i], err = strconv.Atoi(strings.TrimSpace(parts[i]))
+			ok = err == nil && n[i] >= 0
+		}
+		if !ok || n[2] == 0 || n[3] == 0 {
+			return redaction{}, fmt.Errorf("redact region %q: want x,y,w,h with w and h above 0", e)
+		}
+		red.regions = append(red.regions, image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3]))
+	}
+	if len(red.regions) > maxRedactRegions {
+		return redaction{}, fmt.Errorf("at most %d redact regions", maxRedactRegions)
+	}
+	return red, nil
+}
+
+// querySemicolons escapes ";" in the query so redact's separator survives:
+// Go's form parsing rejects unescaped semicolons outright. It wraps the
+// handler itself, after authentication has checked the URI as signed.
+func querySemicolons(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.RawQuery = strings.ReplaceAll(r.URL.RawQuery, ";", "%3B")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redactImage applies red to a copy of img. Regions are scaled from the
+// upload's size (cfg) in case img came from the EXIF thumbnail.
+func redactImage(img image.Image, cfg image.Config, red redaction) image.Image {
+	bounds := img.Bounds()
+	dst := mutableCopy(img)
+	sx := float64(bounds.Dx()) / float64(cfg.Width)
+	sy := float64(bounds.Dy()) / float64(cfg.Height)
+	for _, reg := range red.regions {
+		r := image.Rect(
+			int(float64(reg.Min.X)*sx), int(float64(reg.Min.Y)*sy),
+			int(math.Ceil(float64(reg.Max.X)*sx)), int(math.Ceil(float64(reg.Max.Y)*sy)),
+		).Add(bounds.Min).Intersect(bounds)
+		if r.Empty() {
+			continue
+		}
+		if !red.pixelate {
+			draw.Draw(dst, r, image.Black, image.Point{}, draw.Src)
+			continue
+		}
+		block := max(1, min(r.Dx(), r.Dy())/redactBlocks)
+		small := image.NewRGBA(image.Rect(0, 0, max(1, r.Dx()/block), max(1, r.Dy()/block)))
+		draw.CatmullRom.Scale(small, small.Bounds(), dst, r, draw.Src, nil)
+		draw.NearestNeighbor.Scale(dst, r, small, small.Bounds(), draw.Src, nil)
+	}
+	return dst
+}
+
+// drawable returns img itself when render owns it (owned) and it can be
+// drawn on, and otherwise a copy that keeps 16-bit depth.
+func drawable(img image.Image, owned bool) draw.Image {
+	switch m := img.(type) {
+	case *image.RGBA:
+		if owned {
+			return m
+		}
+	case *image.RGBA64:
+		if owned {
+			return m
+		}
+	}
+	if is16Bit(img.ColorModel()) {
+		b := img.Bounds()
+		dst := image.NewRGBA64(b)
+		draw.Draw(dst, b, img, b.Min, draw.Src)
+		return dst
+	}
+	return mutableCopy(img)
+}
+
+// mutableCopy returns an RGBA copy of img for edits that must not touch the
+// decoded image, which may be shared.
+func mutableCopy(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, img, b.Min, draw.Src)
+	return dst
+}
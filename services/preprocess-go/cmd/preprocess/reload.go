@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// configWatchInterval is how often the config file's mtime is checked.
+// SIGHUP reloads immediately.
+const configWatchInterval = 5 * time.Second
+
+// liveConfig is the part of config that takes effect without a restart.
+// Handlers load it once per request so a reload never mixes old and new.
+type liveConfig struct {
+	defaultMaxDim, minDim, maxDim          int
+	defaultQuality, minQuality, maxQuality int
+	presets                                map[string]url.Values
+	overlays                               map[string]*overlay
+}
+
+// live also loads the overlay assets, the one part that can fail.
+func (c config) live() (*liveConfig, error) {
+	overlays, err := loadOverlays(c.Overlays)
+	if err != nil {
+		return nil, err
+	}
+	return &liveConfig{
+		defaultMaxDim: c.DefaultMaxDim, minDim: c.MinDim, maxDim: c.MaxDim,
+		defaultQuality: c.DefaultQuality, minQuality: c.MinQuality, maxQuality: c.MaxQuality,
+		presets: c.Presets, overlays: overlays,
+	}, nil
+}
+
+// reloadable lists the config fields applyConfig picks up; changes to any
+// other field are logged and wait for the next restart.
+var reloadable = map[string]bool{
+	"DefaultMaxDim": true, "MinDim": true, "MaxDim": true,
+	"DefaultQuality": true, "MinQuality": true, "MaxQuality": true, "Presets": true, "Overlays": true,
+	"RateLimitRPS": true, "RateLimitBurst": true,
+}
+
+type configWatcher struct {
+	path string
+
+	mu      sync.Mutex // reload runs from the watcher and POST /admin/reload
+	last    config     // as loaded, before secret references were resolved
+	modTime time.Time
+}
+
+func newConfigWatcher(path string, loaded config) *configWatcher {
+	w := &configWatcher{path: path, last: loaded}
+	if fi, err := os.Stat(path); err == nil {
+		w.modTime = fi.ModTime()
+	}
+	return w
+}
+
+// watch reloads on SIGHUP and whenever the file's mtime moves.
+func (w *configWatcher) watch(ctx context.Context, s *server) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	t := time.NewTicker(configWatchInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-t.C:
+			if !w.changed() {
+				continue
+			}
+		}
+		if err := w.reload(s); err != nil {
+			slog.Error("config reload failed; keeping previous settings", "path", w.path, "err", err)
+		}
+	}
+}
+
+func (w *configWatcher) changed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fi, err := os.Stat(w.path)
+	if err != nil || fi.ModTime().Equal(w.modTime) {
+		return false
+	}
+	w.modTime = fi.ModTime()
+	return true
+}
+
+func (w *configWatcher) reload(s *server) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fileMu.Lock()
+	prevSettings, prevPresets, prevOverlays := fileSettings, filePresets, fileOverlays
+	fileMu.Unlock()
+	if err := loadConfigFile(w.path); err != nil {
+		return err
+	}
+	cfg := loadConfig()
+	err := cfg.validate()
+	var live *liveConfig
+	if err == nil {
+		live, err = cfg.live()
+	}
+	if err != nil {
+		fileMu.Lock()
+		fileSettings, filePresets, fileOverlays = prevSettings, prevPresets, prevOverlays
+		fileMu.Unlock()
+		return err
+	}
+	prev, next := reflect.ValueOf(w.last), reflect.ValueOf(cfg)
+	for i := 0; i < prev.NumField(); i++ {
+		name := prev.Type().Field(i).Name
+		if !reloadable[name] && !reflect.DeepEqual(prev.Field(i).Interface(), next.Field(i).Interface()) {
+			slog.Warn("config change takes effect on restart", "field", name)
+		}
+	}
+	w.last = cfg
+	s.applyConfig(cfg, live)
+	slog.Info("config reloaded", "path", w.path)
+	return nil
+}
+
+// applyConfig swaps in the reloadable settings.
+func (s *server) applyConfig(cfg config, live *liveConfig) {
+	s.live.Store(live)
+	s.limiter.setRate(cfg.RateLimitRPS, cfg.RateLimitBurst)
+}
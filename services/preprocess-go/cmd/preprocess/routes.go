@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h in mw, the first being outermost.
+func chain(h http.Handler, mw ...middleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+func logging(slow time.Duration) middleware {
+	return func(next http.Handler) http.Handler { return logRequests(slow, next) }
+}
+
+// imageRoute is the middleware every image endpoint runs behind, so their
+// order can't drift apart. auth is s.authenticate except for Thumbor URLs,
+// whose signature can stand in for it; quota is off for /validate, which
+// produces nothing to charge for. CORS is left to the caller since Thumbor
+// URLs are loaded as plain images.
+func (s *server) imageRoute(h http.Handler, auth middleware, quota bool) http.Handler {
+	mw := []middleware{logging(s.cfg.SlowRequestThreshold), instrument, s.recoverPanics, s.ipFilter, auth,
+		s.scopeTenant, s.prioritize, s.debugHeaders}
+	if quota {
+		mw = append(mw, s.enforceQuota)
+	}
+	return chain(h, append(mw, s.rateLimit)...)
+}
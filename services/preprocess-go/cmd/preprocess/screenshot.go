@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"image"
+	"net/http"
+	"strings"
+)
+
+// Screenshots of someone else's post get uploaded as dish photos. Uploads
+// that look like one are flagged, not refused, so the backend can send them
+// through its "is this really your photo?" flow: X-Screenshot: likely on
+// the response, and "screenshot":{"likely":true,"signals":[…]} in the store=
+// response, the dish callback and the processed event.
+//
+// The signals are device_resolution, the exact size of a phone or tablet
+// screen; png, which is how phones save screenshots but not photos; and
+// status_bar, a flat band across the top with the clock and battery at its
+// ends. Any one of them happens in real photos, so it takes two. status_bar
+// needs the pixels and so is only looked for when one other signal has
+// fired, which costs PNGs and screen-sized JPEGs a second, small decode.
+
+type screenshotInfo struct {
+	Likely  bool     `json:"likely"`
+	Signals []string `json:"signals"`
+}
+
+// screenSizes are the native portrait resolutions of common phones and
+// tablets, short side by long side.
+var screenSizes = map[[2]int]bool{
+	// iPhone
+	{640, 1136}: true, {750, 1334}: true, {1242, 2208}: true, {1125, 2436}: true,
+	{828, 1792}: true, {1242, 2688}: true, {1170, 2532}: true, {1284, 2778}: true,
+	{1080, 2340}: true, {1179, 2556}: true, {1290, 2796}: true, {1206, 2622}: true,
+	{1320, 2868}: true,
+	// Android
+	{720, 1280}: true, {720, 1600}: true, {1080, 1920}: true, {1080, 2160}: true,
+	{1080, 2220}: true, {1080, 2280}: true, {1080, 2400}: true, {1080, 2408}: true,
+	{1440, 2560}: true, {1440, 2960}: true, {1440, 3040}: true, {1440, 3088}: true,
+	{1440, 3120}: true, {1440, 3200}: true, {1344, 2992}: true, {1280, 2856}: true,
+	// iPad
+	{1536, 2048}: true, {1620, 2160}: true, {1640, 2360}: true, {1668, 2224}: true,
+	{1668, 2388}: true, {2048, 2732}: true,
+}
+
+// detectScreenshot returns the screenshot signals b shows, or nil if it
+// shows none. Only a result with Likely set is worth reporting.
+func (s *server) detectScreenshot(ctx context.Context, b []byte, ct string) (*screenshotInfo, error) {
+	f, cfg, err := probeImage(b, ct)
+	if err != nil {
+		return nil, nil // the pipeline rejects it
+	}
+	var signals []string
+	if screenSizes[[2]int{min(cfg.Width, cfg.Height), max(cfg.Width, cfg.Height)}] {
+		signals = append(signals, "device_resolution")
+	}
+	if f.ct == "image/png" {
+		signals = append(signals, "png")
+	}
+	if len(signals) == 1 && s.checkLimits(cfg) == nil {
+		var bar bool
+		err := s.runJob(ctx, func(ctx context.Context) error {
+			img, err := s.decodeFor(ctx, f, b, cfg, energyDim)
+			if err != nil {
+				return err
+			}
+			bar = hasStatusBar(grayThumb(img))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if bar {
+			signals = append(signals, "status_bar")
+		}
+	}
+	if len(signals) == 0 {
+		return nil, nil
+	}
+	return &screenshotInfo{Likely: len(signals) >= 2, Signals: signals}, nil
+}
+
+// hasStatusBar looks for a phone status bar across the top of small: a
+// band, a few percent of the height, that is one flat shade but for
+// something drawn at both ends.
+func hasStatusBar(small *image.Gray) bool {
+	w, h := small.Rect.Dx(), small.Rect.Dy()
+	band := max(2, h*4/100)
+	if h < w || w < 24 {
+		return false // status bars are a portrait thing
+	}
+	var hist [256]int
+	for y := 0; y < band; y++ {
+		for _, v := range small.Pix[y*small.Stride : y*small.Stride+w] {
+			hist[v]++
+		}
+	}
+	bg := 0
+	for v, n := range hist {
+		if n > hist[bg] {
+			bg = v
+		}
+	}
+	// The bar is drawn, not photographed: its shade is exact but for
+	// compression, and nothing sits in the middle, where the notch is.
+	const tolerance = 6
+	var plain, left, middle, right int
+	for y := 0; y < band; y++ {
+		for x, v := range small.Pix[y*small.Stride : y*small.Stride+w] {
+			switch {
+			case int(v) >= bg-tolerance && int(v) <= bg+tolerance:
+				plain++
+			case x < w/3:
+				left++
+			case x < w*2/3:
+				middle++
+			default:
+				right++
+			}
+		}
+	}
+	total := band * w
+	return plain*100 >= total*85 && left > 0 && right > 0 && middle*100 <= total/3*2
+}
+
+// flagScreenshot records a likely screenshot for the response headers and
+// the metadata that follows the request.
+func flagScreenshot(w http.ResponseWriter, r *http.Request, sc *screenshotInfo) {
+	if sc == nil {
+		return
+	}
+	logAttrs(r.Context(), "screenshot_signals", strings.Join(sc.Signals, ","))
+	if !sc.Likely {
+		return
+	}
+	setScreenshot(r.Context(), sc)
+	w.Header().Set("X-Screenshot", "likely")
+}
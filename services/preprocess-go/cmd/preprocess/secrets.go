@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// secretResolver turns secret references in config values into the secret
+// itself, so credentials can live in Vault or AWS Secrets Manager instead of
+// plain env vars:
+//
+//	vault://secret/data/preprocess#api_keys   Vault KV (v1 or v2) field
+//	awssm://prod/preprocess#hmac_keys         Secrets Manager JSON field
+//	awssm://prod/preprocess                   Secrets Manager string as-is
+//
+// Any other value is returned unchanged.
+type secretResolver struct {
+	client *http.Client
+
+	vaultAddr      string
+	vaultToken     string
+	vaultTokenFile string // re-read per call so agent-renewed tokens are used
+	vaultNamespace string
+
+	awsRegion   string
+	awsEndpoint string // override for testing or VPC endpoints
+	awsMu       sync.Mutex
+	aws         *secretsmanager.Client // nil until the first awssm:// lookup
+}
+
+func newSecretResolver() *secretResolver {
+	return &secretResolver{
+		client:         &http.Client{Timeout: 10 * time.Second},
+		vaultAddr:      strings.TrimRight(setting("VAULT_ADDR"), "/"),
+		vaultToken:     os.Getenv("VAULT_TOKEN"),
+		vaultTokenFile: setting("VAULT_TOKEN_FILE"),
+		vaultNamespace: setting("VAULT_NAMESPACE"),
+		awsRegion:      envString("AWS_REGION", setting("AWS_DEFAULT_REGION")),
+		awsEndpoint:    setting("AWS_ENDPOINT_URL_SECRETS_MANAGER"),
+	}
+}
+
+func isSecretRef(v string) bool {
+	return strings.HasPrefix(v, "vault://") || strings.HasPrefix(v, "awssm://")
+}
+
+func (sr *secretResolver) resolve(ctx context.Context, v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, "vault://"):
+		path, field, _ := strings.Cut(strings.TrimPrefix(v, "vault://"), "#")
+		return sr.vault(ctx, path, field)
+	case strings.HasPrefix(v, "awssm://"):
+		id, field, _ := strings.Cut(strings.TrimPrefix(v, "awssm://"), "#")
+		return sr.awsSecret(ctx, id, field)
+	}
+	return v, nil
+}
+
+func (sr *secretResolver) vault(ctx context.Context, path, field string) (string, error) {
+	if sr.vaultAddr == "" || field == "" {
+		return "", errors.New("vault: need VAULT_ADDR and a #field in the reference")
+	}
+	token := sr.vaultToken
+	if sr.vaultTokenFile != "" {
+		b, err := os.ReadFile(sr.vaultTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("vault: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sr.vaultAddr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if sr.vaultNamespace != "" {
+		req.Header.Set("X-Vault-Namespace", sr.vaultNamespace)
+	}
+	var body struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := sr.doJSON(req, &body); err != nil {
+		return "", fmt.Errorf("vault %s: %w", path, err)
+	}
+	data := body.Data
+	if inner, ok := data["data"].(map[string]any); ok { // KV v2 nests the secret
+		data = inner
+	}
+	s, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault %s: no string field %q", path, field)
+	}
+	return s, nil
+}
+
+func (sr *secretResolver) awsSecret(ctx context.Context, id, field string) (string, error) {
+	client, err := sr.secretsManager(ctx)
+	if err != nil {
+		return "", err
+	}
+	var opts []func(*secretsmanager.Options)
+	if arn := strings.Split(id, ":"); len(arn) > 3 && arn[0] == "arn" {
+		opts = append(opts, func(o *secretsmanager.Options) { o.Region = arn[3] })
+	} else if client.Options().Region == "" {
+		return "", errors.New("secretsmanager: AWS_REGION not set")
+	}
+	out, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)}, opts...)
+	if err != nil {
+		return "", fmt.Errorf("secretsmanager %s: %w", id, err)
+	}
+	secret := aws.ToString(out.SecretString)
+	if field == "" {
+		return secret, nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secretsmanager %s: secret is not JSON", id)
+	}
+	s, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("secretsmanager %s: no string field %q", id, field)
+	}
+	return s, nil
+}
+
+// secretsManager sets up the Secrets Manager client on first use. It takes
+// credentials from the SDK's default chain (env vars, shared config, web
+// identity as with IRSA, ECS and EC2 instance roles) and refreshes them
+// before they expire.
+func (sr *secretResolver) secretsManager(ctx context.Context) (*secretsmanager.Client, error) {
+	sr.awsMu.Lock()
+	defer sr.awsMu.Unlock()
+	if sr.aws != nil {
+		return sr.aws, nil
+	}
+	var opts []func(*awsconfig.LoadOptions) error
+	if sr.awsRegion != "" {
+		opts = append(opts, awsconfig.WithRegion(sr.awsRegion))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("secretsmanager: %w", err)
+	}
+	sr.aws = secretsmanager.NewFromConfig(cfg, func(o *secretsmanager.Options) {
+		if sr.awsEndpoint != "" {
+			o.BaseEndpoint = aws.String(sr.awsEndpoint)
+		}
+	})
+	return sr.aws, nil
+}
+
+func (sr *secretResolver) doJSON(req *http.Request, v any) error {
+	resp, err := sr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// loadCredentials (re)builds API keys and HMAC secrets from config, secret
+// references and key files. On rotation a failure keeps the previous set.
+func (s *server) loadCredentials(ctx context.Context) error {
+	apiInline, err := s.secrets.resolve(ctx, s.cfg.APIKeys)
+	if err != nil {
+		return err
+	}
+	keys, err := loadAPIKeys(apiInline, s.cfg.APIKeysFile)
+	if err != nil {
+		return fmt.Errorf("api keys: %w", err)
+	}
+	hmacInline, err := s.secrets.resolve(ctx, s.cfg.HMACKeys)
+	if err != nil {
+		return err
+	}
+	hmacKeys, err := readNamedSecrets(hmacInline, s.cfg.HMACKeysFile)
+	if err != nil {
+		return fmt.Errorf("hmac keys: %w", err)
+	}
+
+	if keys != nil {
+		s.apiKeys.Store(&keys)
+	}
+	switch {
+	case s.hmac != nil && len(hmacKeys) > 0:
+		s.hmac.setSecrets(hmacKeys)
+	case len(hmacKeys) > 0:
+		s.hmac = newHMACVerifier(hmacKeys, s.cfg.HMACMaxSkew, s.redis, s.maxUploadLimit())
+	}
+	return nil
+}
+
+func (s *server) rotatableCredentials() bool {
+	return isSecretRef(s.cfg.APIKeys) || isSecretRef(s.cfg.HMACKeys) ||
+		s.cfg.APIKeysFile != "" || s.cfg.HMACKeysFile != "" || len(s.rotating) > 0
+}
+
+// secretSettings are the config values other than keys that may hold a
+// secret reference, by env var.
+func (s *server) secretSettings() map[string]*string {
+	return map[string]*string{
+		"REDIS_URL": &s.cfg.RedisURL, "SENTRY_DSN": &s.cfg.SentryDSN,
+		"CLOUDFLARE_API_TOKEN": &s.cfg.CloudflareAPIToken, "CLOUDINARY_URL": &s.cfg.CloudinaryURL,
+		"THUMBOR_SECURITY_KEY": &s.cfg.ThumborSecurityKey, "POSTGRES_URL": &s.cfg.PostgresURL,
+		"MODERATION_WEBHOOK_URL": &s.cfg.ModerationWebhookURL, "BACKEND_TOKEN": &s.cfg.BackendToken,
+		"ADMIN_TOKEN": &s.cfg.AdminToken,
+	}
+}
+
+// secretValue is a credential that rotation may replace while requests
+// are reading it.
+type secretValue struct {
+	p atomic.Pointer[string]
+}
+
+func (sv *secretValue) get() string {
+	if v := sv.p.Load(); v != nil {
+		return *v
+	}
+	return ""
+}
+
+func (sv *secretValue) set(v string) {
+	sv.p.Store(&v)
+}
+
+// rotatingSecret is a setting given as a secret reference, re-resolved
+// with the keys. apply hands a new value to whatever uses it.
+type rotatingSecret struct {
+	name  string
+	ref   string
+	value string // as last resolved
+	apply func(string) error
+}
+
+// watchSecrets lists the settings in refs (env var to reference) for
+// rotation, once the clients that use them are set up.
+func (s *server) watchSecrets(refs map[string]string) {
+	apply := map[string]func(string) error{
+		"REDIS_URL": func(v string) error {
+			if s.redis != nil {
+				return s.redis.rotate(v)
+			}
+			return nil
+		},
+		"SENTRY_DSN": func(v string) error {
+			if r, ok := s.reporter.(*sentryReporter); ok {
+				return r.rotate(v)
+			}
+			return nil
+		},
+		"CLOUDFLARE_API_TOKEN": func(v string) error {
+			if st, ok := s.stores["cloudflare"].(*cloudflareStore); ok {
+				st.token.set(v)
+			}
+			return nil
+		},
+		"CLOUDINARY_URL": func(v string) error {
+			if st, ok := s.stores["cloudinary"].(*cloudinaryStore); ok {
+				return st.rotate(v)
+			}
+			return nil
+		},
+		"THUMBOR_SECURITY_KEY": func(v string) error { s.thumborKey.set(v); return nil },
+		"POSTGRES_URL": func(v string) error {
+			if s.catalog != nil {
+				return s.catalog.rotate(v)
+			}
+			return nil
+		},
+		"MODERATION_WEBHOOK_URL": func(v string) error {
+			if s.alerter != nil {
+				s.alerter.url.set(v)
+			}
+			return nil
+		},
+		"BACKEND_TOKEN": func(v string) error {
+			if s.dishes != nil {
+				s.dishes.token.set(v)
+			}
+			return nil
+		},
+		"ADMIN_TOKEN": func(v string) error { s.adminToken.set(v); return nil },
+	}
+	for name, ref := range refs {
+		s.rotating = append(s.rotating, &rotatingSecret{name: name, ref: ref, value: *s.secretSettings()[name], apply: apply[name]})
+	}
+}
+
+// rotateSecrets re-resolves the watched settings and applies those that
+// changed. A failed lookup or an unusable value keeps the previous one.
+func (s *server) rotateSecrets(ctx context.Context) {
+	for _, rs := range s.rotating {
+		v, err := s.secrets.resolve(ctx, rs.ref)
+		if err != nil {
+			slog.Error("secret rotation failed; keeping previous value", "setting", rs.name, "err", err)
+			continue
+		}
+		if v == rs.value {
+			continue
+		}
+		if err := rs.apply(v); err != nil {
+			slog.Error("rotated secret rejected; keeping previous value", "setting", rs.name, "err", err)
+			continue
+		}
+		rs.value = v
+		slog.Info("secret rotated", "setting", rs.name)
+	}
+}
+
+// rotateCredentials reloads credentials and the other secret references
+// every SECRETS_REFRESH so rotated secrets and edited key files take effect
+// without a restart.
+func (s *server) rotateCredentials(ctx context.Context) {
+	t := time.NewTicker(s.cfg.SecretsRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			rctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			if err := s.loadCredentials(rctx); err != nil {
+				slog.Error("credential rotation failed; keeping previous keys", "err", err)
+			}
+			s.rotateSecrets(rctx)
+			cancel()
+		}
+	}
+}
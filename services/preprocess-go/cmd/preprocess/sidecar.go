@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Sidecar mode: when the service runs next to the app in one pod, the app
+// can drop the upload on a shared volume (SIDECAR_DIR, typically an
+// emptyDir) and pass its path as ?file=, instead of sending the bytes over
+// the network twice. Outputs are written beside the input and the answer
+// has the same shape as store=, with id the output's path relative to
+// SIDECAR_DIR:
+//
+//	POST /preprocess?file=uploads/abc.jpg&crops=1:1
+//	200 {"outputs":[{"name":"crop-1x1","url":"file:///shared/uploads/abc.crop-1x1.jpg",
+//	      "id":"uploads/abc.crop-1x1.jpg","content_type":"image/jpeg",…}]}
+//
+// Outputs are named <stem>.<name or WxH>.<ext> and appear atomically, so
+// the app never reads a half-written file. The input is left for the app
+// to clean up.
+
+// sidecarPath resolves rel inside SIDECAR_DIR, refusing anything that
+// escapes it, through ".." or a symlink.
+func (s *server) sidecarPath(rel string) (string, error) {
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("file must be a relative path inside the shared directory, got %q", rel)
+	}
+	p, err := filepath.EvalSymlinks(filepath.Join(s.sidecarDir, rel))
+	if err != nil {
+		return "", err
+	}
+	if p != s.sidecarDir && !strings.HasPrefix(p, s.sidecarDir+string(filepath.Separator)) {
+		return "", fmt.Errorf("file %q leaves the shared directory", rel)
+	}
+	return p, nil
+}
+
+// readSidecarFile reads ?file= for readInput. On failure it has already
+// written the response.
+func (s *server) readSidecarFile(w http.ResponseWriter, r *http.Request, rel string) ([]byte, string, bool) {
+	if s.sidecarDir == "" {
+		reject(w, r, http.StatusBadRequest, "sidecar_disabled", "file= needs SIDECAR_DIR")
+		return nil, "", false
+	}
+	start := time.Now()
+	p, err := s.sidecarPath(rel)
+	if errors.Is(err, fs.ErrNotExist) {
+		reject(w, r, http.StatusNotFound, "file_not_found", fmt.Sprintf("no file %q in the shared directory", rel))
+		return nil, "", false
+	}
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "invalid_param", err.Error())
+		return nil, "", false
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		reject(w, r, http.StatusNotFound, "file_not_found", fmt.Sprintf("can't open %q in the shared directory", rel))
+		return nil, "", false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		reject(w, r, http.StatusBadRequest, "invalid_param", fmt.Sprintf("%q is not a regular file", rel))
+		return nil, "", false
+	}
+	limit := s.uploadLimit(r.Context())
+	if fi.Size() > limit {
+		s.rejectTooLarge(w, r, limit)
+		return nil, "", false
+	}
+	b, err := io.ReadAll(io.LimitReader(f, limit+1))
+	recordStage(r.Context(), "read", time.Since(start))
+	if err != nil {
+		reject(w, r, http.StatusInternalServerError, "internal_error", "failed to read the shared file")
+		return nil, "", false
+	}
+	if int64(len(b)) > limit { // grew since the Stat
+		s.rejectTooLarge(w, r, limit)
+		return nil, "", false
+	}
+	logAttrs(r.Context(), "file", rel)
+	b = motionStill(r.Context(), b)
+	return b, http.DetectContentType(b), true
+}
+
+// sidecarStore is the imageStore for a ?file= request: it writes each
+// output next to input.
+type sidecarStore struct {
+	dir   string // SIDECAR_DIR, resolved
+	input string // resolved path of the input
+}
+
+func (st *sidecarStore) put(_ context.Context, res *result) (storedImage, error) {
+	label := res.name
+	if label == "" {
+		label = fmt.Sprintf("%dx%d", res.width, res.height)
+	}
+	dir, base := filepath.Split(st.input)
+	out := filepath.Join(dir, strings.TrimSuffix(base, filepath.Ext(base))+"."+label+"."+fileExt(res.ct))
+
+	tmp, err := os.CreateTemp(dir, ".preprocess-*")
+	if err != nil {
+		return storedImage{}, err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(res.body); err != nil {
+		tmp.Close()
+		return storedImage{}, err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return storedImage{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return storedImage{}, err
+	}
+	if err := os.Rename(tmp.Name(), out); err != nil {
+		return storedImage{}, err
+	}
+	rel, err := filepath.Rel(st.dir, out)
+	if err != nil {
+		return storedImage{}, err
+	}
+	return storedImage{url: "file://" + filepath.ToSlash(out), id: filepath.ToSlash(rel)}, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSidecarPath(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := filepath.Join(root, "shared")
+	outside := filepath.Join(root, "secret.jpg")
+	for _, dir := range []string{shared, filepath.Join(shared, "uploads"), filepath.Join(root, "elsewhere")} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{outside, filepath.Join(shared, "uploads", "a.jpg")} {
+		if err := os.WriteFile(f, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range map[string]string{
+		"out.jpg":    outside,
+		"outdir":     filepath.Join(root, "elsewhere"),
+		"in.jpg":     filepath.Join(shared, "uploads", "a.jpg"),
+		"relout.jpg": "../secret.jpg",
+	} {
+		if err := os.Symlink(target, filepath.Join(shared, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &server{sidecarDir: shared}
+
+	tests := []struct {
+		rel     string
+		want    string // "" for an error
+		missing bool
+	}{
+		{rel: "uploads/a.jpg", want: filepath.Join(shared, "uploads", "a.jpg")},
+		{rel: "./uploads/../uploads/a.jpg", want: filepath.Join(shared, "uploads", "a.jpg")},
+		{rel: "in.jpg", want: filepath.Join(shared, "uploads", "a.jpg")}, // symlink that stays inside
+		{rel: "uploads/none.jpg", missing: true},
+		{rel: "../secret.jpg"},
+		{rel: "uploads/../../secret.jpg"},
+		{rel: outside},
+		{rel: ""},
+		{rel: "out.jpg"},
+		{rel: "relout.jpg"},
+		{rel: "outdir/x.jpg", missing: true}, // doesn't exist, and wouldn't be allowed
+	}
+	for _, tt := range tests {
+		got, err := s.sidecarPath(tt.rel)
+		switch {
+		case tt.missing:
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("sidecarPath(%q) = %q, %v; want not found", tt.rel, got, err)
+			}
+		case tt.want == "":
+			if err == nil {
+				t.Errorf("sidecarPath(%q) = %q, want an error", tt.rel, got)
+			}
+		case err != nil || got != tt.want:
+			t.Errorf("sidecarPath(%q) = %q, %v; want %q", tt.rel, got, err, tt.want)
+		}
+	}
+}
+
+func TestSidecarStorePut(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(dir, "menu.heic")
+	st := &sidecarStore{dir: dir, input: input}
+	img, err := st.put(context.Background(), &result{body: []byte("jpeg"), ct: "image/jpeg", width: 640, height: 480})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.id != "menu.640x480.jpg" {
+		t.Errorf("id = %q, want menu.640x480.jpg", img.id)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, img.id)); err != nil || string(b) != "jpeg" {
+		t.Errorf("output = %q, %v", b, err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, ".preprocess-*")); len(left) > 0 {
+		t.Errorf("temporary files left behind: %v", left)
+	}
+}
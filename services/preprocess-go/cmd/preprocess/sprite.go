@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// POST /sprite packs a set of small icons into one transparent PNG plus a
+// JSON map of where each landed, so the web client fetches its category
+// icons in one request and draws them with background-position.
+const (
+	spriteMaxImages   = 256
+	defaultSpriteCell = 128
+	maxSpriteCell     = 512
+	spritePadding     = 2 // keeps neighbours from bleeding in when scaled by the browser
+)
+
+type spriteInput struct {
+	name string
+	b    []byte
+	ct   string
+}
+
+type spriteFrame struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type spriteMap struct {
+	Width   int                    `json:"width"`
+	Height  int                    `json:"height"`
+	Sprites map[string]spriteFrame `json:"sprites"`
+}
+
+func (s *server) spriteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		reject(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "POST only")
+		return
+	}
+	cell, err := cellParam(r)
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+
+	uploadStart := time.Now()
+	if !s.parseUpload(w, r) {
+		return
+	}
+	fhs := r.MultipartForm.File["image"]
+	if len(fhs) == 0 {
+		reject(w, r, http.StatusBadRequest, "missing_image", "missing form field 'image'")
+		return
+	}
+	if len(fhs) > spriteMaxImages {
+		reject(w, r, http.StatusBadRequest, "invalid_param", fmt.Sprintf("at most %d images per sprite sheet", spriteMaxImages))
+		return
+	}
+	inputs := make([]spriteInput, 0, len(fhs))
+	seen := map[string]bool{}
+	var total int
+	for i, fh := range fhs {
+		name := strings.TrimSuffix(path.Base(fh.Filename), path.Ext(fh.Filename))
+		if name == "" || name == "." || name == "/" {
+			name = "image" + strconv.Itoa(i)
+		}
+		if seen[name] {
+			reject(w, r, http.StatusBadRequest, "invalid_param", fmt.Sprintf("duplicate image name %q", name))
+			return
+		}
+		seen[name] = true
+		f, err := fh.Open()
+		if err != nil {
+			reject(w, r, http.StatusBadRequest, "malformed_upload", "failed to read upload")
+			return
+		}
+		b, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			reject(w, r, http.StatusBadRequest, "malformed_upload", "failed to read upload")
+			return
+		}
+		ct, ok := s.uploadType(w, r, b, fh)
+		if !ok {
+			return
+		}
+		inputs = append(inputs, spriteInput{name: name, b: b, ct: ct})
+		total += len(b)
+	}
+	recordStage(r.Context(), "upload", time.Since(uploadStart))
+	for _, in := range inputs {
+		if !s.scanInput(w, r, in.b) {
+			return
+		}
+	}
+	inputBytes.add(float64(total))
+	h := make([][]byte, len(inputs))
+	for i, in := range inputs {
+		h[i] = in.b
+	}
+	inputHash := hashHex(bytes.Join(h, nil))
+	logAttrs(r.Context(), "input_bytes", total, "inputs", len(inputs))
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ProcessTimeout)
+	defer cancel()
+	var set []*result
+	err = s.runJob(ctx, func(ctx context.Context) (err error) {
+		set, err = s.packSprites(ctx, inputs, cell)
+		return err
+	})
+	if err != nil {
+		s.writeJobError(w, r, err)
+		return
+	}
+	defer releaseAll(set)
+	logAttrs(r.Context(), "output_width", set[0].width, "output_height", set[0].height, "output_bytes", len(set[0].body))
+	writeResultSet(w, set)
+	s.completed(r, inputHash, total, 1, set)
+}
+
+// cellParam reads cell=N, the longest side each icon is scaled down to.
+func cellParam(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("cell")
+	if v == "" {
+		return defaultSpriteCell, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maxSpriteCell {
+		return 0, fmt.Errorf("cell must be 1-%d, got %q", maxSpriteCell, v)
+	}
+	return n, nil
+}
+
+// packSprites scales each icon to fit cell and shelf-packs them, tallest
+// first, into a roughly square sheet. It returns the sheet PNG and the map.
+func (s *server) packSprites(ctx context.Context, inputs []spriteInput, cell int) ([]*result, error) {
+	icons := make([]image.Image, len(inputs))
+	for i, in := range inputs {
+		f, cfg, err := s.probe(ctx, in.b, in.ct)
+		if err != nil {
+			return nil, err
+		}
+		img, err := s.decodeFor(ctx, f, in.b, cfg, cell)
+		if err != nil {
+			return nil, err
+		}
+		rs := time.Now()
+		icons[i] = downscale(img, cell)
+		observeStage(ctx, rs, "resize")
+	}
+	defer func() {
+		for _, icon := range icons {
+			if rgba, ok := icon.(*image.RGBA); ok {
+				putRGBA(rgba)
+			}
+		}
+	}()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	order := make([]int, len(icons))
+	area, widest := 0, 0
+	for i, icon := range icons {
+		order[i] = i
+		b := icon.Bounds()
+		area += (b.Dx() + spritePadding) * (b.Dy() + spritePadding)
+		widest = max(widest, b.Dx()+spritePadding)
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return icons[order[a]].Bounds().Dy() > icons[order[b]].Bounds().Dy()
+	})
+	sheetW := max(widest, int(math.Ceil(math.Sqrt(float64(area)))))
+
+	m := spriteMap{Sprites: make(map[string]spriteFrame, len(icons))}
+	x, y, shelf := 0, 0, 0
+	for _, i := range order {
+		b := icons[i].Bounds()
+		if x+b.Dx()+spritePadding > sheetW {
+			x, y, shelf = 0, y+shelf, 0
+		}
+		m.Sprites[inputs[i].name] = spriteFrame{X: x, Y: y, W: b.Dx(), H: b.Dy()}
+		x += b.Dx() + spritePadding
+		shelf = max(shelf, b.Dy()+spritePadding)
+		m.Width = max(m.Width, x-spritePadding)
+	}
+	m.Height = y + shelf - spritePadding
+
+	sheet := image.NewNRGBA(image.Rect(0, 0, m.Width, m.Height))
+	for i, icon := range icons {
+		fr := m.Sprites[inputs[i].name]
+		draw.Draw(sheet, image.Rect(fr.X, fr.Y, fr.X+fr.W, fr.Y+fr.H), icon, icon.Bounds().Min, draw.Src)
+	}
+
+	es := time.Now()
+	out := getBuffer()
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(out, sheet); err != nil {
+		putBuffer(out)
+		return nil, fmt.Errorf("failed to encode image/png")
+	}
+	observeStage(ctx, es, "encode")
+	js, err := json.Marshal(m)
+	if err != nil {
+		putBuffer(out)
+		return nil, err
+	}
+	return []*result{
+		{body: out.Bytes(), buf: out, ct: "image/png", origCT: inputs[0].ct, width: m.Width, height: m.Height, name: "sprite.png"},
+		{body: js, ct: "application/json", origCT: inputs[0].ct, width: m.Width, height: m.Height, name: "sprite.json"},
+	}, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// statsMinutes is how much history /stats keeps: one bucket per minute.
+const statsMinutes = 60
+
+// stats backs /stats, a cheap summary for the ops dashboard. Prometheus has
+// the same data with more detail; this exists for places without a scraper.
+var stats = newRollingStats()
+
+type statsBucket struct {
+	minute    int64 // unix minute this bucket holds; stale buckets are reset
+	processed int64
+	bytesIn   int64
+	bytesOut  int64
+	rejects   map[string]int64
+}
+
+func (b *statsBucket) add(o *statsBucket) {
+	b.processed += o.processed
+	b.bytesIn += o.bytesIn
+	b.bytesOut += o.bytesOut
+	for k, v := range o.rejects {
+		if b.rejects == nil {
+			b.rejects = map[string]int64{}
+		}
+		b.rejects[k] += v
+	}
+}
+
+type rollingStats struct {
+	mu      sync.Mutex
+	start   time.Time
+	total   statsBucket
+	buckets [statsMinutes]statsBucket
+}
+
+func newRollingStats() *rollingStats {
+	return &rollingStats{start: time.Now()}
+}
+
+// bucket returns the bucket for now, clearing it if it last held an older
+// minute. Callers hold mu.
+func (st *rollingStats) bucket(now time.Time) *statsBucket {
+	m := now.Unix() / 60
+	b := &st.buckets[m%statsMinutes]
+	if b.minute != m {
+		*b = statsBucket{minute: m}
+	}
+	return b
+}
+
+func (st *rollingStats) recordProcessed(in int, outputs []*result) {
+	var d statsBucket
+	d.processed = int64(len(outputs))
+	d.bytesIn = int64(in)
+	for _, res := range outputs {
+		d.bytesOut += int64(len(res.body))
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.bucket(time.Now()).add(&d)
+	st.total.add(&d)
+}
+
+func (st *rollingStats) recordReject(reason string) {
+	d := statsBucket{rejects: map[string]int64{reason: 1}}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.bucket(time.Now()).add(&d)
+	st.total.add(&d)
+}
+
+// window sums the last n minutes, including the current partial one.
+func (st *rollingStats) window(now time.Time, n int) statsBucket {
+	var sum statsBucket
+	cur := now.Unix() / 60
+	for i := range st.buckets {
+		b := &st.buckets[i]
+		if b.minute > cur-int64(n) && b.minute <= cur {
+			sum.add(b)
+		}
+	}
+	return sum
+}
+
+type statsSummary struct {
+	ImagesProcessed  int64            `json:"images_processed"`
+	BytesIn          int64            `json:"bytes_in"`
+	BytesOut         int64            `json:"bytes_out"`
+	CompressionRatio float64          `json:"compression_ratio"`
+	Rejects          map[string]int64 `json:"rejects"`
+}
+
+func (b statsBucket) summary() statsSummary {
+	s := statsSummary{
+		ImagesProcessed: b.processed,
+		BytesIn:         b.bytesIn,
+		BytesOut:        b.bytesOut,
+		Rejects:         b.rejects,
+	}
+	if s.Rejects == nil {
+		s.Rejects = map[string]int64{}
+	}
+	// Same direction as preprocess_compression_ratio: output over input.
+	if b.bytesIn > 0 {
+		s.CompressionRatio = float64(b.bytesOut) / float64(b.bytesIn)
+	}
+	return s
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	stats.mu.Lock()
+	body := struct {
+		UptimeSeconds int64                   `json:"uptime_seconds"`
+		Windows       map[string]statsSummary `json:"windows"`
+	}{
+		UptimeSeconds: int64(now.Sub(stats.start).Seconds()),
+		Windows: map[string]statsSummary{
+			"1m":    stats.window(now, 1).summary(),
+			"5m":    stats.window(now, 5).summary(),
+			"15m":   stats.window(now, 15).summary(),
+			"1h":    stats.window(now, 60).summary(),
+			"total": stats.total.summary(),
+		},
+	}
+	stats.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
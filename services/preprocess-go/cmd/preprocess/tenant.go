@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Tenants let one deployment serve several regions or brands. TENANTS lists
+// them; TENANT_KEYS ties callers (API key names, cert:<cn>, hmac:<id>) to
+// one, and callers without a tie, or an open service, name theirs in
+// X-Tenant. A tenant scopes:
+//
+//   - presets: tenant_presets.<tenant>.<name> in the config file wins over
+//     presets.<name>
+//   - quotas: a QUOTAS entry "@<tenant>:images:bytes" is a daily budget all
+//     of the tenant's callers share, on top of their own
+//   - storage: store= keys are prefixed "<tenant>/"
+//   - metrics: preprocess_tenant_requests_total and _images_total
+//
+// Tenant names end up in object keys and metric labels, hence the narrow
+// charset.
+var tenantNameRe = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// parseTenants reads TENANTS and TENANT_KEYS.
+func parseTenants(names, keys string) (map[string]bool, map[string]string, error) {
+	tenants := map[string]bool{}
+	for _, t := range splitList(names) {
+		if !tenantNameRe.MatchString(t) {
+			return nil, nil, fmt.Errorf("tenant %q: want 1-32 of a-z, 0-9, _ and -", t)
+		}
+		tenants[t] = true
+	}
+	byCaller := map[string]string{}
+	for _, e := range splitList(keys) {
+		// Callers like cert:<cn> contain a colon themselves.
+		i := strings.LastIndex(e, ":")
+		if i <= 0 {
+			return nil, nil, fmt.Errorf("tenant key %q: want caller:tenant", e)
+		}
+		caller, t := e[:i], e[i+1:]
+		if !tenants[t] {
+			return nil, nil, fmt.Errorf("tenant key %q: %q is not in TENANTS", e, t)
+		}
+		byCaller[caller] = t
+	}
+	return tenants, byCaller, nil
+}
+
+// scopeTenant works out the request's tenant. It sits after authenticate: a
+// caller tied to a tenant can't act for another through X-Tenant.
+func (s *server) scopeTenant(next http.Handler) http.Handler {
+	if len(s.tenants) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked := r.Header.Get("X-Tenant")
+		t, tied := s.tenantKeys[callerName(r.Context())]
+		switch {
+		case tied && asked != "" && asked != t:
+			reject(w, r, http.StatusForbidden, "forbidden", fmt.Sprintf("caller is not allowed to act for tenant %q", asked))
+			return
+		case !tied && asked != "":
+			if !s.tenants[asked] {
+				reject(w, r, http.StatusBadRequest, "unknown_tenant", fmt.Sprintf("unknown tenant %q", asked))
+				return
+			}
+			t = asked
+		}
+		if t != "" {
+			setTenant(r.Context(), t)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// storeKey is the key an output is stored under: its objectName, in the
+// tenant's namespace when there is one.
+func storeKey(t string, res *result) string {
+	if t == "" {
+		return res.objectName()
+	}
+	return t + "/" + res.objectName()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Thumbor-style GET URLs, so frontends can move off the hosted resizer by
+// changing the host and prefix only:
+//
+//	GET <THUMBOR_PATH_PREFIX><signature|unsafe>/[fit-in/][W]x[H]/[halign/][valign/][smart/][filters:quality(N)/]<image>
+//
+// signature is Thumbor's: URL-safe base64 of HMAC-SHA1(THUMBOR_SECURITY_KEY,
+// everything after it). <image> is a URL, or a path under
+// THUMBOR_SOURCE_BASE, fetched like ?url=. WxH without fit-in crops to
+// exactly that size (smart or aligned); fit-in scales to fit inside it; a 0
+// or missing side follows the aspect ratio. Options this service can't honour
+// (trim, manual crops, flips, full-fit-in, meta) are a 400 rather than being
+// silently dropped.
+
+// thumborMaxAge is how long CDNs and browsers may keep a response; the
+// signed URL pins the transformation but not the source image.
+const thumborMaxAge = 24 * time.Hour
+
+type thumborSpec struct {
+	width, height  int // 0 follows the aspect ratio
+	fitIn          bool
+	smart          bool
+	halign, valign string
+	quality        int // 0 leaves the default
+	image          string
+}
+
+var (
+	thumborSizeRe   = regexp.MustCompile(`^(\d*)x(\d*)$`)
+	thumborCropRe   = regexp.MustCompile(`^\d+x\d+:\d+x\d+$`)
+	thumborFilterRe = regexp.MustCompile(`^([a-z_]+)\(([^)]*)\)$`)
+)
+
+// thumborRouter sends requests under prefix to h before they reach the mux,
+// whose path cleaning would fold the "//" in embedded image URLs.
+func thumborRouter(prefix string, h, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// thumborAuth lets through signed URLs, which browsers load without
+// credentials, and unsafe ones from authenticated callers only.
+func (s *server) thumborAuth(next http.Handler) http.Handler {
+	authed := s.authenticate(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sig, rest := s.thumborPath(r)
+		switch {
+		case sig == "unsafe" && s.cfg.ThumborAllowUnsafe:
+			authed.ServeHTTP(w, r)
+		case s.thumborSigned(sig, rest):
+			next.ServeHTTP(w, r)
+		default:
+			logAttrs(r.Context(), "auth_error", "bad thumbor signature")
+			reject(w, r, http.StatusForbidden, "forbidden", "missing or invalid URL signature")
+		}
+	})
+}
+
+// thumborPath splits a Thumbor URL into its signature and the signed rest.
+func (s *server) thumborPath(r *http.Request) (sig, rest string) {
+	sig, rest, _ = strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), s.cfg.ThumborPathPrefix), "/")
+	return sig, rest
+}
+
+func (s *server) thumborHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		reject(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "GET only")
+		return
+	}
+	_, rest := s.thumborPath(r)
+	spec, err := parseThumborPath(rest)
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+	src, err := s.thumborSource(spec.image)
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "invalid_param", err.Error())
+		return
+	}
+
+	live := s.live.Load()
+	quality := live.defaultQuality
+	if spec.quality > 0 {
+		quality = min(max(spec.quality, live.minQuality), live.maxQuality)
+	}
+	start := time.Now()
+	b, err := s.fetcher.fetch(r.Context(), src)
+	recordStage(r.Context(), "fetch", time.Since(start))
+	if err != nil {
+		s.writeFetchError(w, r, err)
+		return
+	}
+	if !s.scanInput(w, r, b) {
+		return
+	}
+	b = motionStill(r.Context(), b)
+	inputBytes.add(float64(len(b)))
+	inputHash := hashHex(b)
+	setInputHeaders(w, inputHash, len(b))
+	logAttrs(r.Context(), "input_bytes", len(b))
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ProcessTimeout)
+	defer cancel()
+	opts := options{quality: quality, forceEncode: true}
+	var res *result
+	err = s.runJob(ctx, func(ctx context.Context) (err error) {
+		res, err = s.processThumbor(ctx, b, http.DetectContentType(b), spec, live.maxDim, opts)
+		return err
+	})
+	if err != nil {
+		s.writeJobError(w, r, err)
+		return
+	}
+	defer res.release()
+	logAttrs(r.Context(), "output_format", res.ct, "output_width", res.width, "output_height", res.height,
+		"output_bytes", len(res.body))
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(thumborMaxAge.Seconds())))
+	writeResult(w, res)
+	s.completed(r, inputHash, len(b), 1, []*result{res})
+}
+
+// thumborSigned checks sig against the rest of the path.
+func (s *server) thumborSigned(sig, rest string) bool {
+	key := s.thumborKey.get()
+	if key == "" {
+		return false
+	}
+	mac := hmac.New(sha1.New, []byte(key))
+	mac.Write([]byte(rest))
+	want := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+	// Some URL builders drop the padding.
+	return hmac.Equal([]byte(strings.TrimRight(sig, "=")), []byte(strings.TrimRight(want, "=")))
+}
+
+func parseThumborPath(p string) (thumborSpec, error) {
+	spec := thumborSpec{halign: "center", valign: "middle"}
+	segs := strings.Split(p, "/")
+	i := 0
+	next := func() string {
+		if i < len(segs) {
+			return segs[i]
+		}
+		return ""
+	}
+	if seg := next(); seg == "meta" || seg == "trim" || strings.HasPrefix(seg, "trim:") || thumborCropRe.MatchString(seg) {
+		return thumborSpec{}, fmt.Errorf("thumbor option %q is not supported", seg)
+	}
+	switch next() {
+	case "fit-in":
+		spec.fitIn = true
+		i++
+	case "full-fit-in", "adaptive-fit-in", "adaptive-full-fit-in":
+		return thumborSpec{}, fmt.Errorf("thumbor option %q is not supported", next())
+	}
+	if m := thumborSizeRe.FindStringSubmatch(next()); m != nil {
+		spec.width, _ = strconv.Atoi(m[1])
+		spec.height, _ = strconv.Atoi(m[2])
+		i++
+	} else if strings.HasPrefix(next(), "-") {
+		return thumborSpec{}, fmt.Errorf("thumbor flips are not supported")
+	}
+	if h := next(); h == "left" || h == "center" || h == "right" {
+		spec.halign = h
+		i++
+	}
+	if v := next(); v == "top" || v == "middle" || v == "bottom" {
+		spec.valign = v
+		i++
+	}
+	if next() == "smart" {
+		spec.smart = true
+		i++
+	}
+	if f, ok := strings.CutPrefix(next(), "filters:"); ok {
+		for _, filter := range strings.Split(f, ":") {
+			m := thumborFilterRe.FindStringSubmatch(filter)
+			if m == nil {
+				return thumborSpec{}, fmt.Errorf("bad thumbor filter %q", filter)
+			}
+			if m[1] != "quality" {
+				continue // cosmetic filters are ignored, as Thumbor does unknown ones
+			}
+			q, err := strconv.Atoi(m[2])
+			if err != nil || q < 1 || q > 100 {
+				return thumborSpec{}, fmt.Errorf("thumbor quality must be 1-100, got %q", m[2])
+			}
+			spec.quality = q
+		}
+		i++
+	}
+	img, err := url.PathUnescape(strings.Join(segs[i:], "/"))
+	if err != nil || img == "" {
+		return thumborSpec{}, fmt.Errorf("thumbor URL has no image")
+	}
+	spec.image = img
+	return spec, nil
+}
+
+// thumborSource resolves the image part of the path to a URL to fetch.
+func (s *server) thumborSource(img string) (string, error) {
+	if strings.HasPrefix(img, "http://") || strings.HasPrefix(img, "https://") {
+		return img, nil
+	}
+	if s.cfg.ThumborSourceBase != "" {
+		return strings.TrimRight(s.cfg.ThumborSourceBase, "/") + "/" + strings.TrimLeft(img, "/"), nil
+	}
+	// Thumbor's HTTP loader takes scheme-less URLs as host/path.
+	if host, _, _ := strings.Cut(img, "/"); !strings.Contains(host, ".") {
+		return "", fmt.Errorf("thumbor image %q is not a URL and THUMBOR_SOURCE_BASE is unset", img)
+	}
+	return "https://" + img, nil
+}
+
+// processThumbor sizes the image as spec asks. Thumbor sizes are taken
+// exactly: they are capped at MAX_DIM but not raised to MIN_DIM.
+func (s *server) processThumbor(ctx context.Context, b []byte, ct string, spec thumborSpec, limit int, opts options) (*result, error) {
+	start := time.Now()
+	f, cfg, err := s.probe(ctx, b, ct)
+	if err != nil {
+		return nil, err
+	}
+	w, h := float64(cfg.Width), float64(cfg.Height)
+	crop := !spec.fitIn && spec.width > 0 && spec.height > 0
+	need := limit
+	switch {
+	case crop:
+		// As for crops=, the crop's long side may be the image's short one.
+		opts.maxDim = max(spec.width, spec.height)
+		need = opts.maxDim * max(cfg.Width, cfg.Height) / max(1, min(cfg.Width, cfg.Height))
+	case spec.width > 0 || spec.height > 0:
+		scale := math.Inf(1)
+		if spec.width > 0 {
+			scale = float64(spec.width) / w
+		}
+		if spec.height > 0 {
+			scale = math.Min(scale, float64(spec.height)/h)
+		}
+		opts.maxDim = max(1, int(math.Round(math.Max(w, h)*math.Min(scale, 1))))
+		need = opts.maxDim
+	default:
+		opts.maxDim = limit
+	}
+	opts.maxDim = min(opts.maxDim, limit)
+
+	img, err := s.decodeFor(ctx, f, b, cfg, min(need, limit))
+	if err != nil {
+		return nil, err
+	}
+	if crop {
+		var energy *image.Gray
+		if spec.smart {
+			t := time.Now()
+			energy = energyMap(img)
+			observeStage(ctx, t, "analyze")
+		}
+		r := alignCrop(img.Bounds(), cropRect(img.Bounds(), aspect{spec.width, spec.height}, energy, nil), spec, energy != nil)
+		img = subImage(img, r)
+	}
+	res, err := render(ctx, img, f.ct, opts.maxDim, opts)
+	if err != nil {
+		return nil, err
+	}
+	observeFormat(f.ct, start, len(b), len(res.body))
+	return res, nil
+}
+
+// alignCrop moves a centered crop r to the edges spec's halign and valign
+// name; smart crops stay where they were placed.
+func alignCrop(b, r image.Rectangle, spec thumborSpec, smart bool) image.Rectangle {
+	if smart {
+		return r
+	}
+	var d image.Point
+	switch spec.halign {
+	case "left":
+		d.X = b.Min.X - r.Min.X
+	case "right":
+		d.X = b.Max.X - r.Max.X
+	}
+	switch spec.valign {
+	case "top":
+		d.Y = b.Min.Y - r.Min.Y
+	case "bottom":
+		d.Y = b.Max.Y - r.Max.Y
+	}
+	return r.Add(d)
+}
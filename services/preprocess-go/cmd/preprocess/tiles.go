@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// tiles=dzi cuts a Deep Zoom pyramid so the web client can pan and zoom a
+// large scanned menu without downloading it whole. Level maxLevel is the
+// full-resolution image and each level below halves it, down to 1×1 at
+// level 0; every level is cut into dziTileSize squares overlapping their
+// neighbours by dziOverlap pixels, the layout OpenSeadragon expects.
+const (
+	dziTileSize = 254
+	dziOverlap  = 1
+)
+
+// processTiles decodes once and returns the .dzi descriptor followed by
+// every tile, level by level. max_dim doesn't apply: the full resolution is
+// the point, and MAX_PIXELS already bounds it.
+func (s *server) processTiles(ctx context.Context, b []byte, ct string, opts options) ([]*result, error) {
+	start := time.Now()
+	f, cfg, err := s.probe(ctx, b, ct)
+	if err != nil {
+		return nil, err
+	}
+	img, err := s.decode(ctx, f, b)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkBlank(ctx, f, b, cfg, img); err != nil {
+		return nil, err
+	}
+	if img, err = s.editImage(ctx, img, b, f.ct, cfg, opts); err != nil {
+		return nil, err
+	}
+
+	ext, tileCT := "jpg", "image/jpeg"
+	if imageHasAlpha(img) {
+		ext, tileCT = "png", "image/png"
+	}
+	w, h := cfg.Width, cfg.Height
+	maxLevel := bits.Len(uint(max(w, h) - 1))
+
+	desc := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format="%s" Overlap="%d" TileSize="%d"><Size Width="%d" Height="%d"/></Image>
+`, ext, dziOverlap, dziTileSize, w, h)
+	set := []*result{{body: []byte(desc), ct: "application/xml", origCT: f.ct, width: w, height: h, name: "image.dzi"}}
+
+	// Build top-down, each level from the one above, then emit bottom-up.
+	levels := make([][]*result, maxLevel+1)
+	level := img
+	defer func() {
+		if rgba, ok := level.(*image.RGBA); ok && level != img {
+			putRGBA(rgba)
+		}
+	}()
+	fail := func(err error) ([]*result, error) {
+		for _, ts := range levels {
+			releaseAll(ts)
+		}
+		return nil, err
+	}
+	for l := maxLevel; l >= 0; l-- {
+		if l < maxLevel {
+			shift := maxLevel - l
+			lw, lh := ceilShift(w, shift), ceilShift(h, shift)
+			rs := time.Now()
+			next := newRGBA(image.Rect(0, 0, lw, lh))
+			draw.CatmullRom.Scale(next, next.Bounds(), level, level.Bounds(), draw.Src, nil)
+			observeStage(ctx, rs, "resize")
+			if prev, ok := level.(*image.RGBA); ok && level != img {
+				putRGBA(prev)
+			}
+			level = next
+		}
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+		es := time.Now()
+		tiles, err := s.cutLevel(ctx, level, l, ext, tileCT, f.ct, opts.quality)
+		observeStage(ctx, es, "encode")
+		if err != nil {
+			return fail(err)
+		}
+		levels[l] = tiles
+	}
+
+	out := len(desc)
+	for _, ts := range levels {
+		set = append(set, ts...)
+		for _, t := range ts {
+			out += len(t.body)
+		}
+	}
+	logAttrs(ctx, "dzi_levels", maxLevel+1)
+	observeFormat(f.ct, start, len(b), out)
+	return set, nil
+}
+
+// cutLevel encodes one level's tiles concurrently, bounded by
+// ResizeParallelism like processSizes.
+func (s *server) cutLevel(ctx context.Context, level image.Image, l int, ext, ct, origCT string, quality int) ([]*result, error) {
+	b := level.Bounds()
+	cols := (b.Dx() + dziTileSize - 1) / dziTileSize
+	rows := (b.Dy() + dziTileSize - 1) / dziTileSize
+	sub := level.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+
+	tiles := make([]*result, cols*rows)
+	errs := make([]error, len(tiles))
+	sem := make(chan struct{}, s.cfg.ResizeParallelism)
+	var wg sync.WaitGroup
+	for c := 0; c < cols; c++ {
+		for r := 0; r < rows; r++ {
+			wg.Add(1)
+			go func(i, c, r int) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				defer func() {
+					if v := recover(); v != nil {
+						errs[i] = newPanicError(v)
+					}
+				}()
+				if ctx.Err() != nil {
+					errs[i] = ctx.Err()
+					return
+				}
+				rect := image.Rect(
+					c*dziTileSize-dziOverlap, r*dziTileSize-dziOverlap,
+					(c+1)*dziTileSize+dziOverlap, (r+1)*dziTileSize+dziOverlap,
+				).Add(b.Min).Intersect(b)
+				tile := sub.SubImage(rect)
+				out := getBuffer()
+				var err error
+				if ct == "image/png" {
+					err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(out, tile)
+				} else {
+					err = jpeg.Encode(out, tile, &jpeg.Options{Quality: quality})
+				}
+				if err != nil {
+					putBuffer(out)
+					errs[i] = fmt.Errorf("failed to encode %s", ct)
+					return
+				}
+				tiles[i] = &result{
+					body: out.Bytes(), buf: out, ct: ct, origCT: origCT,
+					width: rect.Dx(), height: rect.Dy(),
+					name: fmt.Sprintf("image_files/%d/%d_%d.%s", l, c, r, ext),
+				}
+			}(c*rows+r, c, r)
+		}
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		releaseAll(tiles)
+		return nil, err
+	}
+	return tiles, nil
+}
+
+func ceilShift(n, shift int) int {
+	return max(1, int(math.Ceil(float64(n)/float64(int(1)<<shift))))
+}
+
+func releaseAll(set []*result) {
+	for _, res := range set {
+		if res != nil {
+			res.release()
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certReloadInterval is how often the cert files are checked for changes, so
+// rotated certificates are picked up without a restart.
+const certReloadInterval = time.Minute
+
+// tlsConfig returns the TLS settings for serving HTTPS directly, or nil when
+// TLS is off (the usual case behind a terminating load balancer). Static
+// cert/key files and ACME are mutually exclusive.
+func (s *server) tlsConfig() (*tls.Config, error) {
+	cfg, err := s.serverTLSConfig()
+	if err != nil || s.cfg.TLSClientCAFile == "" {
+		return cfg, err
+	}
+	if cfg == nil {
+		return nil, errors.New("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE/TLS_KEY_FILE or ACME_DOMAINS")
+	}
+	pem, err := os.ReadFile(s.cfg.TLSClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", s.cfg.TLSClientCAFile)
+	}
+	cfg.ClientCAs = pool
+	switch s.cfg.TLSClientAuth {
+	case "require":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		// Callers without a cert fall through to the other auth methods.
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH %q: want require or optional", s.cfg.TLSClientAuth)
+	}
+	return cfg, nil
+}
+
+// peerName identifies a verified client certificate by its common name, or
+// its first DNS SAN when the CN is empty.
+func peerName(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	if leaf.Subject.CommonName != "" {
+		return leaf.Subject.CommonName, true
+	}
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames[0], true
+	}
+	return "", false
+}
+
+func (s *server) serverTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := s.cfg.TLSCertFile, s.cfg.TLSKeyFile
+	domains := splitList(s.cfg.ACMEDomains)
+	switch {
+	case (certFile != "" || keyFile != "") && len(domains) > 0:
+		return nil, errors.New("set either TLS_CERT_FILE/TLS_KEY_FILE or ACME_DOMAINS, not both")
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		cr := &certReloader{certFile: certFile, keyFile: keyFile}
+		if err := cr.load(); err != nil {
+			return nil, err
+		}
+		return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: cr.getCertificate}, nil
+	case len(domains) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(s.cfg.ACMECacheDir),
+			Email:      s.cfg.ACMEEmail,
+		}
+		if s.cfg.ACMEHTTPAddr != "" {
+			// HTTP-01 challenges; everything else is redirected to HTTPS.
+			go func() {
+				slog.Info("acme http listener", "addr", s.cfg.ACMEHTTPAddr)
+				if err := http.ListenAndServe(s.cfg.ACMEHTTPAddr, m.HTTPHandler(nil)); err != nil {
+					slog.Error("acme http listener failed", "err", err)
+				}
+			}()
+		}
+		cfg := m.TLSConfig()
+		cfg.MinVersion = tls.VersionTLS12
+		return cfg, nil
+	}
+	return nil, nil
+}
+
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func (c *certReloader) load() error {
+	fi, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime, c.checked = &cert, fi.ModTime(), time.Now()
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < certReloadInterval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+	fi, err := os.Stat(c.certFile)
+	if err != nil || !fi.ModTime().After(c.modTime) {
+		return c.cert, nil
+	}
+	if err := c.load(); err != nil {
+		// Keep serving the old pair; a half-written rotation will settle.
+		slog.Error("tls: reload failed", "err", err)
+		return c.cert, nil
+	}
+	slog.Info("tls: certificate reloaded", "file", c.certFile)
+	return c.cert, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// POST /validate runs the checks an upload will face, before the user has
+// written a review to go with it, and says what would fail:
+//
+//	200 {"valid":false,"reasons":[{"code":"TOO_BLURRY","message":"..."}],
+//	     "image":{"content_type":"image/jpeg","width":4032,"height":3024,"bytes":3145728,"sharpness":0.011}}
+//
+// The upload is taken the way /preprocess takes it and scanned; a flagged
+// upload isn't checked any further, so its reasons stop there. Otherwise
+// the format and dimensions are checked against the same limits as
+// processing, plus VALIDATE_MIN_SIDE and PHOTO_MAX_ASPECT_RATIO unless that
+// one crops, and the image is decoded at small size to measure its sharpness
+// against VALIDATE_MIN_SHARPNESS and, with REJECT_BLANK_IMAGES, to spot
+// blank ones. An upload over the caller's size limit is still a 413, since
+// it is never read. Nothing is stored or charged to quotas.
+
+type validationReason struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type validatedImage struct {
+	ContentType string   `json:"content_type,omitempty"`
+	Width       int      `json:"width,omitempty"`
+	Height      int      `json:"height,omitempty"`
+	Bytes       int      `json:"bytes"`
+	Sharpness   *float64 `json:"sharpness,omitempty"`
+}
+
+func (s *server) validateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		reject(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "POST only")
+		return
+	}
+	b, ct, ok := s.readInput(w, r)
+	if !ok {
+		return
+	}
+	logAttrs(r.Context(), "input_bytes", len(b))
+	reasons := []validationReason{}
+	fail := func(code, format string, args ...any) {
+		reasons = append(reasons, validationReason{code, fmt.Sprintf(format, args...)})
+	}
+	info := validatedImage{Bytes: len(b)}
+	write := func() {
+		logAttrs(r.Context(), "valid", len(reasons) == 0, "reasons", len(reasons))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"valid": len(reasons) == 0, "reasons": reasons, "image": info})
+	}
+
+	reason, err := s.scanUpload(r, b)
+	switch {
+	case reason != "":
+		fail("MALWARE_DETECTED", "upload rejected by malware scan")
+		write()
+		return
+	case err != nil && r.Context().Err() != nil:
+		setOutcome(r.Context(), "client_gone")
+		return
+	case err != nil:
+		reject(w, r, http.StatusServiceUnavailable, "scan_unavailable", "malware scanner unavailable")
+		return
+	}
+
+	f, cfg, err := probeImage(b, ct)
+	if err != nil {
+		fail("UNSUPPORTED_FORMAT", "unsupported or invalid image")
+		write()
+		return
+	}
+	info.ContentType, info.Width, info.Height = f.ct, cfg.Width, cfg.Height
+	logAttrs(r.Context(), "input_format", f.ct, "input_width", cfg.Width, "input_height", cfg.Height)
+	if side := s.cfg.ValidateMinSide; min(cfg.Width, cfg.Height) < side {
+		fail("TOO_SMALL", "image must be at least %dpx on its shorter side", side)
+	}
+	if limit := s.cfg.PhotoMaxAspectRatio; limit > 0 && s.cfg.PhotoAspectMode == photoAspectReject && elongation(cfg) > limit {
+		fail("EXTREME_ASPECT_RATIO", "image is more elongated than the %g:1 a photo may be", limit)
+	}
+	switch err := s.checkLimits(cfg); {
+	case errors.Is(err, errTooManyPixels):
+		fail("TOO_MANY_PIXELS", "image exceeds %d pixel limit", s.cfg.MaxPixels)
+	case errors.Is(err, errAspectRatio):
+		fail("ASPECT_RATIO_EXCEEDED", "image aspect ratio exceeds %g:1 limit", s.cfg.MaxAspectRatio)
+	case errors.Is(err, errUnsupportedImage):
+		fail("UNSUPPORTED_FORMAT", "unsupported or invalid image")
+	}
+	if len(reasons) > 0 || (s.cfg.ValidateMinSharpness == 0 && !s.cfg.RejectBlankImages) {
+		// Past the limits the decode isn't safe, and a rejected upload
+		// doesn't need a sharpness anyway.
+		write()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.ProcessTimeout)
+	defer cancel()
+	var sharpness float64
+	var blank bool
+	err = s.runJob(ctx, func(ctx context.Context) error {
+		img, err := s.decodeFor(ctx, f, b, cfg, energyDim)
+		if err != nil {
+			return err
+		}
+		sharpness = meanEnergy(energyMap(img))
+		blank = isBlank(lumaStats(grayThumb(img)))
+		return nil
+	})
+	if errors.Is(err, errUnsupportedImage) {
+		fail("UNSUPPORTED_FORMAT", "unsupported or invalid image")
+		write()
+		return
+	}
+	if err != nil {
+		s.writeJobError(w, r, err)
+		return
+	}
+	sharpness = math.Round(sharpness*1e4) / 1e4
+	info.Sharpness = &sharpness
+	logAttrs(r.Context(), "sharpness", sharpness)
+	if s.cfg.RejectBlankImages && blank {
+		// A blank image is blurry too, but that's not what to tell the user.
+		fail("BLANK_IMAGE", "image is blank or nearly uniform")
+	} else if sharpness < s.cfg.ValidateMinSharpness {
+		fail("TOO_BLURRY", "image is too blurry: sharpness %g is under %g", sharpness, s.cfg.ValidateMinSharpness)
+	}
+	write()
+}
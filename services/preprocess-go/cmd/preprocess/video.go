@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/gif"
+	"image/png"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// video=mp4|webm turns an animated GIF upload into a short, silent clip for
+// the feed: user GIFs of food run to megabytes, and the same loop as H.264
+// or VP9 is a fraction of that. The work is done by ffmpeg at FFMPEG_PATH,
+// which the distroless image doesn't ship; without it, video= is a 400
+// VIDEO_DISABLED. The clip is scaled to fit max_dim, with even sides as
+// yuv420p needs, cut at VIDEO_MAX_DURATION, and carries no metadata. Only
+// GIF input is taken, and the pixel edits, sizes, crops and tiles don't
+// apply.
+
+// errTranscode is ffmpeg rejecting the input; failing to run it at all is
+// ours, not the caller's, and isn't wrapped.
+var errTranscode = errors.New("transcode failed")
+
+type videoFormat struct {
+	ct    string
+	codec []string // ffmpeg output options
+}
+
+var videoFormats = map[string]videoFormat{
+	// faststart puts the index first so the feed can start playing before
+	// the whole clip has loaded.
+	"mp4":  {"video/mp4", []string{"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-movflags", "+faststart"}},
+	"webm": {"video/webm", []string{"-c:v", "libvpx-vp9", "-b:v", "0", "-crf", "35", "-deadline", "good", "-cpu-used", "4", "-row-mt", "1"}},
+}
+
+func videoParam(r *http.Request) (string, error) {
+	switch v := r.URL.Query().Get("video"); v {
+	case "", "mp4", "webm":
+		return v, nil
+	default:
+		return "", fmt.Errorf("video must be mp4 or webm, got %q", v)
+	}
+}
+
+// videoSize fits w×h within maxDim, rounding down to even sides.
+func videoSize(w, h, maxDim int) (int, int) {
+	scale := math.Min(1, float64(maxDim)/float64(max(w, h)))
+	even := func(v int) int {
+		return max(2, int(math.Round(float64(v)*scale))&^1)
+	}
+	return even(w), even(h)
+}
+
+// transcodeGIF converts b, which must be a GIF, to format within maxDim.
+func (s *server) transcodeGIF(ctx context.Context, b []byte, format string, maxDim int) (*result, error) {
+	start := time.Now()
+	cfg, err := gif.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+	inputFormats.inc("image/gif")
+	logAttrs(ctx, "input_format", "image/gif", "input_width", cfg.Width, "input_height", cfg.Height)
+	if err := s.checkLimits(cfg); err != nil {
+		return nil, err
+	}
+	w, h := videoSize(cfg.Width, cfg.Height, maxDim)
+	vf := videoFormats[format]
+
+	// ffmpeg wants seekable files: +faststart rewrites the output, and
+	// reading GIFs from a pipe loses their frame timing on some builds.
+	dir, err := os.MkdirTemp("", "preprocess-video-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "in.gif"), filepath.Join(dir, "out."+format)
+	if err := os.WriteFile(in, b, 0o600); err != nil {
+		return nil, err
+	}
+	args := []string{"-f", "gif", "-i", in,
+		"-t", seconds(s.cfg.VideoMaxDuration),
+		"-an", "-map_metadata", "-1",
+		"-vf", fmt.Sprintf("scale=%d:%d:flags=lanczos", w, h), "-pix_fmt", "yuv420p"}
+	if err := s.ffmpeg(ctx, append(append(args, vf.codec...), out)...); err != nil {
+		return nil, err
+	}
+	body, err := os.ReadFile(out)
+	if err != nil {
+		return nil, err
+	}
+	observeStage(ctx, start, "transcode")
+	observeFormat("image/gif", start, len(b), len(body))
+	return &result{body: body, ct: vf.ct, origCT: "image/gif", width: w, height: h}, nil
+}
+
+// ffmpeg runs FFMPEG_PATH with args, wrapping its own complaints in
+// errTranscode.
+func (s *server) ffmpeg(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, s.cfg.FFmpegPath, append([]string{"-hide_banner", "-loglevel", "error", "-nostdin", "-y"}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var exit *exec.ExitError
+		if !errors.As(err, &exit) {
+			return err
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 512 {
+			msg = msg[len(msg)-512:]
+		}
+		return fmt.Errorf("%w: %v: %s", errTranscode, err, msg)
+	}
+	return nil
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// Short MP4 and MOV uploads, such as dish videos, are accepted anywhere an
+// image is: one frame is taken from the video and goes through the image
+// pipeline as if it had been uploaded itself. frame= picks it: middle, the
+// default, first, or sharpest of VIDEO_FRAME_SAMPLES evenly spaced samples.
+// This needs FFMPEG_PATH too; without it, a video is an unsupported format
+// like any other non-image.
+
+func frameParam(r *http.Request) (string, error) {
+	switch v := r.URL.Query().Get("frame"); v {
+	case "", "middle":
+		return "middle", nil
+	case "first", "sharpest":
+		return v, nil
+	default:
+		return "", fmt.Errorf("frame must be first, middle or sharpest, got %q", v)
+	}
+}
+
+// isVideo reports whether b looks like an MP4 or QuickTime file. HEIF and
+// AVIF images share the container, so their brands are left out.
+func isVideo(b []byte) bool {
+	return len(b) >= 12 && string(b[4:8]) == "ftyp" && !isHEIF(b)
+}
+
+// isoDuration reads a video's length from its movie header (moov/mvhd).
+func isoDuration(b []byte) (time.Duration, bool) {
+	moov, ok := isoBox(b, "moov")
+	if !ok {
+		return 0, false
+	}
+	mvhd, ok := isoBox(moov, "mvhd")
+	if !ok || len(mvhd) < 20 {
+		return 0, false
+	}
+	var scale, length uint64
+	if mvhd[0] == 1 {
+		if len(mvhd) < 32 {
+			return 0, false
+		}
+		scale, length = uint64(binary.BigEndian.Uint32(mvhd[20:])), binary.BigEndian.Uint64(mvhd[24:])
+	} else {
+		scale, length = uint64(binary.BigEndian.Uint32(mvhd[12:])), uint64(binary.BigEndian.Uint32(mvhd[16:]))
+	}
+	if scale == 0 || length == 0 || length/scale > 24*3600 {
+		return 0, false
+	}
+	return time.Duration(float64(length) / float64(scale) * float64(time.Second)), true
+}
+
+// isoBox finds the first box of type typ in b and returns its payload.
+func isoBox(b []byte, typ string) ([]byte, bool) {
+	for len(b) >= 8 {
+		size, hdr := uint64(binary.BigEndian.Uint32(b)), uint64(8)
+		switch size {
+		case 0: // runs to the end
+			size = uint64(len(b))
+		case 1: // 64-bit size follows the type
+			if len(b) < 16 {
+				return nil, false
+			}
+			size, hdr = binary.BigEndian.Uint64(b[8:]), 16
+		}
+		if size < hdr || size > uint64(len(b)) {
+			return nil, false
+		}
+		if string(b[4:8]) == typ {
+			return b[hdr:size], true
+		}
+		b = b[size:]
+	}
+	return nil, false
+}
+
+// videoFrame takes the frame mode names out of video b, as a PNG.
+func (s *server) videoFrame(ctx context.Context, b []byte, mode string) ([]byte, error) {
+	start := time.Now()
+	length, ok := isoDuration(b)
+	if !ok {
+		return nil, errUnsupportedImage
+	}
+	inputFormats.inc("video")
+	logAttrs(ctx, "input_format", "video", "video_seconds", length.Seconds(), "frame", mode)
+	var at []time.Duration
+	switch mode {
+	case "first":
+		at = []time.Duration{0}
+	case "middle":
+		at = []time.Duration{length / 2}
+	case "sharpest":
+		n := s.cfg.VideoFrameSamples
+		for i := 0; i < n; i++ {
+			at = append(at, length*time.Duration(2*i+1)/time.Duration(2*n))
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "preprocess-video-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "in")
+	if err := os.WriteFile(in, b, 0o600); err != nil {
+		return nil, err
+	}
+	var best []byte
+	bestScore := -1.0
+	for i, t := range at {
+		out := filepath.Join(dir, fmt.Sprintf("frame%d.png", i))
+		// -ss before -i seeks by keyframe index instead of decoding
+		// everything up to t.
+		if err := s.ffmpeg(ctx, "-ss", seconds(t), "-i", in, "-frames:v", "1", "-an", "-map_metadata", "-1", "-c:v", "png", out); err != nil {
+			return nil, err
+		}
+		frame, err := os.ReadFile(out)
+		if err != nil {
+			// ffmpeg exits cleanly when there was no frame at t.
+			return nil, fmt.Errorf("%w: no frame at %s", errTranscode, seconds(t))
+		}
+		if len(at) == 1 {
+			best = frame
+			break
+		}
+		cfg, err := png.DecodeConfig(bytes.NewReader(frame))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errTranscode, err)
+		}
+		if err := s.checkLimits(cfg); err != nil {
+			return nil, err
+		}
+		img, err := png.Decode(bytes.NewReader(frame))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errTranscode, err)
+		}
+		if score := meanEnergy(energyMap(img)); score > bestScore {
+			best, bestScore = frame, score
+		}
+	}
+	observeStage(ctx, start, "extract")
+	return best, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errOverloaded = errors.New("worker queue full")
+
+// Priority lanes. A freed slot goes to an interactive job, and to a batch
+// job only when none is waiting, so app uploads don't time out behind a
+// backfill that filled the queue.
+const (
+	laneInteractive = iota
+	laneBatch
+	numLanes
+)
+
+var laneNames = [numLanes]string{"interactive", "batch"}
+
+// workPool bounds concurrent pixel work to a fixed number of slots and lets
+// at most maxQueue requests wait for one. Past that, callers are shed
+// immediately rather than piling up behind a saturated CPU.
+type workPool struct {
+	mu       sync.Mutex
+	workers  int
+	active   int
+	waiting  [numLanes]fairQueue
+	maxQueue int
+	queued   int
+}
+
+func newWorkPool(workers, maxQueue int) *workPool {
+	return &workPool{workers: workers, maxQueue: maxQueue}
+}
+
+func (p *workPool) acquire(ctx context.Context, lane int, client string) error {
+	p.mu.Lock()
+	// Freed slots are handed straight to waiters, so a free one means
+	// nobody is waiting.
+	if p.active < p.workers {
+		p.active++
+		p.mu.Unlock()
+		return nil
+	}
+	if p.queued >= p.maxQueue {
+		p.mu.Unlock()
+		return errOverloaded
+	}
+	ready := make(chan struct{})
+	p.waiting[lane].push(client, ready)
+	p.queued++
+	p.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.waiting[lane].remove(client, ready) {
+		p.queued--
+		return ctx.Err()
+	}
+	// Handed a slot as the context ended: pass it on.
+	p.releaseLocked()
+	return ctx.Err()
+}
+
+func (p *workPool) release() {
+	p.mu.Lock()
+	p.releaseLocked()
+	p.mu.Unlock()
+}
+
+func (p *workPool) releaseLocked() {
+	for lane := range p.waiting {
+		if ready := p.waiting[lane].pop(); ready != nil {
+			close(ready)
+			p.queued--
+			return
+		}
+	}
+	p.active--
+}
+
+// fairQueue holds one lane's waiters, FIFO per client, and serves the
+// clients round-robin. A waiter's channel is closed when it's handed a slot.
+type fairQueue struct {
+	byClient map[string][]chan struct{}
+	turns    []string // clients with waiters, next to be served first
+	n        int
+}
+
+func (q *fairQueue) push(client string, ready chan struct{}) {
+	if q.byClient == nil {
+		q.byClient = map[string][]chan struct{}{}
+	}
+	if len(q.byClient[client]) == 0 {
+		q.turns = append(q.turns, client)
+	}
+	q.byClient[client] = append(q.byClient[client], ready)
+	q.n++
+}
+
+// pop takes the next client's oldest waiter and sends that client to the
+// back of the line, or returns nil if nobody is waiting.
+func (q *fairQueue) pop() chan struct{} {
+	if q.n == 0 {
+		return nil
+	}
+	client := q.turns[0]
+	waiters := q.byClient[client]
+	ready := waiters[0]
+	q.turns = q.turns[1:]
+	if len(waiters) > 1 {
+		q.byClient[client] = waiters[1:]
+		q.turns = append(q.turns, client)
+	} else {
+		delete(q.byClient, client)
+	}
+	q.n--
+	return ready
+}
+
+// remove drops a waiter that gave up, reporting false if it was already
+// handed a slot.
+func (q *fairQueue) remove(client string, ready chan struct{}) bool {
+	waiters := q.byClient[client]
+	for i, c := range waiters {
+		if c != ready {
+			continue
+		}
+		if len(waiters) > 1 {
+			q.byClient[client] = append(waiters[:i:i], waiters[i+1:]...)
+		} else {
+			delete(q.byClient, client)
+			for k, t := range q.turns {
+				if t == client {
+					q.turns = append(q.turns[:k], q.turns[k+1:]...)
+					break
+				}
+			}
+		}
+		q.n--
+		return true
+	}
+	return false
+}
+
+type poolStats struct {
+	Workers       int `json:"workers"`
+	Active        int `json:"active"`
+	Queued        int `json:"queued"`
+	QueuedBatch   int `json:"queued_batch"` // of Queued
+	QueueCapacity int `json:"queue_capacity"`
+}
+
+func (p *workPool) stats() poolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return poolStats{
+		Workers:       p.workers,
+		Active:        p.active,
+		Queued:        p.queued,
+		QueuedBatch:   p.waiting[laneBatch].n,
+		QueueCapacity: p.maxQueue,
+	}
+}
+
+// activeJob is one runJob call, for GET /admin/jobs.
+type activeJob struct {
+	RequestID string     `json:"request_id"`
+	Path      string     `json:"path"`
+	Caller    string     `json:"caller,omitempty"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Priority  string     `json:"priority"`
+	Queued    time.Time  `json:"queued"`
+	Started   *time.Time `json:"started,omitempty"` // nil while waiting for a slot
+}
+
+// jobRegistry tracks jobs from queueing until their work actually stops,
+// which for a job past its deadline can be after the response went out.
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[*activeJob]struct{}
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{jobs: map[*activeJob]struct{}{}}
+}
+
+func (g *jobRegistry) add(ctx context.Context) *activeJob {
+	lane, _ := schedule(ctx)
+	j := &activeJob{RequestID: requestID(ctx), Path: requestPath(ctx), Caller: callerName(ctx), Tenant: tenantName(ctx), Priority: laneNames[lane], Queued: time.Now()}
+	g.mu.Lock()
+	g.jobs[j] = struct{}{}
+	g.mu.Unlock()
+	return j
+}
+
+func (g *jobRegistry) start(j *activeJob) {
+	now := time.Now()
+	g.mu.Lock()
+	j.Started = &now
+	g.mu.Unlock()
+}
+
+func (g *jobRegistry) done(j *activeJob) {
+	g.mu.Lock()
+	delete(g.jobs, j)
+	g.mu.Unlock()
+}
+
+// list returns copies of the active jobs, oldest first.
+func (g *jobRegistry) list() []activeJob {
+	g.mu.Lock()
+	out := make([]activeJob, 0, len(g.jobs))
+	for j := range g.jobs {
+		out = append(out, *j)
+	}
+	g.mu.Unlock()
+	sort.Slice(out, func(i, k int) bool { return out[i].Queued.Before(out[k].Queued) })
+	return out
+}
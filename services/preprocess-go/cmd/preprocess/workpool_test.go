@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFairQueueRoundRobin(t *testing.T) {
+	var q fairQueue
+	named := map[chan struct{}]string{}
+	push := func(client, name string) {
+		c := make(chan struct{})
+		named[c] = name
+		q.push(client, c)
+	}
+	// A backfill client queues first and deep; the others still get turns.
+	push("backfill", "b1")
+	push("backfill", "b2")
+	push("backfill", "b3")
+	push("app", "a1")
+	push("web", "w1")
+	push("app", "a2")
+
+	var got []string
+	for c := q.pop(); c != nil; c = q.pop() {
+		got = append(got, named[c])
+	}
+	want := []string{"b1", "a1", "w1", "b2", "a2", "b3"}
+	if len(got) != len(want) {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("order = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestFairQueueRemove(t *testing.T) {
+	var q fairQueue
+	a1, a2, b1 := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	q.push("a", a1)
+	q.push("a", a2)
+	q.push("b", b1)
+	if !q.remove("a", a1) {
+		t.Fatal("remove of a waiting channel reported false")
+	}
+	if !q.remove("b", b1) {
+		t.Fatal("remove of b's only waiter reported false")
+	}
+	if q.remove("b", b1) {
+		t.Error("second remove reported true")
+	}
+	if c := q.pop(); c != a2 {
+		t.Errorf("pop after removals = %v, want a's second waiter", c)
+	}
+	if c := q.pop(); c != nil || q.n != 0 {
+		t.Errorf("queue not empty: pop = %v, n = %d", c, q.n)
+	}
+}
+
+func TestWorkPoolLanes(t *testing.T) {
+	p := newWorkPool(1, 4)
+	ctx := context.Background()
+	if err := p.acquire(ctx, laneInteractive, "app"); err != nil {
+		t.Fatal(err)
+	}
+	order := make(chan string, 2)
+	wait := func(lane int, name string) {
+		if err := p.acquire(ctx, lane, name); err != nil {
+			t.Error(err)
+			return
+		}
+		order <- name
+		p.release()
+	}
+	go wait(laneBatch, "batch")
+	waitQueued(t, p, 1)
+	go wait(laneInteractive, "interactive")
+	waitQueued(t, p, 2)
+
+	p.release()
+	if first, second := <-order, <-order; first != "interactive" || second != "batch" {
+		t.Errorf("slots went to %s then %s, want interactive first", first, second)
+	}
+	if st := p.stats(); st.Active != 0 || st.Queued != 0 {
+		t.Errorf("stats after draining = %+v", st)
+	}
+}
+
+func TestWorkPoolShedsAndCancels(t *testing.T) {
+	p := newWorkPool(1, 1)
+	if err := p.acquire(context.Background(), laneInteractive, ""); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- p.acquire(ctx, laneInteractive, "") }()
+	waitQueued(t, p, 1)
+	if err := p.acquire(context.Background(), laneInteractive, ""); !errors.Is(err, errOverloaded) {
+		t.Errorf("acquire with a full queue = %v, want %v", err, errOverloaded)
+	}
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled waiter = %v, want %v", err, context.Canceled)
+	}
+	p.release()
+	if st := p.stats(); st.Active != 0 || st.Queued != 0 {
+		t.Errorf("stats = %+v, want idle", st)
+	}
+}
+
+func waitQueued(t *testing.T, p *workPool, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); p.stats().Queued < n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d waiters never queued", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}